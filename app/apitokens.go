@@ -0,0 +1,409 @@
+// app/apitokens.go
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Prefix of API tokens, so leaked tokens are easy to recognize
+const apiTokenPrefix = "fh_"
+
+// Limits of the token lifetime in days
+const (
+	defaultAPITokenDays = 90
+	maxAPITokenDays     = 365
+)
+
+// Errors returned by the API token functions
+var (
+	errInvalidAPIToken = errors.New("invalid or expired API token")
+	errAPITokenScope   = errors.New("token scopes can't exceed your own roles")
+	errAPITokenOwner   = errors.New("the owner of the token must change their password or set up two-factor authentication")
+)
+
+// Paths API tokens can't be used on, so a leaked token can't create new
+// tokens, change the account that owns it, manage users, turn off the
+// two-factor requirement, or reach the data subject requests, the audit log and
+// the retention policies, which are owner-only
+var apiTokenDeniedPrefixes = []string{"/api/account", "/api/tokens", "/api/users", "/api/settings", "/api/data-subject", "/api/audit", "/api/retention"}
+
+// apiToken is a token for programmatic access to the admin API. Personal
+// tokens act as the user who created them, limited to the scopes of the token.
+// Service tokens belong to no user and have exactly their scopes.
+type apiToken struct {
+	ID         int64             `json:"id"`
+	UserID     *int64            `json:"user_id,omitempty"`
+	Name       string            `json:"name"`
+	Prefix     string            `json:"prefix"`
+	Scopes     map[string]string `json:"scopes"`
+	CreatedBy  string            `json:"created_by"`
+	CreatedAt  time.Time         `json:"created_at"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	LastUsedAt *time.Time        `json:"last_used_at"`
+}
+
+// Return the hash under which a token is stored
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Return the bearer token of a request, or an empty string
+func bearerToken(r *http.Request) string {
+	const scheme = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(scheme):])
+}
+
+// Create a token and return it with its plain text value, which is not stored
+func createAPIToken(userID *int64, name string, scopes map[string]string, days int, createdBy string) (*apiToken, string, error) {
+	for formID, role := range scopes {
+		if formID == "" || !validRole(role) {
+			return nil, "", fmt.Errorf("invalid scope %q on form %q", role, formID)
+		}
+	}
+	random, err := randomToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("error generating token: %v", err)
+	}
+	plain := apiTokenPrefix + random
+
+	db, err := getDB()
+	if err != nil {
+		return nil, "", fmt.Errorf("error opening database: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	t := &apiToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    plain[:len(apiTokenPrefix)+6],
+		Scopes:    scopes,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, days),
+	}
+	result, err := tx.Exec(`INSERT INTO api_tokens(user_id, name, token_hash, prefix, created_by, created_at, expires_at)
+        VALUES(?, ?, ?, ?, ?, ?, ?)`, userID, name, hashAPIToken(plain), t.Prefix, createdBy, t.CreatedAt, t.ExpiresAt)
+	if err != nil {
+		return nil, "", fmt.Errorf("error inserting token: %v", err)
+	}
+	t.ID, _ = result.LastInsertId()
+	for formID, role := range scopes {
+		if _, err := tx.Exec("INSERT INTO api_token_scopes(token_id, form_id, role) VALUES(?, ?, ?)", t.ID, formID, role); err != nil {
+			return nil, "", fmt.Errorf("error inserting token scope: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", fmt.Errorf("error committing token: %v", err)
+	}
+	return t, plain, nil
+}
+
+// Load the scopes of a token
+func loadAPITokenScopes(db *sql.DB, t *apiToken) error {
+	rows, err := db.Query("SELECT form_id, role FROM api_token_scopes WHERE token_id = ?", t.ID)
+	if err != nil {
+		return fmt.Errorf("error querying token scopes: %v", err)
+	}
+	defer rows.Close()
+
+	t.Scopes = make(map[string]string)
+	for rows.Next() {
+		var formID, role string
+		if err := rows.Scan(&formID, &role); err != nil {
+			return fmt.Errorf("error scanning token scope: %v", err)
+		}
+		t.Scopes[formID] = role
+	}
+	return rows.Err()
+}
+
+// List the personal tokens of a user, and the service tokens when requested
+func listAPITokens(userID int64, withService bool) ([]*apiToken, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	rows, err := db.Query(`SELECT id, user_id, name, prefix, created_by, created_at, expires_at, last_used_at FROM api_tokens
+        WHERE user_id = ? OR (? AND user_id IS NULL) ORDER BY created_at DESC`, userID, withService)
+	if err != nil {
+		return nil, fmt.Errorf("error querying tokens: %v", err)
+	}
+	defer rows.Close()
+
+	tokens := []*apiToken{}
+	for rows.Next() {
+		t := &apiToken{}
+		var owner sql.NullInt64
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&t.ID, &owner, &t.Name, &t.Prefix, &t.CreatedBy, &t.CreatedAt, &t.ExpiresAt, &lastUsed); err != nil {
+			return nil, fmt.Errorf("error scanning token: %v", err)
+		}
+		if owner.Valid {
+			t.UserID = &owner.Int64
+		}
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, t := range tokens {
+		if err := loadAPITokenScopes(db, t); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// Delete a token of a user, or a service token when allowed
+func deleteAPIToken(id, userID int64, withService bool) (bool, error) {
+	db, err := getDB()
+	if err != nil {
+		return false, fmt.Errorf("error opening database: %v", err)
+	}
+	result, err := db.Exec("DELETE FROM api_tokens WHERE id = ? AND (user_id = ? OR (? AND user_id IS NULL))", id, userID, withService)
+	if err != nil {
+		return false, fmt.Errorf("error deleting token: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	if n == 0 {
+		return false, nil
+	}
+	if _, err := db.Exec("DELETE FROM api_token_scopes WHERE token_id = ?", id); err != nil {
+		return false, fmt.Errorf("error deleting token scopes: %v", err)
+	}
+	return true, nil
+}
+
+// Delete the personal tokens of a user
+func deleteUserAPITokens(userID int64) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM api_token_scopes WHERE token_id IN (SELECT id FROM api_tokens WHERE user_id = ?)", userID); err != nil {
+		return fmt.Errorf("error deleting token scopes: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM api_tokens WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting tokens: %v", err)
+	}
+	return nil
+}
+
+// Return the user a token acts as. Personal tokens get the lower of the token
+// scope and the current role of their user on every form, service tokens get
+// their scopes.
+func authenticateAPIToken(plain string) (*user, error) {
+	if !strings.HasPrefix(plain, apiTokenPrefix) {
+		return nil, errInvalidAPIToken
+	}
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+
+	t := &apiToken{}
+	var owner sql.NullInt64
+	now := time.Now().UTC()
+	err = db.QueryRow("SELECT id, user_id, name FROM api_tokens WHERE token_hash = ? AND expires_at > ?", hashAPIToken(plain), now).
+		Scan(&t.ID, &owner, &t.Name)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidAPIToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying token: %v", err)
+	}
+	if err := loadAPITokenScopes(db, t); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, t.ID); err != nil {
+		log.Errorf("Error updating token usage: %v", err)
+	}
+
+	if !owner.Valid {
+		return &user{Username: "service:" + t.Name, Grants: t.Scopes}, nil
+	}
+	u, err := getUserByID(owner.Int64)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Tokens can't skip the password change or two-factor setup required of their owner
+	if u.MustReset || needsTwoFactorSetup(u) {
+		return nil, errAPITokenOwner
+	}
+	u.Grants = intersectGrants(u, &user{Grants: t.Scopes})
+	return u, nil
+}
+
+// Return the grants giving on every form the lower role of the two users
+func intersectGrants(a, b *user) map[string]string {
+	grants := make(map[string]string)
+	for _, g := range []map[string]string{a.Grants, b.Grants} {
+		for formID := range g {
+			role, other := a.roleFor(formID), b.roleFor(formID)
+			if roleLevels[other] < roleLevels[role] {
+				role = other
+			}
+			if role != "" {
+				grants[formID] = role
+			}
+		}
+	}
+	return grants
+}
+
+// Check whether the request is sent to a path API tokens can't be used on
+func apiTokenDenied(path string) bool {
+	for _, prefix := range apiTokenDeniedPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler to view the API tokens page
+func viewAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/tokens.html")
+}
+
+// API handler to fetch the tokens of the current user, and the service tokens for owners
+func apiTokensHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	tokens, err := listAPITokens(u.ID, u.canAll(roleOwner))
+	if err != nil {
+		log.Errorf("Error fetching API tokens: %v", err)
+		jsonError(w, "Could not fetch API tokens", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// API handler to create a token
+func createAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name          string            `json:"name"`
+		Scopes        map[string]string `json:"scopes"`
+		ExpiresInDays int               `json:"expires_in_days"`
+		Service       bool              `json:"service"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" {
+		jsonError(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if len(request.Scopes) == 0 {
+		jsonError(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	if request.ExpiresInDays == 0 {
+		request.ExpiresInDays = defaultAPITokenDays
+	}
+	if request.ExpiresInDays < 0 || request.ExpiresInDays > maxAPITokenDays {
+		jsonError(w, fmt.Sprintf("Expiry must be between 1 and %d days", maxAPITokenDays), http.StatusBadRequest)
+		return
+	}
+
+	// Tokens can't grant more than the user has, and service tokens outlive users so only owners create them
+	u := currentUser(r)
+	for formID, role := range request.Scopes {
+		if formID == "" || !validRole(role) {
+			jsonError(w, fmt.Sprintf("Invalid scope %q on form %q", role, formID), http.StatusBadRequest)
+			return
+		}
+		allowed := u.can(role, formID)
+		if formID == allForms {
+			allowed = u.canAll(role)
+		}
+		if !allowed {
+			jsonError(w, errAPITokenScope.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	var owner *int64
+	if request.Service {
+		if !authorizeAll(w, r, roleOwner) {
+			return
+		}
+	} else {
+		owner = &u.ID
+	}
+
+	t, plain, err := createAPIToken(owner, request.Name, request.Scopes, request.ExpiresInDays, u.Username)
+	if err != nil {
+		log.Errorf("Error creating API token: %v", err)
+		jsonError(w, "Could not create API token", http.StatusInternalServerError)
+		return
+	}
+
+	scopes := make([]string, 0, len(t.Scopes))
+	for formID, role := range t.Scopes {
+		scopes = append(scopes, formID+"="+role)
+	}
+	sort.Strings(scopes)
+	recordAudit(r, "api_token.create", fmt.Sprintf("%s (%s)", t.Name, strings.Join(scopes, ", ")))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   plain,
+		"details": t,
+	})
+}
+
+// API handler to delete a token
+func deleteAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	var id int64
+	if _, err := fmt.Sscan(mux.Vars(r)["id"], &id); err != nil {
+		jsonError(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	found, err := deleteAPIToken(id, u.ID, u.canAll(roleOwner))
+	if err != nil {
+		log.Errorf("Error deleting API token %d: %v", id, err)
+		jsonError(w, "Could not delete API token", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		jsonError(w, "API token not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, "api_token.delete", fmt.Sprintf("token %d", id))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,79 @@
+// app/apitokens_test.go
+package main
+
+import (
+	"testing"
+)
+
+func TestAPITokenDenied(t *testing.T) {
+	tests := []struct {
+		path   string
+		denied bool
+	}{
+		{"/api/submissions", false},
+		{"/api/forms/contact/export", false},
+		{"/api/tokens", true},
+		{"/api/tokens/1", true},
+		{"/api/account/password", true},
+		{"/api/users", true},
+		{"/api/users/2/grants", true},
+		{"/api/users/2/reset", true},
+		{"/api/settings", true},
+		{"/api/usersettings", false},
+		{"/api/data-subject", true},
+		{"/api/data-subject/export", true},
+		{"/api/audit", true},
+		{"/api/audit/export", true},
+		{"/api/retention", true},
+	}
+	for _, tt := range tests {
+		if got := apiTokenDenied(tt.path); got != tt.denied {
+			t.Errorf("apiTokenDenied(%q) = %t, want %t", tt.path, got, tt.denied)
+		}
+	}
+}
+
+func TestAuthenticateAPITokenOwner(t *testing.T) {
+	useTestDB(t)
+	u, err := createUser("scripter", "correct horse battery staple", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setGrants(u.ID, map[string]string{"*": roleEditor}); err != nil {
+		t.Fatal(err)
+	}
+	_, plain, err := createAPIToken(&u.ID, "script", map[string]string{"*": roleViewer}, defaultAPITokenDays, u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := authenticateAPIToken(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != u.ID || got.Grants["*"] != roleViewer {
+		t.Errorf("token acts as user %d with grants %v, want user %d with viewer", got.ID, got.Grants, u.ID)
+	}
+
+	// The token is refused while its owner must change their password
+	if err := forceUserPasswordReset(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIToken(plain); err != errAPITokenOwner {
+		t.Errorf("token of a user who must change their password: error %v, want %v", err, errAPITokenOwner)
+	}
+	if err := setUserPassword(u.ID, "another horse battery staple", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIToken(plain); err != nil {
+		t.Errorf("token after the password change: %v", err)
+	}
+
+	// Revoked tokens are unknown
+	if err := deleteUserAPITokens(u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIToken(plain); err != errInvalidAPIToken {
+		t.Errorf("revoked token: error %v, want %v", err, errInvalidAPIToken)
+	}
+}
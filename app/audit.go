@@ -0,0 +1,301 @@
+// app/audit.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Actor of the changes to config.json, which is edited outside the admin panel
+const configFileActor = "config file"
+
+// Setting holding the version of config.json recorded last in the audit log
+const settingConfigVersion = "config_version"
+
+// auditEntry is an action recorded in the audit log
+type auditEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+}
+
+// auditFilter selects entries of the audit log, newest first
+type auditFilter struct {
+	Actor  string
+	Action string
+	IP     string
+	Search string
+	From   time.Time
+	To     time.Time
+	Before int64
+	Limit  int
+}
+
+// Record an admin action together with the user who performed it
+func recordAudit(r *http.Request, action, target string) {
+	recordAuditAs(r, usernameOf(currentUser(r)), action, target)
+}
+
+// Record an action performed by the given actor, for requests without an authenticated user
+func recordAuditAs(r *http.Request, actor, action, target string) {
+	ip, _ := clientIP(r)
+	appendAudit(auditEntry{Actor: actor, Action: action, Target: target, IP: ip})
+}
+
+// Append an entry to the audit log. When it can't be stored, the entry is
+// written to the application log so it isn't lost.
+func appendAudit(entry auditEntry) {
+	entry.CreatedAt = time.Now().UTC()
+	db, err := getDB()
+	if err == nil {
+		_, err = db.Exec("INSERT INTO audit_log(created_at, actor, action, target, ip) VALUES(?, ?, ?, ?, ?)",
+			entry.CreatedAt.Format(sqliteTimestampFormat), entry.Actor, entry.Action, entry.Target, entry.IP)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"audit":  true,
+			"actor":  entry.Actor,
+			"action": entry.Action,
+			"target": entry.Target,
+			"ip":     entry.IP,
+		}).Errorf("Error recording audit entry: %v", err)
+	}
+}
+
+// Version of config.json recorded last, cached to avoid a query on every load
+var auditedConfigVersion struct {
+	sync.Mutex
+	version string
+}
+
+// Record a change of config.json in the audit log the first time a new version is loaded
+func recordConfigVersion(version string) {
+	auditedConfigVersion.Lock()
+	defer auditedConfigVersion.Unlock()
+	if version == auditedConfigVersion.version {
+		return
+	}
+
+	previous, err := getSetting(settingConfigVersion, "")
+	if err != nil {
+		log.Errorf("Error checking the version of the configuration: %v", err)
+		return
+	}
+	if previous != version {
+		if err := setSetting(settingConfigVersion, version); err != nil {
+			log.Errorf("Error storing the version of the configuration: %v", err)
+			return
+		}
+		target := version
+		if previous != "" {
+			target = previous + " -> " + version
+		}
+		appendAudit(auditEntry{Actor: configFileActor, Action: "config.change", Target: target})
+	}
+	auditedConfigVersion.version = version
+}
+
+// Parse the filter and page of an audit log request
+func parseAuditFilter(query url.Values) (auditFilter, error) {
+	f := auditFilter{
+		Actor:  strings.TrimSpace(query.Get("actor")),
+		Action: strings.TrimSpace(query.Get("action")),
+		IP:     strings.TrimSpace(query.Get("ip")),
+		Search: strings.TrimSpace(query.Get("q")),
+		Limit:  defaultAuditLimit,
+	}
+	var err error
+	if value := query.Get("from"); value != "" {
+		if f.From, err = parseSubmissionDate(value, false); err != nil {
+			return f, err
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if f.To, err = parseSubmissionDate(value, true); err != nil {
+			return f, err
+		}
+	}
+	if value := query.Get("before"); value != "" {
+		if f.Before, err = strconv.ParseInt(value, 10, 64); err != nil || f.Before <= 0 {
+			return f, fmt.Errorf("invalid before %q", value)
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if f.Limit, err = strconv.Atoi(value); err != nil || f.Limit < 1 || f.Limit > maxAuditLimit {
+			return f, fmt.Errorf("invalid limit %q, use 1 to %d", value, maxAuditLimit)
+		}
+	}
+	return f, nil
+}
+
+// Build the WHERE clause of an audit log filter. Actions match by prefix, so
+// "submission." selects every action on submissions.
+func auditConditions(f auditFilter) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	if f.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "action LIKE ? ESCAPE '\\'")
+		args = append(args, strings.TrimPrefix(likePattern(f.Action), "%"))
+	}
+	if f.IP != "" {
+		conditions = append(conditions, "ip = ?")
+		args = append(args, f.IP)
+	}
+	if f.Search != "" {
+		conditions = append(conditions, "target LIKE ? ESCAPE '\\'")
+		args = append(args, likePattern(f.Search))
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.From.UTC().Format(sqliteTimestampFormat))
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, f.To.UTC().Format(sqliteTimestampFormat))
+	}
+	if f.Before > 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, f.Before)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// Return a page of the audit log, newest first, and the ID to pass as before
+// for the next page, or 0 on the last page
+func queryAudit(db *sql.DB, f auditFilter) ([]auditEntry, int64, error) {
+	where, args := auditConditions(f)
+	rows, err := db.Query("SELECT id, created_at, actor, action, target, ip FROM audit_log WHERE "+where+" ORDER BY id DESC LIMIT ?",
+		append(args, f.Limit+1)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying audit log: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.Action, &e.Target, &e.IP); err != nil {
+			return nil, 0, fmt.Errorf("error scanning audit entry: %v", err)
+		}
+		if len(entries) == f.Limit {
+			return entries, entries[len(entries)-1].ID, nil
+		}
+		entries = append(entries, e)
+	}
+	return entries, 0, rows.Err()
+}
+
+// Handler to view the audit log (admin)
+func viewAuditHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/audit.html")
+}
+
+// API handler to search the audit log (admin)
+func apiAuditHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		jsonError(w, "Could not connect to the database", http.StatusInternalServerError)
+		return
+	}
+
+	entries, next, err := queryAudit(db, filter)
+	if err != nil {
+		log.Errorf("Error querying audit log: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return
+	}
+	response := map[string]interface{}{"entries": entries}
+	if next > 0 {
+		response["next"] = next
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// API handler to download the audit log entries matching the filters as CSV
+// or JSON Lines (admin)
+func exportAuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("format")
+	format, ok := exportFormats[name]
+	if !ok || name == "xlsx" {
+		jsonError(w, "Invalid format, use csv or jsonl", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseAuditFilter(query)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = maxAuditLimit
+
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		jsonError(w, "Could not connect to the database", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("audit-log-%s.%s", time.Now().UTC().Format("2006-01-02"), name)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	recordAudit(r, "audit.export", strings.TrimPrefix(r.URL.RawQuery, "?"))
+
+	// The response has started, so errors from here on can only be logged
+	export, err := format.open(w, []string{"id", "created_at", "actor", "action", "target", "ip"})
+	if err != nil {
+		log.Errorf("Error writing export of audit log: %v", err)
+		return
+	}
+	for {
+		entries, next, err := queryAudit(db, filter)
+		if err != nil {
+			log.Errorf("Error querying audit log for export: %v", err)
+			return
+		}
+		for _, e := range entries {
+			if err := export.writeRow([]interface{}{e.ID, e.CreatedAt.Format(time.RFC3339), e.Actor, e.Action, e.Target, e.IP}); err != nil {
+				log.Errorf("Error writing export of audit log: %v", err)
+				return
+			}
+		}
+		if next == 0 {
+			break
+		}
+		filter.Before = next
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if err := export.close(); err != nil {
+		log.Errorf("Error writing export of audit log: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+// app/audit_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuditLogAppendOnly(t *testing.T) {
+	testDB := useTestDB(t)
+	r := withUser(httptest.NewRequest(http.MethodPost, "/api/users", nil), &user{ID: 1, Username: "alice"})
+	recordAudit(r, "user.create", "bob")
+	recordAudit(r, "user.delete", "bob")
+
+	// Recorded entries can't be changed or deleted
+	for _, statement := range []string{
+		"UPDATE audit_log SET actor = 'mallory'",
+		"DELETE FROM audit_log WHERE action = 'user.delete'",
+		"DELETE FROM audit_log",
+	} {
+		_, err := testDB.Exec(statement)
+		if err == nil || !strings.Contains(err.Error(), "append-only") {
+			t.Errorf("%s: error %v, want the append-only error", statement, err)
+		}
+	}
+
+	entries, next, err := queryAudit(testDB, auditFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || next != 0 {
+		t.Fatalf("%d entries after the rejected changes, want 2", len(entries))
+	}
+	if e := entries[0]; e.Actor != "alice" || e.Action != "user.delete" || e.Target != "bob" || e.IP != "192.0.2.1" {
+		t.Errorf("newest entry = %+v", e)
+	}
+}
+
+func TestQueryAudit(t *testing.T) {
+	testDB := useTestDB(t)
+	for _, entry := range []auditEntry{
+		{Actor: "alice", Action: "submission.delete", Target: "12", IP: "192.0.2.1"},
+		{Actor: "alice", Action: "submission.update", Target: "13", IP: "192.0.2.1"},
+		{Actor: "bob", Action: "submissions.export", Target: "form contact_100%", IP: "192.0.2.2"},
+		{Actor: "bob", Action: "login", IP: "192.0.2.2"},
+	} {
+		appendAudit(entry)
+	}
+
+	tests := []struct {
+		name   string
+		filter auditFilter
+		want   []string
+	}{
+		{"all", auditFilter{}, []string{"login", "submissions.export", "submission.update", "submission.delete"}},
+		{"actor", auditFilter{Actor: "alice"}, []string{"submission.update", "submission.delete"}},
+		{"action prefix", auditFilter{Action: "submission."}, []string{"submission.update", "submission.delete"}},
+		{"IP", auditFilter{IP: "192.0.2.2"}, []string{"login", "submissions.export"}},
+		{"search with wildcards", auditFilter{Search: "_100%"}, []string{"submissions.export"}},
+		{"search with an underscore", auditFilter{Search: "t_c"}, nil},
+	}
+	for _, tt := range tests {
+		// Read every page of one entry
+		var got []string
+		tt.filter.Limit = 1
+		for pages := 0; pages < 10; pages++ {
+			entries, next, err := queryAudit(testDB, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				got = append(got, e.Action)
+			}
+			if next == 0 {
+				break
+			}
+			tt.filter.Before = next
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Send the CSRF token of the session with every state-changing request of the admin pages
+(function () {
+    function csrfToken() {
+        const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+        return match ? decodeURIComponent(match[1]) : '';
+    }
+
+    // Add the token header to fetch requests that change state
+    const originalFetch = window.fetch;
+    window.fetch = function (resource, options = {}) {
+        const method = (options.method || 'GET').toUpperCase();
+        if (!['GET', 'HEAD', 'OPTIONS'].includes(method)) {
+            options.headers = new Headers(options.headers || {});
+            options.headers.set('X-CSRF-Token', csrfToken());
+        }
+        return originalFetch(resource, options);
+    };
+
+    // Add the token field to forms posted without scripts, such as the login form
+    document.addEventListener('submit', event => {
+        const form = event.target;
+        if (form.method.toLowerCase() !== 'post') {
+            return;
+        }
+        let input = form.querySelector('input[name="csrf_token"]');
+        if (!input) {
+            input = document.createElement('input');
+            input.type = 'hidden';
+            input.name = 'csrf_token';
+            form.appendChild(input);
+        }
+        input.value = csrfToken();
+    }, true);
+})();
@@ -0,0 +1,208 @@
+// app/bans.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Default settings of the automatic bans
+const (
+	defaultBanWindow       = time.Hour
+	defaultBanBaseDuration = 15 * time.Minute
+	defaultBanMaxDuration  = 24 * time.Hour
+	defaultBanResetAfter   = 7 * 24 * time.Hour
+)
+
+var bans *banList
+
+// ban is a temporary ban of an IP address
+type ban struct {
+	IP          string    `json:"ip"`
+	Level       int       `json:"level"`
+	Reason      string    `json:"reason"`
+	BannedUntil time.Time `json:"banned_until"`
+	CreatedAt   time.Time `json:"created_at"`
+	Active      bool      `json:"active"`
+}
+
+// banList bans IP addresses that repeatedly exceed the rate limits. Each ban
+// of the same IP address lasts twice as long as the previous one.
+type banList struct {
+	threshold    int
+	window       time.Duration
+	baseDuration time.Duration
+	maxDuration  time.Duration
+	resetAfter   time.Duration
+}
+
+// Parse an optional duration setting
+func parseDurationSetting(name, value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return d, nil
+}
+
+// Initialize the ban list from the configuration. A threshold of 0 disables automatic bans.
+func newBanList(config AutoBan) (*banList, error) {
+	b := &banList{threshold: config.Threshold}
+	var err error
+	if b.window, err = parseDurationSetting("auto_ban.window", config.Window, defaultBanWindow); err != nil {
+		return nil, err
+	}
+	if b.baseDuration, err = parseDurationSetting("auto_ban.base_duration", config.BaseDuration, defaultBanBaseDuration); err != nil {
+		return nil, err
+	}
+	if b.maxDuration, err = parseDurationSetting("auto_ban.max_duration", config.MaxDuration, defaultBanMaxDuration); err != nil {
+		return nil, err
+	}
+	if b.resetAfter, err = parseDurationSetting("auto_ban.reset_after", config.ResetAfter, defaultBanResetAfter); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Return the duration of a ban at the given escalation level
+func (b *banList) duration(level int) time.Duration {
+	d := b.baseDuration
+	for i := 1; i < level && d < b.maxDuration; i++ {
+		d *= 2
+	}
+	return min(d, b.maxDuration)
+}
+
+// Check whether an IP address is banned and until when
+func (b *banList) bannedUntil(ip string) (time.Time, bool, error) {
+	db, err := getDB()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error opening database: %v", err)
+	}
+
+	var until time.Time
+	err = db.QueryRow("SELECT banned_until FROM bans WHERE ip = ?", ip).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("error querying ban: %v", err)
+	}
+	return until, time.Now().Before(until), nil
+}
+
+// Record a rate limit violation and ban the IP address once it reaches the threshold
+func (b *banList) recordViolation(ip, formID string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("INSERT INTO rate_limit_violations(ip, form_id, created_at) VALUES(?, ?, ?)", ip, formID, now); err != nil {
+		return fmt.Errorf("error recording violation: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM rate_limit_violations WHERE created_at < ?", now.Add(-b.window)); err != nil {
+		return fmt.Errorf("error cleaning up violations: %v", err)
+	}
+
+	var violations int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM rate_limit_violations WHERE ip = ?", ip).Scan(&violations); err != nil {
+		return fmt.Errorf("error counting violations: %v", err)
+	}
+	if violations < b.threshold {
+		return tx.Commit()
+	}
+
+	level := 1
+	var previousLevel int
+	var previousUntil time.Time
+	err = tx.QueryRow("SELECT level, banned_until FROM bans WHERE ip = ?", ip).Scan(&previousLevel, &previousUntil)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return fmt.Errorf("error querying ban: %v", err)
+	case now.Before(previousUntil):
+		// Already banned, requests are rejected before they reach the rate limiter
+		return tx.Commit()
+	case now.Sub(previousUntil) < b.resetAfter:
+		level = previousLevel + 1
+	}
+
+	duration := b.duration(level)
+	reason := fmt.Sprintf("%d rate limit violations within %s", violations, b.window)
+	_, err = tx.Exec(`INSERT INTO bans(ip, level, reason, banned_until, created_at) VALUES(?, ?, ?, ?, ?)
+        ON CONFLICT(ip) DO UPDATE SET level = excluded.level, reason = excluded.reason,
+            banned_until = excluded.banned_until, created_at = excluded.created_at`,
+		ip, level, reason, now.Add(duration), now)
+	if err != nil {
+		return fmt.Errorf("error saving ban: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM rate_limit_violations WHERE ip = ?", ip); err != nil {
+		return fmt.Errorf("error clearing violations: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	log.Warnf("IP %s banned for %s (level %d): %s", ip, duration, level, reason)
+	return nil
+}
+
+// List the bans, including expired ones that still count towards escalation
+func (b *banList) list() ([]ban, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+
+	rows, err := db.Query("SELECT ip, level, reason, banned_until, created_at FROM bans ORDER BY banned_until DESC")
+	if err != nil {
+		return nil, fmt.Errorf("error querying bans: %v", err)
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	result := []ban{}
+	for rows.Next() {
+		var entry ban
+		if err := rows.Scan(&entry.IP, &entry.Level, &entry.Reason, &entry.BannedUntil, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning ban: %v", err)
+		}
+		entry.Active = now.Before(entry.BannedUntil)
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+// Lift the ban of an IP address and forget its escalation level
+func (b *banList) unban(ip string) (bool, error) {
+	db, err := getDB()
+	if err != nil {
+		return false, fmt.Errorf("error opening database: %v", err)
+	}
+
+	result, err := db.Exec("DELETE FROM bans WHERE ip = ?", ip)
+	if err != nil {
+		return false, fmt.Errorf("error deleting ban: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM rate_limit_violations WHERE ip = ?", ip); err != nil {
+		return false, fmt.Errorf("error clearing violations: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
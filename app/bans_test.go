@@ -0,0 +1,81 @@
+// app/bans_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanEscalation(t *testing.T) {
+	testDB := useTestDB(t)
+	b, err := newBanList(AutoBan{Threshold: 2, BaseDuration: "1m", MaxDuration: "3m", ResetAfter: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ip = "203.0.113.9"
+
+	// Reach the threshold and check the ban that follows
+	offend := func(wantLevel int, wantDuration time.Duration) {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			if _, banned, _ := b.bannedUntil(ip); banned {
+				t.Fatalf("banned after %d violations, want after 2", i)
+			}
+			if err := b.recordViolation(ip, "contact"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		until, banned, err := b.bannedUntil(ip)
+		if err != nil || !banned {
+			t.Fatalf("not banned after reaching the threshold: %v", err)
+		}
+		bans, err := b.list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bans) != 1 || bans[0].Level != wantLevel {
+			t.Fatalf("bans = %+v, want one at level %d", bans, wantLevel)
+		}
+		if d := time.Until(until); d > wantDuration || d < wantDuration-time.Minute/2 {
+			t.Errorf("level %d ban lasts %s, want %s", wantLevel, d.Round(time.Second), wantDuration)
+		}
+	}
+	// End the ban, as if it ended the given time ago
+	expire := func(ago time.Duration) {
+		t.Helper()
+		if _, err := testDB.Exec("UPDATE bans SET banned_until = ?", time.Now().UTC().Add(-ago)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offend(1, time.Minute)
+	expire(time.Second)
+	offend(2, 2*time.Minute)
+	expire(time.Second)
+	offend(3, 3*time.Minute)
+
+	// The escalation is forgotten once reset_after has passed since the last ban
+	expire(2 * time.Hour)
+	offend(1, time.Minute)
+
+	// Unbanning forgets the escalation too
+	if lifted, err := b.unban(ip); err != nil || !lifted {
+		t.Fatalf("unban: %t, %v", lifted, err)
+	}
+	offend(1, time.Minute)
+}
+
+func TestBanDuration(t *testing.T) {
+	b, err := newBanList(AutoBan{Threshold: 1, BaseDuration: "15m", MaxDuration: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for level, want := range map[int]time.Duration{1: 15 * time.Minute, 2: 30 * time.Minute, 3: time.Hour, 10: time.Hour} {
+		if got := b.duration(level); got != want {
+			t.Errorf("duration of level %d = %s, want %s", level, got, want)
+		}
+	}
+	if _, err := newBanList(AutoBan{Threshold: 1, Window: "-1m"}); err == nil {
+		t.Error("negative window accepted")
+	}
+}
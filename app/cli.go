@@ -0,0 +1,422 @@
+// app/cli.go
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const cliUsage = `Usage: form-handler <command> [arguments]
+
+Commands:
+  user add [-must-reset] [-role <role>] [-forms <ids>] <username>
+                                      Create a user, the password is read from stdin
+  user passwd <username>              Set the password of a user
+  user reset <username>               Require a user to change their password at the next login
+  user reset-2fa <username>           Remove two-factor authentication of a user who lost their device
+  user delete <username>              Delete a user
+  user list                           List the users and their roles
+  user grant <username> <form> <role> Give a user a role (owner, editor or viewer) on a form, or * for all forms
+  user revoke <username> <form>       Remove the role of a user on a form
+  encryption keygen                   Print a new key for ENCRYPTION_KEY
+  encryption rotate                   Re-encrypt submissions and files with the current ENCRYPTION_KEY
+  migrate status                      List the database migrations and whether they are applied
+  migrate up                          Apply the pending database migrations
+  migrate down [-force] [<version>]   Roll back the migrations after a version, by default the last one
+  migrate submissions <command>       Run a migrate command on the database of SUBMISSIONS_DATABASE_URL
+`
+
+// Run a command line subcommand and return the process exit code
+func runCLI(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "user":
+		initDatabase()
+		err = runUserCommand(args[1], args[2:])
+	case "encryption":
+		initDatabase()
+		err = runEncryptionCommand(args[1], args[2:])
+	case "migrate":
+		// Migrations are run explicitly, so the database is not migrated first
+		err = runMigrateCommand(args[1], args[2:])
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Actor of the actions run from the command line in the audit log
+const cliActor = "command line"
+
+// Record an action run from the command line in the audit log
+func recordCLIAudit(action, target string) {
+	appendAudit(auditEntry{Actor: cliActor, Action: action, Target: target})
+}
+
+// Read a password from the terminal without echoing it, or from stdin when it is not a terminal
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Read a new password, asking twice on a terminal
+func readNewPassword() (string, error) {
+	password, err := readPassword("Password: ")
+	if err != nil {
+		return "", err
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		confirm, err := readPassword("Confirm password: ")
+		if err != nil {
+			return "", err
+		}
+		if confirm != password {
+			return "", fmt.Errorf("passwords do not match")
+		}
+	}
+	return password, nil
+}
+
+// Look up a user by username for a command
+func cliUser(args []string) (*user, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected exactly one username")
+	}
+	u, err := getUserByUsername(args[0])
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user %s not found", args[0])
+	}
+	return u, err
+}
+
+// Run a "user" subcommand
+func runUserCommand(command string, args []string) error {
+	switch command {
+	case "add":
+		flags := flag.NewFlagSet("user add", flag.ContinueOnError)
+		mustReset := flags.Bool("must-reset", false, "require a password change at the first login")
+		role := flags.String("role", roleViewer, "role of the user: owner, editor or viewer")
+		forms := flags.String("forms", allForms, "comma-separated form IDs the role applies to, or * for all forms")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return fmt.Errorf("expected exactly one username")
+		}
+		if !validRole(*role) {
+			return fmt.Errorf("invalid role %q", *role)
+		}
+		grants := map[string]string{}
+		for _, formID := range strings.Split(*forms, ",") {
+			if formID = strings.TrimSpace(formID); formID != "" {
+				grants[formID] = *role
+			}
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		u, err := createUser(flags.Arg(0), password, *mustReset)
+		if err != nil {
+			return err
+		}
+		if err := setGrants(u.ID, grants); err != nil {
+			return err
+		}
+		recordCLIAudit("user.create", u.Username)
+		fmt.Printf("User %s created\n", u.Username)
+
+	case "passwd":
+		u, err := cliUser(args)
+		if err != nil {
+			return err
+		}
+		password, err := readNewPassword()
+		if err != nil {
+			return err
+		}
+		if err := setUserPassword(u.ID, password, false); err != nil {
+			return err
+		}
+		if err := revokeUserSessions(u.ID, ""); err != nil {
+			return err
+		}
+		recordCLIAudit("user.password_change", u.Username)
+		fmt.Printf("Password of user %s changed\n", u.Username)
+
+	case "reset":
+		u, err := cliUser(args)
+		if err != nil {
+			return err
+		}
+		if err := forceUserPasswordReset(u.ID); err != nil {
+			return err
+		}
+		if err := revokeUserSessions(u.ID, ""); err != nil {
+			return err
+		}
+		if err := deleteUserAPITokens(u.ID); err != nil {
+			return err
+		}
+		recordCLIAudit("user.force_reset", u.Username)
+		fmt.Printf("User %s must change their password at the next login\n", u.Username)
+
+	case "reset-2fa":
+		u, err := cliUser(args)
+		if err != nil {
+			return err
+		}
+		if err := disableTOTP(u.ID); err != nil {
+			return err
+		}
+		if err := deleteUserAPITokens(u.ID); err != nil {
+			return err
+		}
+		recordCLIAudit("user.2fa_reset", u.Username)
+		fmt.Printf("Two-factor authentication of user %s removed\n", u.Username)
+
+	case "delete":
+		u, err := cliUser(args)
+		if err != nil {
+			return err
+		}
+		if err := deleteUser(u.ID); err != nil {
+			return err
+		}
+		recordCLIAudit("user.delete", u.Username)
+		fmt.Printf("User %s deleted\n", u.Username)
+
+	case "list":
+		users, err := listUsers()
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			status := ""
+			if u.MustReset {
+				status = " (must change password)"
+			}
+			if u.TOTPEnabled {
+				status += " (2FA)"
+			}
+			roles := []string{}
+			for formID, role := range u.Grants {
+				roles = append(roles, formID+"="+role)
+			}
+			sort.Strings(roles)
+			fmt.Printf("%s%s %s\n", u.Username, status, strings.Join(roles, ","))
+		}
+
+	case "grant":
+		if len(args) != 3 {
+			return fmt.Errorf("expected a username, a form ID and a role")
+		}
+		u, err := cliUser(args[:1])
+		if err != nil {
+			return err
+		}
+		formID, role := args[1], args[2]
+		if !validRole(role) {
+			return fmt.Errorf("invalid role %q", role)
+		}
+		u.Grants[formID] = role
+		if err := setGrants(u.ID, u.Grants); err != nil {
+			return err
+		}
+		recordCLIAudit("user.grants", fmt.Sprintf("%s %v", u.Username, u.Grants))
+		fmt.Printf("User %s is now %s on form %s\n", u.Username, role, formID)
+
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("expected a username and a form ID")
+		}
+		u, err := cliUser(args[:1])
+		if err != nil {
+			return err
+		}
+		formID := args[1]
+		if _, ok := u.Grants[formID]; !ok {
+			return fmt.Errorf("user %s has no role on form %s", u.Username, formID)
+		}
+		delete(u.Grants, formID)
+		if err := setGrants(u.ID, u.Grants); err != nil {
+			return err
+		}
+		recordCLIAudit("user.grants", fmt.Sprintf("%s %v", u.Username, u.Grants))
+		fmt.Printf("User %s no longer has a role on form %s\n", u.Username, formID)
+
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return fmt.Errorf("unknown command: user %s", command)
+	}
+	return nil
+}
+
+// Run an "encryption" subcommand
+func runEncryptionCommand(command string, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no arguments")
+	}
+	switch command {
+	case "keygen":
+		key, err := generateEncryptionKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+
+	case "rotate":
+		if err := initEncryption(); err != nil {
+			return err
+		}
+		config, err := loadConfig("/app/config/config.json")
+		if err != nil {
+			return err
+		}
+		values, files, err := rotateEncryption(config)
+		if err != nil {
+			return err
+		}
+		// The subject index depends on the current key too
+		indexed, err := indexSubmissions()
+		if err != nil {
+			return err
+		}
+		recordCLIAudit("encryption.rotate", fmt.Sprintf("%d values and %d files", values, files))
+		fmt.Printf("Re-encrypted %d values and %d files, and re-indexed %d names and email addresses\n", values, files, indexed)
+		return nil
+
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return fmt.Errorf("unknown command: encryption %s", command)
+	}
+}
+
+// Run a "migrate" subcommand on the application database, or with
+// "submissions" on the shared database storing the submissions
+func runMigrateCommand(command string, args []string) error {
+	var db *sql.DB
+	var dialect sqlDialect = &sqliteDialect{}
+	var err error
+	if command == "submissions" {
+		if os.Getenv("SUBMISSIONS_DATABASE_URL") == "" {
+			return fmt.Errorf("SUBMISSIONS_DATABASE_URL is not set, the submissions are stored in the application database")
+		}
+		if len(args) == 0 {
+			fmt.Fprint(os.Stderr, cliUsage)
+			return fmt.Errorf("expected a migrate command")
+		}
+		command, args = args[0], args[1:]
+		db, dialect, err = openSubmissionDatabase()
+	} else {
+		db, err = getDB()
+	}
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "status":
+		if len(args) != 0 {
+			return fmt.Errorf("expected no arguments")
+		}
+		statuses, err := migrationStatuses(db, dialect)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Schema version %d\n", schemaVersion(statuses))
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s %s\n", s.Version, s.Name, applied)
+		}
+
+	case "up":
+		if len(args) != 0 {
+			return fmt.Errorf("expected no arguments")
+		}
+		applied, err := migrateUp(db, dialect)
+		for _, m := range applied {
+			fmt.Printf("Applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("The database is up to date")
+		}
+
+	case "down":
+		flags := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		force := flags.Bool("force", false, "also roll back migrations that delete data which must be kept, such as the audit log")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		args = flags.Args()
+		if len(args) > 1 {
+			return fmt.Errorf("expected at most one version")
+		}
+		statuses, err := migrationStatuses(db, dialect)
+		if err != nil {
+			return err
+		}
+		// By default only the newest applied migration is rolled back
+		target, newest := 0, schemaVersion(statuses)
+		for _, s := range statuses {
+			if s.AppliedAt != nil && s.Version < newest {
+				target = s.Version
+			}
+		}
+		if len(args) == 1 {
+			if target, err = strconv.Atoi(args[0]); err != nil || target < 0 {
+				return fmt.Errorf("invalid version %q", args[0])
+			}
+		}
+		reverted, err := migrateDown(db, dialect, target, *force)
+		for _, m := range reverted {
+			fmt.Printf("Rolled back %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(reverted) == 0 {
+			fmt.Println("Nothing to roll back")
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return fmt.Errorf("unknown command: migrate %s", command)
+	}
+	return nil
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Field represents a form field with its properties
@@ -15,12 +20,59 @@ type Field struct {
 	MaxLength        int      `json:"max_length,omitempty"`
 	MaxFileSize      int64    `json:"max_file_size,omitempty"`
 	AllowedFileTypes []string `json:"allowed_file_types,omitempty"`
+
+	// Whether the value, or the contents of an uploaded file, is encrypted at rest
+	Encrypt bool `json:"encrypt,omitempty"`
 }
 
 // RateLimit represents the rate limit configuration for a form
 type RateLimit struct {
-	Requests int    `json:"requests"`
-	Duration string `json:"duration"`
+	Requests  int    `json:"requests"`
+	Duration  string `json:"duration"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Burst     int    `json:"burst,omitempty"`
+}
+
+// Validate the rate limit and return the length of its window
+func (rl RateLimit) window() (time.Duration, error) {
+	duration, err := time.ParseDuration(rl.Duration)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid rate limit duration: %q", rl.Duration)
+	}
+	if rl.Requests < 0 || rl.Burst < 0 {
+		return 0, fmt.Errorf("rate limit requests and burst must not be negative")
+	}
+	switch rl.Algorithm {
+	case "", rateLimitSlidingWindow, rateLimitTokenBucket:
+	default:
+		return 0, fmt.Errorf("invalid rate limit algorithm: %q", rl.Algorithm)
+	}
+	return duration, nil
+}
+
+// Return the bucket capacity of a token bucket rate limit
+func (rl RateLimit) burst() int {
+	if rl.Burst > 0 {
+		return rl.Burst
+	}
+	return rl.Requests
+}
+
+// IPFilter represents the IP allow/deny lists and blocked countries
+type IPFilter struct {
+	Allow            []string `json:"allow,omitempty"`
+	Deny             []string `json:"deny,omitempty"`
+	BlockedCountries []string `json:"blocked_countries,omitempty"`
+}
+
+// LogRedaction configures the masking of personal data in the application log
+type LogRedaction struct {
+	// Names of log fields whose values are masked, such as submitted form fields.
+	// Defaults to defaultRedactedFields when omitted.
+	Fields []string `json:"fields"`
+
+	// Whether email addresses are logged, instead of masking their local part
+	KeepEmails bool `json:"keep_emails,omitempty"`
 }
 
 // FormConfig holds the configuration for a specific form
@@ -28,12 +80,103 @@ type FormConfig struct {
 	ReferralURL    string    `json:"referral_url"`
 	AllowedOrigins []string  `json:"allowed_origins"`
 	RateLimit      RateLimit `json:"rate_limit"`
+	IPFilter       IPFilter  `json:"ip_filter"`
 	Fields         []Field   `json:"fields"`
+
+	// How long submissions are kept, such as "90d", and whether they are then
+	// purged or anonymized. Submissions are kept forever when Retain is empty.
+	Retain          string `json:"retain,omitempty"`
+	RetentionAction string `json:"retention_action,omitempty"`
+
+	// Whether the submitted values are written to the log, after redaction
+	LogSubmissions bool `json:"log_submissions,omitempty"`
+}
+
+// Actions taken on submissions older than the retention period
+const (
+	retentionPurge     = "purge"
+	retentionAnonymize = "anonymize"
+)
+
+// Validate the retention of a form and return its period and action. The
+// period is 0 when submissions are kept forever.
+func (fc FormConfig) retention() (time.Duration, string, error) {
+	action := fc.RetentionAction
+	switch action {
+	case "":
+		action = retentionPurge
+	case retentionPurge, retentionAnonymize:
+	default:
+		return 0, "", fmt.Errorf("invalid retention action: %q", fc.RetentionAction)
+	}
+	if fc.Retain == "" {
+		return 0, action, nil
+	}
+
+	// Accept days and weeks in addition to Go durations
+	var period time.Duration
+	var err error
+	if n, unit := strings.TrimRight(fc.Retain, "dw"), strings.TrimLeft(fc.Retain, "0123456789"); unit == "d" || unit == "w" {
+		var count int
+		count, err = strconv.Atoi(n)
+		period = time.Duration(count) * 24 * time.Hour
+		if unit == "w" {
+			period *= 7
+		}
+	} else {
+		period, err = time.ParseDuration(fc.Retain)
+	}
+	if err != nil || period <= 0 {
+		return 0, "", fmt.Errorf("invalid retention: %q", fc.Retain)
+	}
+	return period, action, nil
+}
+
+// AutoBan represents the automatic ban configuration for repeat rate limit offenders
+type AutoBan struct {
+	Threshold    int    `json:"threshold"`
+	Window       string `json:"window,omitempty"`
+	BaseDuration string `json:"base_duration,omitempty"`
+	MaxDuration  string `json:"max_duration,omitempty"`
+	ResetAfter   string `json:"reset_after,omitempty"`
+}
+
+// LoginProtection represents the brute-force protection of the admin login
+type LoginProtection struct {
+	MaxFailures   int    `json:"max_failures,omitempty"`
+	IPMaxFailures int    `json:"ip_max_failures,omitempty"`
+	Window        string `json:"window,omitempty"`
+	Delay         string `json:"delay,omitempty"`
+	MaxDelay      string `json:"max_delay,omitempty"`
+	Lockout       string `json:"lockout,omitempty"`
+	MaxLockout    string `json:"max_lockout,omitempty"`
+}
+
+// OIDC represents the OpenID Connect single sign-on configuration of the admin panel
+type OIDC struct {
+	Issuer               string                       `json:"issuer"`
+	ClientID             string                       `json:"client_id"`
+	RedirectURL          string                       `json:"redirect_url"`
+	Name                 string                       `json:"name,omitempty"`
+	Scopes               []string                     `json:"scopes,omitempty"`
+	AllowedDomains       []string                     `json:"allowed_domains,omitempty"`
+	GroupsClaim          string                       `json:"groups_claim,omitempty"`
+	GroupRoles           map[string]map[string]string `json:"group_roles,omitempty"`
+	DisablePasswordLogin bool                         `json:"disable_password_login,omitempty"`
 }
 
 // Config represents the application's configuration
 type Config struct {
-	Forms map[string]FormConfig `json:"forms"`
+	IPFilter        IPFilter              `json:"ip_filter"`
+	AutoBan         AutoBan               `json:"auto_ban"`
+	LoginProtection LoginProtection       `json:"login_protection"`
+	OIDC            OIDC                  `json:"oidc"`
+	LogRedaction    LogRedaction          `json:"log_redaction"`
+	Forms           map[string]FormConfig `json:"forms"`
+
+	// Version identifies the contents of the configuration file, as the start
+	// of its SHA-256 hash
+	Version string `json:"-"`
 }
 
 // Load the configuration from a JSON file
@@ -68,6 +211,10 @@ func loadConfig(configPath string) (Config, error) {
 		return config, fmt.Errorf("error unmarshalling configuration JSON: %v", err)
 	}
 
+	sum := sha256.Sum256(byteValue)
+	config.Version = hex.EncodeToString(sum[:6])
+	recordConfigVersion(config.Version)
+
 	log.Infof("Configuration loaded successfully from %s", configPath)
 	return config, nil
 }
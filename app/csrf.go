@@ -0,0 +1,98 @@
+// app/csrf.go
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// Cookie the admin pages read the CSRF token from
+	csrfCookieName = "csrf_token"
+	// Header and form field the CSRF token is sent back in
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFieldName  = "csrf_token"
+)
+
+// Paths that change state without an admin session, such as public form submissions
+var csrfExemptPaths = map[string]bool{
+	"/api/forms": true,
+}
+
+// Store a new CSRF token in the session and send it in the CSRF cookie.
+// The session must be saved by the caller.
+func newCSRFToken(w http.ResponseWriter, session *sessions.Session) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("error generating CSRF token: %v", err)
+	}
+	session.Values["csrf_token"] = token
+	setCSRFCookie(w, token, session.Options.MaxAge)
+	return token, nil
+}
+
+// Send the CSRF token in a cookie that scripts of the admin pages can read
+func setCSRFCookie(w http.ResponseWriter, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Make sure the session has a CSRF token, saving the session when one is created
+func ensureCSRFToken(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	if token, _ := session.Values["csrf_token"].(string); token != "" {
+		return nil
+	}
+	if _, err := newCSRFToken(w, session); err != nil {
+		return err
+	}
+	return session.Save(r, w)
+}
+
+// Middleware to reject state-changing requests without the CSRF token of the session
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if csrfExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Browsers can't send the Authorization header cross-site, and API requests
+		// with a token ignore the session cookie
+		if strings.HasPrefix(r.URL.Path, "/api/") && bearerToken(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, _ := store.Get(r, "session-name")
+		expected, _ := session.Values["csrf_token"].(string)
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			token = r.FormValue(csrfFieldName)
+		}
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			log.Warnf("Request with an invalid CSRF token rejected: %s %s", r.Method, r.URL.Path)
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				jsonError(w, "Invalid CSRF token", http.StatusForbidden)
+			} else {
+				http.Error(w, "Invalid CSRF token, reload the page and try again", http.StatusForbidden)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,64 @@
+// app/csrf_test.go
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	s := useTestSessionStore(t)
+	handler := csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	const token = "the csrf token of the session"
+
+	tests := []struct {
+		name, method, path string
+		session            bool
+		header, field      string
+		bearer             bool
+		wantCode           int
+	}{
+		{name: "token in the header", method: "POST", path: "/api/users", session: true, header: token, wantCode: http.StatusNoContent},
+		{name: "token in the form", method: "POST", path: "/logout", session: true, field: token, wantCode: http.StatusNoContent},
+		{name: "missing token", method: "DELETE", path: "/api/submissions/1", session: true, wantCode: http.StatusForbidden},
+		{name: "wrong token", method: "PATCH", path: "/api/submissions/1", session: true, header: "guessed", wantCode: http.StatusForbidden},
+		{name: "token without a session", method: "POST", path: "/api/users", header: token, wantCode: http.StatusForbidden},
+		{name: "empty token without a session", method: "POST", path: "/api/users", wantCode: http.StatusForbidden},
+		{name: "read-only request", method: "GET", path: "/api/users", session: true, wantCode: http.StatusNoContent},
+		{name: "public form submission", method: "POST", path: "/api/forms", wantCode: http.StatusNoContent},
+		{name: "API token", method: "DELETE", path: "/api/submissions/1", session: true, bearer: true, wantCode: http.StatusNoContent},
+		{name: "API token outside the API", method: "POST", path: "/logout", session: true, bearer: true, wantCode: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		var r *http.Request
+		if tt.session {
+			r = requestWithSession(t, s, tt.method, tt.path, map[interface{}]interface{}{"csrf_token": token})
+		} else {
+			r = httptest.NewRequest(tt.method, tt.path, nil)
+		}
+		if tt.field != "" {
+			r.Body = io.NopCloser(strings.NewReader(url.Values{csrfFieldName: {tt.field}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if tt.header != "" {
+			r.Header.Set(csrfHeaderName, tt.header)
+		}
+		if tt.bearer {
+			r.Header.Set("Authorization", "Bearer fh_token")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: %s %s returned %d, want %d", tt.name, tt.method, tt.path, w.Code, tt.wantCode)
+		}
+		if w.Code == http.StatusForbidden && strings.HasPrefix(tt.path, "/api/") && !strings.Contains(w.Body.String(), `"error"`) {
+			t.Errorf("%s: API error %q is not JSON", tt.name, w.Body)
+		}
+	}
+}
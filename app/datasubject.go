@@ -0,0 +1,163 @@
+// app/datasubject.go
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dataSubject identifies a person by any of the identifiers that are set
+type dataSubject struct {
+	Email string
+	Name  string
+	IP    string
+}
+
+// Parse the identifiers of a data subject request and return a description of
+// the search for the audit log. Email and name match ignoring case. The
+// description only names the kinds of identifiers given, since the audit log
+// can't be erased.
+func parseDataSubject(query url.Values) (dataSubject, string, error) {
+	subject := dataSubject{
+		Email: strings.TrimSpace(query.Get("email")),
+		Name:  strings.TrimSpace(query.Get("name")),
+		IP:    strings.TrimSpace(query.Get("ip")),
+	}
+	var described []string
+	for _, identifier := range []struct{ param, value string }{
+		{"email", subject.Email},
+		{"name", subject.Name},
+		{"ip", subject.IP},
+	} {
+		if identifier.value != "" {
+			described = append(described, identifier.param)
+		}
+	}
+	if len(described) == 0 {
+		return subject, "", fmt.Errorf("an email, name or ip is required")
+	}
+	return subject, "by " + strings.Join(described, ", "), nil
+}
+
+// Parse the identifiers of a data subject request and return its submissions
+// in all forms, including those in the trash. Writes an error response and
+// returns false when it fails.
+func dataSubjectRequest(w http.ResponseWriter, r *http.Request) ([]submission, string, bool) {
+	subject, described, err := parseDataSubject(r.URL.Query())
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	submissions, err := submissionStore.Find(submissionSelector{Subject: &subject}, 0)
+	if err != nil {
+		log.Errorf("Error searching submissions of data subject: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	return submissions, described, true
+}
+
+// Handler to view the data subject requests page (admin)
+func viewDataSubjectHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/data_subject.html")
+}
+
+// API handler to find the submissions of a data subject in all forms
+func apiDataSubjectHandler(w http.ResponseWriter, r *http.Request) {
+	submissions, described, ok := dataSubjectRequest(w, r)
+	if !ok {
+		return
+	}
+	recordAudit(r, "data_subject.search", fmt.Sprintf("%s: %d submissions", described, len(submissions)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"submissions": submissions})
+}
+
+// API handler to download the submissions of a data subject as a ZIP bundle
+// with submissions.json and the uploaded files in attachments/
+func exportDataSubjectHandler(w http.ResponseWriter, r *http.Request) {
+	submissions, described, ok := dataSubjectRequest(w, r)
+	if !ok {
+		return
+	}
+	recordAudit(r, "data_subject.export", fmt.Sprintf("%s: %d submissions", described, len(submissions)))
+
+	filename := fmt.Sprintf("data-subject-%s.zip", time.Now().UTC().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	// The response has started, so errors from here on can only be logged
+	bundle := zip.NewWriter(w)
+	f, err := bundle.Create("submissions.json")
+	if err != nil {
+		log.Errorf("Error writing data subject bundle: %v", err)
+		return
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(submissions); err != nil {
+		log.Errorf("Error writing data subject bundle: %v", err)
+		return
+	}
+
+	for _, s := range submissions {
+		if s.File == "" {
+			continue
+		}
+		if err := addUploadToBundle(bundle, s.File); err != nil {
+			log.Errorf("Error adding file %s to data subject bundle: %v", s.File, err)
+			return
+		}
+	}
+	if err := bundle.Close(); err != nil {
+		log.Errorf("Error writing data subject bundle: %v", err)
+	}
+}
+
+// Copy an uploaded file, decrypted, into attachments/ of a bundle, skipping missing files
+func addUploadToBundle(bundle *zip.Writer, name string) error {
+	data, err := readUpload(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	dst, err := bundle.Create("attachments/" + filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(data)
+	return err
+}
+
+// API handler to erase the submissions of a data subject and their uploaded
+// files. They are purged right away, without going through the trash.
+func eraseDataSubjectHandler(w http.ResponseWriter, r *http.Request) {
+	subject, described, err := parseDataSubject(r.URL.Query())
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := purgeSubmissions(submissionSelector{Subject: &subject})
+	if err != nil {
+		log.Errorf("Error erasing submissions of data subject: %v", err)
+		jsonError(w, "Could not erase submissions", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "data_subject.erase", fmt.Sprintf("%s: %d submissions", described, n))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"erased": n})
+}
@@ -0,0 +1,60 @@
+// app/datasubject_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEraseDataSubject(t *testing.T) {
+	useTestSubmissionStore(t)
+	for _, s := range []submission{
+		{FormID: "contact", Name: "Alice Example", Email: "alice@example.com", Message: "hello", Read: "N", Metadata: &submissionMetadata{IP: "192.0.2.7"}},
+		{FormID: "support", Name: "alice example", Email: "other@example.com", Message: "help", Read: "N"},
+		{FormID: "contact", Name: "Bob", Email: "bob@example.com", Message: "hi", Read: "N"},
+	} {
+		if _, err := submissionStore.Create(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/data-subject?email=ALICE@example.com&name=Alice+Example&ip=192.0.2.7", nil)
+	r = withUser(r, &user{ID: 1, Username: "owner", Grants: map[string]string{"*": roleOwner}})
+	w := httptest.NewRecorder()
+	eraseDataSubjectHandler(w, r)
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"erased":2}` {
+		t.Fatalf("response %d %s, want 2 erased", w.Code, w.Body)
+	}
+	if count, _, _ := submissionStore.Count(submissionSelector{}); count != 1 {
+		t.Errorf("%d submissions remain, want only Bob's", count)
+	}
+
+	// The audit log can't be erased, so it must not hold the identifiers
+	rows, err := db.Query("SELECT actor, action, target, ip FROM audit_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	entries := 0
+	for rows.Next() {
+		var actor, action, target, ip string
+		if err := rows.Scan(&actor, &action, &target, &ip); err != nil {
+			t.Fatal(err)
+		}
+		entries++
+		entry := strings.ToLower(strings.Join([]string{actor, action, target, ip}, " "))
+		for _, identifier := range []string{"alice", "192.0.2.7"} {
+			if strings.Contains(entry, identifier) {
+				t.Errorf("audit entry %q holds the identifier %q", entry, identifier)
+			}
+		}
+		if action == "data_subject.erase" && target != "by email, name, ip: 2 submissions" {
+			t.Errorf("audit target %q, want the kinds of identifiers and the count", target)
+		}
+	}
+	if entries != 1 {
+		t.Errorf("%d audit entries, want 1", entries)
+	}
+}
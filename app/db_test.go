@@ -0,0 +1,32 @@
+// app/db_test.go
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// Replace the application database with a migrated one in a temporary
+// directory for the duration of a test
+func useTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	// Keep getDB from opening the application database
+	once.Do(func() {})
+
+	testDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(testDB, &sqliteDialect{}); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+	return testDB
+}
@@ -0,0 +1,429 @@
+// app/encryption.go
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Prefix of the encrypted values stored in the database, followed by the ID of
+// the key and the base64 nonce and ciphertext
+const encryptedValuePrefix = "enc:v1:"
+
+// Header of encrypted uploaded files, followed by the ID of the key, the nonce and the ciphertext
+var encryptedFileHeader = []byte("FHENC1\n")
+
+// Length of the IDs identifying the key a value was encrypted with
+const encryptionKeyIDLength = 8
+
+// Columns of the submissions table holding form fields that can be encrypted
+var encryptedColumns = []string{"name", "email", "message"}
+
+// Columns identifying data subjects, stored with a keyed hash in the column of
+// the same name with the suffix _hash so encrypted values can still be found
+var subjectIndexColumns = []string{"name", "email"}
+
+// encryptionKey is an AES-256-GCM key, its ID and the key of the subject index
+type encryptionKey struct {
+	id    string
+	aead  cipher.AEAD
+	index []byte
+}
+
+// Keys encrypting sensitive submission fields: the current key encrypts new
+// values, and all keys decrypt
+var encryptionKeys struct {
+	current *encryptionKey
+	byID    map[string]*encryptionKey
+}
+
+// Parse a base64 encoded 32-byte key
+func parseEncryptionKey(value string) (*encryptionKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %v", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("form-handler subject index"))
+	return &encryptionKey{id: hex.EncodeToString(sum[:])[:encryptionKeyIDLength], aead: aead, index: mac.Sum(nil)}, nil
+}
+
+// Return the subject index of a name or email address under the key, which
+// ignores case and surrounding spaces like the data subject search
+func (k *encryptionKey) subjectIndex(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return the subject index of a stored value, which may be encrypted, under the
+// current key, or "" when no key is set
+func storedSubjectIndex(stored string) (string, error) {
+	if encryptionKeys.current == nil {
+		return "", nil
+	}
+	value, err := decryptValue(stored)
+	if err != nil {
+		return "", err
+	}
+	return encryptionKeys.current.subjectIndex(value), nil
+}
+
+// Return the subject indexes of a name or email address under every key, so
+// values indexed before a key rotation are found too
+func subjectIndexes(value string) []string {
+	var indexes []string
+	for _, key := range encryptionKeys.byID {
+		if index := key.subjectIndex(value); index != "" {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// Load the encryption keys from ENCRYPTION_KEY and the comma-separated
+// ENCRYPTION_PREVIOUS_KEYS, which still decrypt values while they are rotated
+func initEncryption() error {
+	encryptionKeys.current = nil
+	encryptionKeys.byID = map[string]*encryptionKey{}
+
+	value := os.Getenv("ENCRYPTION_KEY")
+	if value == "" {
+		return nil
+	}
+	key, err := parseEncryptionKey(value)
+	if err != nil {
+		return fmt.Errorf("ENCRYPTION_KEY: %v", err)
+	}
+	encryptionKeys.current = key
+	encryptionKeys.byID[key.id] = key
+
+	for _, previous := range strings.Split(os.Getenv("ENCRYPTION_PREVIOUS_KEYS"), ",") {
+		if strings.TrimSpace(previous) == "" {
+			continue
+		}
+		key, err := parseEncryptionKey(previous)
+		if err != nil {
+			return fmt.Errorf("ENCRYPTION_PREVIOUS_KEYS: %v", err)
+		}
+		encryptionKeys.byID[key.id] = key
+	}
+	return nil
+}
+
+// Check that only stored fields are encrypted, and that a key is set when a
+// form encrypts fields
+func validateEncryption(config Config) error {
+	for formID, formConfig := range config.Forms {
+		for _, field := range formConfig.Fields {
+			if !field.Encrypt {
+				continue
+			}
+			if field.Type != "file" && !slices.Contains(encryptedColumns, field.Name) {
+				return fmt.Errorf("form %s encrypts field %s, but only the %s fields and files are stored", formID, field.Name, strings.Join(encryptedColumns, ", "))
+			}
+			if encryptionKeys.current == nil {
+				return fmt.Errorf("form %s encrypts field %s, but ENCRYPTION_KEY is not set", formID, field.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Return a new random key, base64 encoded for ENCRYPTION_KEY
+func generateEncryptionKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Encrypt data with the current key, returning the ID of the key, the nonce and the ciphertext
+func sealData(plaintext []byte) (string, []byte, error) {
+	key := encryptionKeys.current
+	if key == nil {
+		return "", nil, fmt.Errorf("ENCRYPTION_KEY is not set")
+	}
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+	return key.id, key.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt the nonce and ciphertext returned by sealData with the key of an ID
+func openData(keyID string, sealed []byte) ([]byte, error) {
+	key, ok := encryptionKeys.byID[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s is not configured", keyID)
+	}
+	size := key.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("encrypted data is truncated")
+	}
+	plaintext, err := key.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data with key %s: %v", keyID, err)
+	}
+	return plaintext, nil
+}
+
+// Encrypt a field value for storage. Empty values are stored as they are.
+func encryptValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	keyID, sealed, err := sealData([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	return encryptedValuePrefix + keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Return the ID of the key a stored value was encrypted with, or "" when it is plaintext
+func valueKeyID(value string) string {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return ""
+	}
+	keyID, _, _ := strings.Cut(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	return keyID
+}
+
+// Decrypt a stored field value. Plaintext values are returned as they are.
+func decryptValue(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedValuePrefix) {
+		return value, nil
+	}
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %v", err)
+	}
+	plaintext, err := openData(keyID, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Encrypt the contents of an uploaded file with the current key
+func encryptFile(dst io.Writer, src io.Reader) error {
+	plaintext, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	keyID, sealed, err := sealData(plaintext)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(append(append(append([]byte{}, encryptedFileHeader...), keyID...), sealed...))
+	return err
+}
+
+// Return the ID of the key file contents were encrypted with, or "" when they are plaintext
+func fileKeyID(data []byte) string {
+	if !bytes.HasPrefix(data, encryptedFileHeader) || len(data) < len(encryptedFileHeader)+encryptionKeyIDLength {
+		return ""
+	}
+	return string(data[len(encryptedFileHeader) : len(encryptedFileHeader)+encryptionKeyIDLength])
+}
+
+// Read an uploaded file, decrypting it when it is encrypted
+func readUpload(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join("/app/uploads", filepath.Base(name)))
+	if err != nil {
+		return nil, err
+	}
+	keyID := fileKeyID(data)
+	if keyID == "" {
+		return data, nil
+	}
+	return openData(keyID, data[len(encryptedFileHeader)+encryptionKeyIDLength:])
+}
+
+// Return the columns a form encrypts and whether it encrypts its uploaded files
+func (fc FormConfig) encryptedFields() (map[string]bool, bool) {
+	columns := map[string]bool{}
+	files := false
+	for _, field := range fc.Fields {
+		if !field.Encrypt {
+			continue
+		}
+		if field.Type == "file" {
+			files = true
+		} else {
+			columns[field.Name] = true
+		}
+	}
+	return columns, files
+}
+
+// Return the encrypted fields of a form, or of all the forms a user can view,
+// which the submission search can't match since only their ciphertext is stored
+func unsearchableFields(config Config, u *user, formID string) []string {
+	var fields []string
+	for id, formConfig := range config.Forms {
+		if (formID != "" && id != formID) || !u.can(roleViewer, id) {
+			continue
+		}
+		columns, _ := formConfig.encryptedFields()
+		for column := range columns {
+			if !slices.Contains(fields, column) {
+				fields = append(fields, column)
+			}
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// Re-encrypt with the current key the stored values and files encrypted with a
+// previous key, and encrypt those of fields that are now configured to be
+// encrypted. Returns the number of values and files changed.
+func rotateEncryption(config Config) (int, int, error) {
+	current := encryptionKeys.current
+	if current == nil {
+		return 0, 0, fmt.Errorf("ENCRYPTION_KEY is not set")
+	}
+
+	stored, err := submissionStore.EncryptableValues()
+	if err != nil {
+		return 0, 0, err
+	}
+	var changes []valueChange
+	files := map[string]bool{}
+	for _, v := range stored {
+		columns, encryptFiles := config.Forms[v.FormID].encryptedFields()
+		for i, column := range encryptedColumns {
+			value := v.Values[i]
+			keyID := valueKeyID(value)
+			if keyID == current.id || (keyID == "" && !columns[column]) || value == "" {
+				continue
+			}
+			plaintext, err := decryptValue(value)
+			if err != nil {
+				return 0, 0, fmt.Errorf("submission %d: %v", v.ID, err)
+			}
+			encrypted, err := encryptValue(plaintext)
+			if err != nil {
+				return 0, 0, err
+			}
+			changes = append(changes, valueChange{ID: v.ID, Column: column, Value: encrypted})
+		}
+		if v.File != "" {
+			files[v.File] = files[v.File] || encryptFiles
+		}
+	}
+	if err := submissionStore.SetValues(changes); err != nil {
+		return 0, 0, err
+	}
+
+	rotated := 0
+	for file, encrypt := range files {
+		changed, err := rotateUpload(file, current.id, encrypt)
+		if err != nil {
+			return len(changes), rotated, fmt.Errorf("file %s: %v", file, err)
+		}
+		if changed {
+			rotated++
+		}
+	}
+	return len(changes), rotated, nil
+}
+
+// Index with the current key the names and email addresses of the submissions
+// stored before the subject index existed, indexed with a previous key, or whose
+// index is stale. Returns the number of indexes changed.
+func indexSubmissions() (int, error) {
+	if encryptionKeys.current == nil {
+		return 0, nil
+	}
+	stored, err := submissionStore.EncryptableValues()
+	if err != nil {
+		return 0, err
+	}
+	var changes []valueChange
+	for _, v := range stored {
+		for i, column := range subjectIndexColumns {
+			index, err := storedSubjectIndex(v.Values[slices.Index(encryptedColumns, column)])
+			if err != nil {
+				return 0, fmt.Errorf("submission %d: %v", v.ID, err)
+			}
+			if index != v.Indexes[i] {
+				changes = append(changes, valueChange{ID: v.ID, Column: column + "_hash", Value: index})
+			}
+		}
+	}
+	if err := submissionStore.SetValues(changes); err != nil {
+		return 0, err
+	}
+	return len(changes), nil
+}
+
+// Re-encrypt an uploaded file encrypted with a previous key, or encrypt a
+// plaintext one when encrypt is set, replacing it atomically. Missing files are
+// skipped.
+func rotateUpload(name, currentKeyID string, encrypt bool) (bool, error) {
+	path := filepath.Join("/app/uploads", filepath.Base(name))
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	keyID := fileKeyID(data)
+	if keyID == currentKeyID || (keyID == "" && !encrypt) {
+		return false, nil
+	}
+	plaintext, err := readUpload(name)
+	if err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp("/app/uploads", ".rotate-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := encryptFile(tmp, bytes.NewReader(plaintext)); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,262 @@
+// app/encryption_test.go
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// Set the encryption keys for the duration of a test and return them
+func useEncryptionKeys(t *testing.T, previous ...string) string {
+	t.Helper()
+	key, err := generateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENCRYPTION_KEY", key)
+	t.Setenv("ENCRYPTION_PREVIOUS_KEYS", strings.Join(previous, ","))
+	if err := initEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		encryptionKeys.current = nil
+		encryptionKeys.byID = map[string]*encryptionKey{}
+	})
+	return key
+}
+
+// Replace the submission store with one using the test database
+func useTestSubmissionStore(t *testing.T) {
+	t.Helper()
+	previous := submissionStore
+	submissionStore = &sqlSubmissionStore{db: useTestDB(t), dialect: &sqliteDialect{}}
+	t.Cleanup(func() { submissionStore = previous })
+}
+
+// Flip a bit of the ciphertext of an encrypted value
+func tamper(value string) string {
+	prefix := value[:strings.LastIndex(value, ":")+1]
+	sealed, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	sealed[len(sealed)-1] ^= 1
+	return prefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestDecryptValue(t *testing.T) {
+	old := useEncryptionKeys(t)
+	oldValue, err := encryptValue("written with the old key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useEncryptionKeys(t, old)
+	value, err := encryptValue("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		stored  string
+		want    string
+		wantErr string
+	}{
+		{name: "round trip", stored: value, want: "secret"},
+		{name: "previous key", stored: oldValue, want: "written with the old key"},
+		{name: "plaintext", stored: "not encrypted", want: "not encrypted"},
+		{name: "empty", stored: "", want: ""},
+		{name: "unknown key", stored: encryptedValuePrefix + "00000000:" + strings.SplitN(value, ":", 4)[3], wantErr: "encryption key 00000000 is not configured"},
+		{name: "tampered ciphertext", stored: tamper(value), wantErr: "error decrypting data"},
+		{name: "truncated", stored: encryptedValuePrefix + valueKeyID(value) + ":AAAA", wantErr: "truncated"},
+		{name: "malformed", stored: encryptedValuePrefix + "no separator", wantErr: "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptValue(tt.stored)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("decrypted %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Values are encrypted with a random nonce
+	again, _ := encryptValue("secret")
+	if again == value {
+		t.Error("the same value was encrypted twice to the same ciphertext")
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	form := func(fields ...Field) Config {
+		return Config{Forms: map[string]FormConfig{"contact": {Fields: fields}}}
+	}
+	tests := []struct {
+		name    string
+		withKey bool
+		config  Config
+		wantErr string
+	}{
+		{name: "no encrypted fields", config: form(Field{Name: "email"})},
+		{name: "encrypted fields", withKey: true, config: form(Field{Name: "email", Encrypt: true}, Field{Name: "cv", Type: "file", Encrypt: true})},
+		{name: "missing key", config: form(Field{Name: "email", Encrypt: true}), wantErr: "ENCRYPTION_KEY is not set"},
+		{name: "field that isn't stored", withKey: true, config: form(Field{Name: "phone", Encrypt: true}), wantErr: "only the name, email, message fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.withKey {
+				useEncryptionKeys(t)
+			}
+			err := validateEncryption(tt.config)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotateEncryption(t *testing.T) {
+	useTestSubmissionStore(t)
+	config := Config{Forms: map[string]FormConfig{"contact": {Fields: []Field{{Name: "email", Encrypt: true}, {Name: "message"}}}}}
+
+	old := useEncryptionKeys(t)
+	email, _ := encryptValue("Alice@example.com")
+	id, err := submissionStore.Create(submission{FormID: "contact", Email: email, Message: "plain", Read: "N"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rows written with the previous key are still read after the rotation
+	useEncryptionKeys(t, old)
+	s, err := submissionStore.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Email != "Alice@example.com" {
+		t.Fatalf("email read with the previous key = %q", s.Email)
+	}
+
+	values, _, err := rotateEncryption(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values != 1 {
+		t.Errorf("rotated %d values, want 1", values)
+	}
+	stored, err := submissionStore.EncryptableValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := valueKeyID(stored[0].Values[1]); got != encryptionKeys.current.id {
+		t.Errorf("email encrypted with key %s after rotation, want %s", got, encryptionKeys.current.id)
+	}
+	if stored[0].Values[2] != "plain" {
+		t.Errorf("message that isn't encrypted was changed to %q", stored[0].Values[2])
+	}
+
+	// Without the previous key, the rotated row is still read
+	t.Setenv("ENCRYPTION_PREVIOUS_KEYS", "")
+	if err := initEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := submissionStore.Get(id); err != nil || s.Email != "Alice@example.com" {
+		t.Errorf("email after dropping the previous key = %q, %v", s.Email, err)
+	}
+}
+
+func TestDataSubjectOfEncryptedSubmissions(t *testing.T) {
+	useTestSubmissionStore(t)
+	old := useEncryptionKeys(t)
+	create := func(name, email string) {
+		t.Helper()
+		encryptedName, _ := encryptValue(name)
+		encryptedEmail, _ := encryptValue(email)
+		if _, err := submissionStore.Create(submission{FormID: "contact", Name: encryptedName, Email: encryptedEmail, Read: "N"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("Alice", "alice@example.com")
+	create("Bob", "bob@example.com")
+
+	// Rows indexed with a previous key are found until they are re-indexed
+	useEncryptionKeys(t, old)
+	create("alice", "ALICE@example.com")
+
+	tests := []struct {
+		subject dataSubject
+		want    int
+	}{
+		{dataSubject{Email: "alice@example.com"}, 2},
+		{dataSubject{Email: " Alice@Example.com "}, 2},
+		{dataSubject{Name: "ALICE"}, 2},
+		{dataSubject{Name: "Bob"}, 1},
+		{dataSubject{Email: "carol@example.com"}, 0},
+	}
+	check := func() {
+		t.Helper()
+		for _, tt := range tests {
+			count, _, err := submissionStore.Count(submissionSelector{Subject: &tt.subject})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.want {
+				t.Errorf("%+v matches %d submissions, want %d", tt.subject, count, tt.want)
+			}
+		}
+	}
+	check()
+
+	indexed, err := indexSubmissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 4 {
+		t.Errorf("re-indexed %d values, want the 4 of the previous key", indexed)
+	}
+	check()
+
+	// Erasure removes the index with the data
+	n, _, err := submissionStore.Anonymize(submissionSelector{Subject: &dataSubject{Email: "alice@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("anonymized %d submissions, want 2", n)
+	}
+	if count, _, _ := submissionStore.Count(submissionSelector{Subject: &dataSubject{Name: "Alice"}}); count != 0 {
+		t.Errorf("%d submissions of the erased subject remain", count)
+	}
+}
+
+func TestUnsearchableFields(t *testing.T) {
+	config := Config{Forms: map[string]FormConfig{
+		"contact": {Fields: []Field{{Name: "email", Encrypt: true}, {Name: "message"}}},
+		"support": {Fields: []Field{{Name: "message", Encrypt: true}, {Name: "cv", Type: "file", Encrypt: true}}},
+	}}
+	tests := []struct {
+		grants map[string]string
+		formID string
+		want   string
+	}{
+		{map[string]string{"*": roleViewer}, "", "email,message"},
+		{map[string]string{"*": roleViewer}, "contact", "email"},
+		{map[string]string{"support": roleViewer}, "", "message"},
+		{map[string]string{"support": roleViewer}, "contact", ""},
+	}
+	for _, tt := range tests {
+		got := strings.Join(unsearchableFields(config, &user{Grants: tt.grants}, tt.formID), ",")
+		if got != tt.want {
+			t.Errorf("grants %v on form %q: %q, want %q", tt.grants, tt.formID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// app/export.go
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exportWriter writes the rows of an export in one format
+type exportWriter interface {
+	writeRow(values []interface{}) error
+	close() error
+}
+
+// Formats submissions can be exported in, with their content type and the
+// function starting an export with the given column names
+var exportFormats = map[string]struct {
+	contentType string
+	open        func(w io.Writer, columns []string) (exportWriter, error)
+}{
+	"csv":   {"text/csv; charset=utf-8", newCSVExport},
+	"jsonl": {"application/x-ndjson", newJSONLExport},
+	"xlsx":  {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", newXLSXExport},
+}
+
+// Format a value for a text cell
+func exportCell(value interface{}) string {
+	switch v := value.(type) {
+	case []string:
+		return strings.Join(v, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// csvExport writes an export as CSV with a header row
+type csvExport struct {
+	w *csv.Writer
+}
+
+func newCSVExport(w io.Writer, columns []string) (exportWriter, error) {
+	e := &csvExport{w: csv.NewWriter(w)}
+	return e, e.w.Write(columns)
+}
+
+func (e *csvExport) writeRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		cell := exportCell(value)
+		// Keep spreadsheets from evaluating submitted text as a formula
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			cell = "'" + cell
+		}
+		record[i] = cell
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExport) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonlExport writes an export as one JSON object per line
+type jsonlExport struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func newJSONLExport(w io.Writer, columns []string) (exportWriter, error) {
+	return &jsonlExport{enc: json.NewEncoder(w), columns: columns}, nil
+}
+
+func (e *jsonlExport) writeRow(values []interface{}) error {
+	row := make(map[string]interface{}, len(values))
+	for i, value := range values {
+		row[e.columns[i]] = value
+	}
+	return e.enc.Encode(row)
+}
+
+func (e *jsonlExport) close() error {
+	return nil
+}
+
+// Parts of an XLSX workbook with a single worksheet, written before the worksheet
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Submissions" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// xlsxExport writes an export as an XLSX workbook with inline strings, so rows
+// can be streamed without building a shared string table first
+type xlsxExport struct {
+	zip   *zip.Writer
+	sheet io.Writer
+}
+
+func newXLSXExport(w io.Writer, columns []string) (exportWriter, error) {
+	e := &xlsxExport{zip: zip.NewWriter(w)}
+	for _, part := range xlsxParts {
+		f, err := e.zip.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if e.sheet, err = e.zip.Create("xl/worksheets/sheet1.xml"); err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(e.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	return e, e.writeRow(header)
+}
+
+func (e *xlsxExport) writeRow(values []interface{}) error {
+	var b strings.Builder
+	b.WriteString("<row>")
+	for _, value := range values {
+		b.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		xml.EscapeText(&b, []byte(exportCell(value)))
+		b.WriteString("</t></is></c>")
+	}
+	b.WriteString("</row>")
+	_, err := io.WriteString(e.sheet, b.String())
+	return err
+}
+
+func (e *xlsxExport) close() error {
+	if _, err := io.WriteString(e.sheet, "</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	return e.zip.Close()
+}
+
+// Return the value of a form field of a submission. Only the name, email and
+// message fields and the uploaded file are stored, other fields are empty.
+func (s submission) fieldValue(field Field) string {
+	if field.Type == "file" {
+		if s.File == "" {
+			return ""
+		}
+		return signedUploadURL(s.File)
+	}
+	switch field.Name {
+	case "name":
+		return s.Name
+	case "email":
+		return s.Email
+	case "message":
+		return s.Message
+	}
+	return ""
+}
+
+// API handler to download the submissions of a form as CSV, JSON Lines or XLSX,
+// filtered and sorted like the submissions list
+func exportSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	formID := mux.Vars(r)["form_id"]
+	if !authorizeForm(w, r, roleViewer, formID) {
+		return
+	}
+
+	query := r.URL.Query()
+	format, ok := exportFormats[query.Get("format")]
+	if !ok {
+		jsonError(w, "Invalid format, use csv, jsonl or xlsx", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseSubmissionFilter(query)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.FormID = formID
+	filter.Limit = maxSubmissionsLimit
+	filter.Cursor = nil
+
+	config, err := loadConfig("/app/config/config.json")
+	if err != nil {
+		log.Errorf("Error loading config: %v", err)
+		jsonError(w, "Could not load config", http.StatusInternalServerError)
+		return
+	}
+	formConfig, exists := config.Forms[formID]
+	if !exists {
+		jsonError(w, "Form configuration not found", http.StatusNotFound)
+		return
+	}
+
+	columns := []string{"id", "created_at"}
+	for _, field := range formConfig.Fields {
+		columns = append(columns, field.Name)
+	}
+	columns = append(columns, "read", "starred", "status", "tags", "spam")
+
+	filename := fmt.Sprintf("submissions-%s-%s.%s", formID, time.Now().UTC().Format("2006-01-02"), query.Get("format"))
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	recordAudit(r, "submission.export", formID)
+
+	// The response has started, so errors from here on can only be logged
+	export, err := format.open(w, columns)
+	if err != nil {
+		log.Errorf("Error writing export of form %s: %v", formID, err)
+		return
+	}
+	u := currentUser(r)
+	for {
+		page, next, err := submissionStore.List(u, filter)
+		if err != nil {
+			log.Errorf("Error querying submissions of form %s for export: %v", formID, err)
+			return
+		}
+		for _, s := range page {
+			values := []interface{}{s.ID, s.CreatedAt}
+			for _, field := range formConfig.Fields {
+				values = append(values, s.fieldValue(field))
+			}
+			values = append(values, s.Read == "Y", s.Starred, s.Status, s.Tags, s.Spam)
+			if err := export.writeRow(values); err != nil {
+				log.Errorf("Error writing export of form %s: %v", formID, err)
+				return
+			}
+		}
+		if next == "" {
+			break
+		}
+		filter.Cursor, _ = decodeSubmissionCursor(next)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	if err := export.close(); err != nil {
+		log.Errorf("Error writing export of form %s: %v", formID, err)
+	}
+}
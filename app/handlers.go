@@ -2,22 +2,26 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 	"github.com/microcosm-cc/bluemonday"
+	"github.com/sirupsen/logrus"
 )
 
 // Handler for form submission
 func formHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -97,6 +101,13 @@ func formHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		formData[field.Name] = policy.Sanitize(value) // Sanitize the input
+		if field.Encrypt && field.Type != "file" {
+			if formData[field.Name], err = encryptValue(formData[field.Name]); err != nil {
+				http.Error(w, "Could not encrypt form data", http.StatusInternalServerError)
+				log.Errorf("Error encrypting %s: %v", field.Name, err)
+				return
+			}
+		}
 
 		if field.Type == "file" {
 			if fileHeaders, ok := r.MultipartForm.File[field.Name]; ok {
@@ -135,89 +146,124 @@ func formHandler(w http.ResponseWriter, r *http.Request) {
 					}
 					defer dst.Close()
 
-					if _, err := io.Copy(dst, file); err != nil {
+					if field.Encrypt {
+						err = encryptFile(dst, file)
+					} else {
+						_, err = io.Copy(dst, file)
+					}
+					if err != nil {
 						http.Error(w, "Could not save file", http.StatusInternalServerError)
 						log.Errorf("Error saving file: %v", err)
 						return
 					}
 					formData["file"] = newFileName
-					log.Infof("Uploaded file %s saved to /app/uploads/%s", fileHeader.Filename, newFileName)
+					log.Infof("Uploaded file saved to /app/uploads/%s", newFileName)
 				}
 			}
 		}
 	}
 
-	db, err := getDB()
-	if err != nil {
-		log.Errorf("Error opening database: %v", err)
-		http.Error(w, "Could not connect to the database", http.StatusInternalServerError)
-		return
-	}
-
-	tx, err := db.Begin()
-	if err != nil {
-		log.Errorf("Error beginning transaction: %v", err)
-		http.Error(w, "Could not begin database transaction", http.StatusInternalServerError)
-		return
-	}
-
-	stmt, err := tx.Prepare("INSERT INTO submissions(form_id, name, email, message, file, read) VALUES(?, ?, ?, ?, ?, ?)")
+	ip, _ := clientIP(r)
+	id, err := submissionStore.Create(submission{
+		FormID:  formID,
+		Name:    formData["name"],
+		Email:   formData["email"],
+		Message: formData["message"],
+		File:    formData["file"],
+		Read:    "N",
+		Metadata: &submissionMetadata{
+			IP:             ip,
+			UserAgent:      r.UserAgent(),
+			Referer:        referer,
+			Origin:         origin,
+			AcceptLanguage: r.Header.Get("Accept-Language"),
+			ConfigVersion:  config.Version,
+			ProcessingMS:   float64(time.Since(start).Microseconds()) / 1000,
+		},
+	})
 	if err != nil {
-		log.Errorf("Error preparing statement: %v", err)
-		http.Error(w, "Could not prepare database statement", http.StatusInternalServerError)
-		return
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(formID, formData["name"], formData["email"], formData["message"], formData["file"], "N")
-	if err != nil {
-		tx.Rollback()
-		log.Errorf("Error executing statement: %v", err)
-		http.Error(w, "Could not execute database statement", http.StatusInternalServerError)
-		return
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		log.Errorf("Error committing transaction: %v", err)
-		http.Error(w, "Could not commit database transaction", http.StatusInternalServerError)
+		log.Errorf("Error storing submission: %v", err)
+		http.Error(w, "Could not store submission", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"success": "Form submitted successfully"})
-	log.Infof("Form processed successfully, data: %+v", formData)
+
+	// Submitted values are only logged when the form asks for it, and the
+	// redaction hook still masks the configured fields
+	fields := logrus.Fields{"form_id": formID, "submission_id": id}
+	if formConfig.LogSubmissions {
+		for name, value := range formData {
+			fields[name] = value
+		}
+	}
+	log.WithFields(fields).Info("Form processed successfully")
 }
 
 // Handler for user login
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
 	if r.Method == "POST" {
+		if passwordLoginDisabled() {
+			http.Error(w, "Password login is disabled, use single sign-on", http.StatusForbidden)
+			return
+		}
 		username := r.FormValue("username")
 		password := r.FormValue("password")
-		log.Infof("Login attempt with username: %s", username)
-		envUsername := os.Getenv("ADMIN_USERNAME")
-		envPassword := os.Getenv("ADMIN_PASSWORD")
-		if username == envUsername && password == envPassword {
-			session.Values["authenticated"] = true
-			session.Options = &sessions.Options{
-				Path:     "/",
-				HttpOnly: true,
-				MaxAge:   3600, // 1 hour
-			}
-			err := session.Save(r, w)
-			if err != nil {
+		if !checkLoginAllowed(w, r, username) {
+			return
+		}
+		u, err := authenticateUser(username, password)
+		if err == errInvalidCredentials {
+			recordLoginFailure(r, username)
+			recordAuditAs(r, loginActor(username), "user.login_failed", "")
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Errorf("Error authenticating user: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// Users with two-factor authentication enter their code before the session is authenticated
+		if u.TOTPEnabled {
+			session.Values["authenticated"] = false
+			session.Values["pending_user_id"] = u.ID
+			session.Values["pending_at"] = time.Now().Unix()
+			session.Values["pending_attempts"] = 0
+			if err := session.Save(r, w); err != nil {
 				log.Errorf("Error saving session: %v", err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
-			log.Infof("User %s authenticated successfully", username)
-			http.Redirect(w, r, "/submissions", http.StatusFound)
+			http.Redirect(w, r, "/login/2fa", http.StatusFound)
+			return
+		}
+
+		if err := startSession(w, r, session, u); err != nil {
+			log.Errorf("Error saving session: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := loginGuard.recordSuccess(u.Username); err != nil {
+			log.Errorf("Error resetting failed logins: %v", err)
+		}
+		recordAuditAs(r, u.Username, "user.login", u.Username)
+		if u.MustReset {
+			http.Redirect(w, r, "/account/password", http.StatusFound)
 			return
 		}
-		log.Warnf("Invalid login attempt for username: %s", username)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		http.Redirect(w, r, "/submissions", http.StatusFound)
+		return
+	}
+
+	// The login form needs a CSRF token before the user is authenticated
+	if err := ensureCSRFToken(w, r, session); err != nil {
+		log.Errorf("Error saving session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	http.ServeFile(w, r, "/app/backend/login.html")
@@ -226,15 +272,20 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 // Handler for user logout
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "session-name")
+	username, _ := session.Values["username"].(string)
 	session.Values["authenticated"] = false
+	delete(session.Values, "user_id")
+	delete(session.Values, "username")
+	delete(session.Values, "csrf_token")
 	session.Options.MaxAge = -1
+	setCSRFCookie(w, "", -1)
 	err := session.Save(r, w)
 	if err != nil {
 		log.Errorf("Error saving session: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	log.Info("User logged out")
+	recordAuditAs(r, username, "user.logout", username)
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
 
@@ -243,79 +294,231 @@ func viewSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "/app/backend/index.html")
 }
 
-// API handler to fetch submissions
+// Handler to view a submission with its metadata (admin)
+func viewSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/submission.html")
+}
+
+// API handler to fetch a page of submissions, filtered, sorted and searched
+// with the query parameters
 func apiSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := getDB()
+	filter, err := parseSubmissionFilter(r.URL.Query())
 	if err != nil {
-		log.Errorf("Error opening database: %v", err)
-		http.Error(w, "Could not connect to the database", http.StatusInternalServerError)
+		jsonError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	rows, err := db.Query("SELECT id, form_id, name, email, message, file, read, created_at FROM submissions")
-	if err != nil {
-		log.Errorf("Error querying database: %v", err)
-		http.Error(w, "Could not query the database", http.StatusInternalServerError)
+	if filter.FormID != "" && !authorizeForm(w, r, roleViewer, filter.FormID) {
 		return
 	}
-	defer rows.Close()
 
-	var submissions []map[string]interface{}
-	for rows.Next() {
-		var id int
-		var formID, name, email, message, file, read, createdAt string
-		err := rows.Scan(&id, &formID, &name, &email, &message, &file, &read, &createdAt)
+	// The database only holds the ciphertext of encrypted fields, so they
+	// can't be sorted by and the search skips them
+	var encrypted []string
+	if filter.Search != "" || filter.Sort == "name" || filter.Sort == "email" {
+		config, err := loadConfig("/app/config/config.json")
 		if err != nil {
-			log.Errorf("Error scanning row: %v", err)
-			http.Error(w, "Could not read data from the database", http.StatusInternalServerError)
-			return
+			log.Errorf("Error loading config: %v", err)
+		} else {
+			encrypted = unsearchableFields(config, currentUser(r), filter.FormID)
 		}
-		submission := map[string]interface{}{
-			"id":         id,
-			"form_id":    formID,
-			"name":       name,
-			"email":      email,
-			"message":    message,
-			"file":       file,
-			"read":       read,
-			"created_at": createdAt,
-		}
-		submissions = append(submissions, submission)
+	}
+	if slices.Contains(encrypted, filter.Sort) {
+		jsonError(w, fmt.Sprintf("Submissions can't be sorted by %s, which is encrypted", filter.Sort), http.StatusBadRequest)
+		return
+	}
+
+	submissions, next, err := submissionStore.List(currentUser(r), filter)
+	if err != nil {
+		log.Errorf("Error querying submissions: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"submissions": submissions,
+		"next_cursor": next,
+	}
+	// Tell the caller which fields the search skipped
+	if filter.Search != "" && len(encrypted) > 0 {
+		response["unsearched_fields"] = encrypted
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(submissions)
+	json.NewEncoder(w).Encode(response)
 }
 
-// Handler to delete a submission by ID (admin)
+// Handler to delete a submission by ID (admin). The submission is moved to the
+// trash, or purged together with its uploaded file with permanent=true.
 func deleteSubmissionHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+	var id int64
+	if _, err := fmt.Sscan(mux.Vars(r)["id"], &id); err != nil {
+		jsonError(w, "Invalid submission ID", http.StatusBadRequest)
+		return
+	}
+	permanent, err := parseBoolFilter(r.URL.Query(), "permanent")
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	db, err := getDB()
+	forms, err := submissionStore.FormIDs([]int64{id})
 	if err != nil {
-		log.Errorf("Error opening database: %v", err)
-		http.Error(w, "Could not connect to the database", http.StatusInternalServerError)
+		log.Errorf("Error querying submission: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return
+	}
+	formID, ok := forms[id]
+	if !ok {
+		jsonError(w, "Submission not found", http.StatusNotFound)
+		return
+	}
+	if !authorizeForm(w, r, roleEditor, formID) {
 		return
 	}
 
-	stmt, err := db.Prepare("DELETE FROM submissions WHERE id = ?")
+	if permanent != nil && *permanent {
+		if _, err := purgeSubmissions(submissionSelector{ID: id}); err != nil {
+			log.Errorf("Error purging submission %d: %v", id, err)
+			jsonError(w, "Could not delete submission", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		recordAudit(r, "submission.purge", fmt.Sprint(id))
+		return
+	}
+
+	if _, err := submissionStore.Trash(submissionSelector{ID: id}); err != nil {
+		log.Errorf("Error deleting submission %d: %v", id, err)
+		jsonError(w, "Could not delete submission", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	recordAudit(r, "submission.delete", fmt.Sprint(id))
+}
+
+// API handler to fetch a submission by ID
+func apiSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	var id int64
+	if _, err := fmt.Sscan(mux.Vars(r)["id"], &id); err != nil {
+		jsonError(w, "Invalid submission ID", http.StatusBadRequest)
+		return
+	}
+
+	s, err := submissionStore.Get(id)
+	if err == sql.ErrNoRows {
+		jsonError(w, "Submission not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Errorf("Error preparing delete statement: %v", err)
-		http.Error(w, "Could not prepare delete statement", http.StatusInternalServerError)
+		log.Errorf("Error querying submission %d: %v", id, err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeForm(w, r, roleViewer, s.FormID) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// API handler to mark a submission read or unread, star it, tag it or change its status
+func updateSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	var id int64
+	if _, err := fmt.Sscan(mux.Vars(r)["id"], &id); err != nil {
+		jsonError(w, "Invalid submission ID", http.StatusBadRequest)
 		return
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(id)
+	var update submissionUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !updateSubmissions(w, r, []int64{id}, update) {
+		return
+	}
+
+	s, err := submissionStore.Get(id)
 	if err != nil {
-		log.Errorf("Error executing delete statement: %v", err)
-		http.Error(w, "Could not delete submission", http.StatusInternalServerError)
+		log.Errorf("Error querying submission %d: %v", id, err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
 
-	w.WriteHeader(http.StatusNoContent)
-	log.Infof("Submission with ID %s deleted", id)
+// API handler to apply the same update to several submissions
+func bulkUpdateSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		IDs []int64 `json:"ids"`
+		submissionUpdate
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(request.IDs) == 0 || len(request.IDs) > maxSubmissionsLimit {
+		jsonError(w, fmt.Sprintf("Between 1 and %d submission IDs are required", maxSubmissionsLimit), http.StatusBadRequest)
+		return
+	}
+	if !updateSubmissions(w, r, request.IDs, request.submissionUpdate) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"updated": len(request.IDs)})
+}
+
+// Authorize and apply an update to submissions, all or none of them. Writes an
+// error response and returns false when it fails.
+func updateSubmissions(w http.ResponseWriter, r *http.Request, ids []int64, update submissionUpdate) bool {
+	if err := update.validate(); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	forms, err := submissionStore.FormIDs(ids)
+	if err != nil {
+		log.Errorf("Error querying submissions: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return false
+	}
+
+	role := roleEditor
+	if update.readOnly() {
+		role = roleViewer
+	}
+	for _, id := range ids {
+		formID, ok := forms[id]
+		if !ok {
+			jsonError(w, fmt.Sprintf("Submission %d not found", id), http.StatusNotFound)
+			return false
+		}
+		if !authorizeForm(w, r, role, formID) {
+			return false
+		}
+	}
+
+	if err := submissionStore.Update(ids, update); err != nil {
+		if err == errTooManyTags {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		log.Errorf("Error updating submissions: %v", err)
+		jsonError(w, "Could not update submissions", http.StatusInternalServerError)
+		return false
+	}
+
+	// Submissions are marked read whenever they are opened, which is not worth auditing
+	if !update.readOnly() {
+		for _, id := range ids {
+			recordAudit(r, "submission.update", fmt.Sprint(id))
+		}
+	}
+	return true
 }
 
 // Health check handler
@@ -324,35 +527,217 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+// rateLimitEntry summarizes the rate limit state of one IP address on one form
+type rateLimitEntry struct {
+	IP            string             `json:"ip"`
+	FormID        string             `json:"form_id"`
+	Accepted      int                `json:"accepted"`
+	Rejected      int                `json:"rejected"`
+	Timestamps    []time.Time        `json:"timestamps"`
+	ResetAt       time.Time          `json:"reset_at"`
+	LastSeen      time.Time          `json:"last_seen"`
+	LastUserAgent string             `json:"last_user_agent"`
+	Banned        bool               `json:"banned"`
+	BannedUntil   *time.Time         `json:"banned_until,omitempty"`
+	Override      *rateLimitOverride `json:"override,omitempty"`
+}
+
+// rateLimitFilter selects and orders the rate limit entries
+type rateLimitFilter struct {
+	IP           string
+	FormID       string
+	BannedOnly   bool
+	RejectedOnly bool
+	Sort         string
+	Descending   bool
+}
+
 // API handler to fetch rate limits
 func apiRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
-	rateLimits := getRateLimits()
+	query := r.URL.Query()
+	filter := rateLimitFilter{
+		IP:           query.Get("ip"),
+		FormID:       query.Get("form_id"),
+		BannedOnly:   query.Get("banned") == "true",
+		RejectedOnly: query.Get("rejected") == "true",
+		Sort:         query.Get("sort"),
+		Descending:   query.Get("order") != "asc",
+	}
+
+	rateLimits, err := getRateLimits(currentUser(r), filter)
+	if err != nil {
+		log.Errorf("Error fetching rate limits: %v", err)
+		jsonError(w, "Could not fetch rate limits", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(rateLimits)
 }
 
-func getRateLimits() map[string][]time.Time {
-	rateLimits := make(map[string][]time.Time)
-	rateLimiter.mu.Lock()
-	defer rateLimiter.mu.Unlock()
+// Return the rate limit entries of the forms the user can view
+func getRateLimits(u *user, filter rateLimitFilter) ([]rateLimitEntry, error) {
+	states, err := rateLimiter.States()
+	if err != nil {
+		return nil, err
+	}
+	banList, err := bans.list()
+	if err != nil {
+		return nil, err
+	}
+	activeBans := make(map[string]time.Time)
+	for _, b := range banList {
+		if b.Active {
+			activeBans[b.IP] = b.BannedUntil
+		}
+	}
 
-	for ip, visitor := range rateLimiter.visitors {
-		visitor.mu.Lock()
-		rateLimits[ip] = append([]time.Time(nil), visitor.timestamps...)
-		visitor.mu.Unlock()
+	entries := []rateLimitEntry{}
+	for _, state := range states {
+		// Failed logins are listed with the login lockouts
+		if strings.HasPrefix(state.FormID, loginFormPrefix) {
+			continue
+		}
+		if !u.can(roleViewer, state.FormID) {
+			continue
+		}
+		if filter.IP != "" && !strings.Contains(state.IP, filter.IP) {
+			continue
+		}
+		if filter.FormID != "" && state.FormID != filter.FormID {
+			continue
+		}
+		if filter.RejectedOnly && state.Rejected == 0 {
+			continue
+		}
+
+		entry := rateLimitEntry{
+			IP:            state.IP,
+			FormID:        state.FormID,
+			Accepted:      state.Accepted,
+			Rejected:      state.Rejected,
+			Timestamps:    state.Timestamps,
+			ResetAt:       state.ResetAt,
+			LastSeen:      state.LastSeen,
+			LastUserAgent: state.LastUserAgent,
+		}
+		if until, banned := activeBans[state.IP]; banned {
+			entry.Banned = true
+			entry.BannedUntil = &until
+		} else if filter.BannedOnly {
+			continue
+		}
+		if override, found := rateLimitOverrides.lookup(state.FormID, state.IP); found {
+			entry.Override = &override
+		}
+		entries = append(entries, entry)
 	}
-	return rateLimits
+
+	less := func(a, b rateLimitEntry) bool { return a.LastSeen.Before(b.LastSeen) }
+	switch filter.Sort {
+	case "ip":
+		less = func(a, b rateLimitEntry) bool { return a.IP < b.IP }
+	case "form_id":
+		less = func(a, b rateLimitEntry) bool { return a.FormID < b.FormID }
+	case "accepted":
+		less = func(a, b rateLimitEntry) bool { return a.Accepted < b.Accepted }
+	case "rejected":
+		less = func(a, b rateLimitEntry) bool { return a.Rejected < b.Rejected }
+	case "reset_at":
+		less = func(a, b rateLimitEntry) bool { return a.ResetAt.Before(b.ResetAt) }
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if filter.Descending {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+	return entries, nil
 }
 
-// API handler to clear rate limits for a specific IP
+// API handler to clear rate limits for a specific IP, optionally on one form only
 func clearRateLimitHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	ip := vars["ip"]
+	formID := r.URL.Query().Get("form_id")
+	u := currentUser(r)
+
+	if formID != "" && !authorizeForm(w, r, roleEditor, formID) {
+		return
+	}
+
+	if formID != "" || u.canAll(roleEditor) {
+		if err := rateLimiter.Clear(ip, formID); err != nil {
+			log.Errorf("Error clearing rate limits for IP %s: %v", ip, err)
+			jsonError(w, "Could not clear rate limits", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		// Clear only the forms the user is allowed to edit
+		states, err := rateLimiter.States()
+		if err != nil {
+			log.Errorf("Error fetching rate limits: %v", err)
+			jsonError(w, "Could not fetch rate limits", http.StatusInternalServerError)
+			return
+		}
+		for _, state := range states {
+			if state.IP != ip || !u.can(roleEditor, state.FormID) {
+				continue
+			}
+			if err := rateLimiter.Clear(ip, state.FormID); err != nil {
+				log.Errorf("Error clearing rate limits for IP %s: %v", ip, err)
+				jsonError(w, "Could not clear rate limits", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	if formID != "" {
+		recordAudit(r, "rate_limit.clear", ip+" on form "+formID)
+		return
+	}
+	recordAudit(r, "rate_limit.clear", ip)
+}
+
+// API handler to fetch the automatic bans
+func apiBansHandler(w http.ResponseWriter, r *http.Request) {
+	// Bans apply to all forms, so only users who can view all forms see them
+	if !currentUser(r).canAll(roleViewer) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]ban{})
+		return
+	}
+
+	list, err := bans.list()
+	if err != nil {
+		log.Errorf("Error fetching bans: %v", err)
+		jsonError(w, "Could not fetch bans", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// API handler to lift the ban of a specific IP
+func unbanHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ip := vars["ip"]
+
+	if !authorizeAll(w, r, roleEditor) {
+		return
+	}
 
-	rateLimiter.mu.Lock()
-	delete(rateLimiter.visitors, ip)
-	rateLimiter.mu.Unlock()
+	found, err := bans.unban(ip)
+	if err != nil {
+		log.Errorf("Error lifting ban for IP %s: %v", ip, err)
+		jsonError(w, "Could not lift ban", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		jsonError(w, "Ban not found", http.StatusNotFound)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
-	log.Infof("Rate limits cleared for IP %s", ip)
+	recordAudit(r, "ban.lift", ip)
 }
@@ -0,0 +1,422 @@
+// app/ipfilter.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Actions of an IP rule
+const (
+	ipRuleAllow = "allow"
+	ipRuleDeny  = "deny"
+)
+
+var ipFilters *ipFilterSet
+
+// ipRule is an allow or deny entry for an IP address or CIDR range.
+// Rules with an empty form ID apply to all forms.
+type ipRule struct {
+	ID        int64  `json:"id"`
+	FormID    string `json:"form_id"`
+	CIDR      string `json:"cidr"`
+	Action    string `json:"action"`
+	Note      string `json:"note"`
+	Source    string `json:"source"`
+	CreatedAt string `json:"created_at,omitempty"`
+	network   *net.IPNet
+}
+
+// blockedRequest counts the requests blocked for an IP address
+type blockedRequest struct {
+	IP            string `json:"ip"`
+	FormID        string `json:"form_id"`
+	Reason        string `json:"reason"`
+	Count         int    `json:"count"`
+	LastBlockedAt string `json:"last_blocked_at"`
+}
+
+// ipFilterSet holds the IP rules from the configuration and the database,
+// and the optional country database
+type ipFilterSet struct {
+	config Config
+	rules  []ipRule
+	geoip  *maxminddb.Reader
+	mu     sync.RWMutex
+}
+
+// Initialize the IP filters and open the MaxMind country database if a path is given
+func newIPFilterSet(config Config, geoipPath string) (*ipFilterSet, error) {
+	f := &ipFilterSet{config: config}
+	if geoipPath != "" {
+		reader, err := maxminddb.Open(geoipPath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening country database: %v", err)
+		}
+		f.geoip = reader
+		log.Infof("Country database loaded from %s", geoipPath)
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Parse an IP address or CIDR range into a network
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Build the rules of an IP filter from the configuration
+func configIPRules(formID string, filter IPFilter) ([]ipRule, error) {
+	var rules []ipRule
+	add := func(action string, entries []string) error {
+		for _, entry := range entries {
+			network, err := parseNetwork(entry)
+			if err != nil {
+				return fmt.Errorf("invalid %s entry %q: %v", action, entry, err)
+			}
+			rules = append(rules, ipRule{FormID: formID, CIDR: entry, Action: action, Source: "config", network: network})
+		}
+		return nil
+	}
+	if err := add(ipRuleAllow, filter.Allow); err != nil {
+		return nil, err
+	}
+	if err := add(ipRuleDeny, filter.Deny); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Reload the rules from the configuration and the database
+func (f *ipFilterSet) reload() error {
+	rules, err := configIPRules("", f.config.IPFilter)
+	if err != nil {
+		return err
+	}
+	formIDs := make([]string, 0, len(f.config.Forms))
+	for formID := range f.config.Forms {
+		formIDs = append(formIDs, formID)
+	}
+	sort.Strings(formIDs)
+	for _, formID := range formIDs {
+		formRules, err := configIPRules(formID, f.config.Forms[formID].IPFilter)
+		if err != nil {
+			return fmt.Errorf("form %s: %v", formID, err)
+		}
+		rules = append(rules, formRules...)
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	rows, err := db.Query("SELECT id, form_id, cidr, action, note, created_at FROM ip_rules ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying ip rules: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rule := ipRule{Source: "admin"}
+		if err := rows.Scan(&rule.ID, &rule.FormID, &rule.CIDR, &rule.Action, &rule.Note, &rule.CreatedAt); err != nil {
+			return fmt.Errorf("error scanning ip rule: %v", err)
+		}
+		if rule.network, err = parseNetwork(rule.CIDR); err != nil {
+			log.Warnf("Skipping invalid IP rule %d: %v", rule.ID, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading ip rules: %v", err)
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.mu.Unlock()
+	return nil
+}
+
+// Return a copy of the current rules
+func (f *ipFilterSet) list() []ipRule {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return append([]ipRule(nil), f.rules...)
+}
+
+// Look up the ISO country code of an IP address
+func (f *ipFilterSet) country(ip net.IP) string {
+	if f.geoip == nil {
+		return ""
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := f.geoip.Lookup(ip, &record); err != nil {
+		log.Errorf("Error looking up country for IP %s: %v", ip, err)
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// Check whether requests from an IP address to a form are blocked. A request
+// must pass both the rules for all forms and the rules of the form. Allow rules
+// admit only the IP addresses they match, and deny rules and blocked countries
+// reject IP addresses whether they are allowed or not, so the rules of a form
+// can't let in an IP address denied for all forms.
+func (f *ipFilterSet) check(formID, ip string) (bool, string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, ""
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	scopes := []string{""}
+	if formID != "" {
+		scopes = append(scopes, formID)
+	}
+	for _, scope := range scopes {
+		restricted, allowed := false, false
+		for _, rule := range f.rules {
+			if rule.FormID != scope {
+				continue
+			}
+			matches := rule.network.Contains(parsed)
+			if rule.Action == ipRuleDeny && matches {
+				return true, "deny " + rule.CIDR
+			}
+			if rule.Action == ipRuleAllow {
+				restricted = true
+				allowed = allowed || matches
+			}
+		}
+		if restricted && !allowed {
+			return true, "not allowed"
+		}
+	}
+
+	blockedCountries := f.config.IPFilter.BlockedCountries
+	if formConfig, exists := f.config.Forms[formID]; exists {
+		blockedCountries = append(append([]string(nil), blockedCountries...), formConfig.IPFilter.BlockedCountries...)
+	}
+	if len(blockedCountries) == 0 {
+		return false, ""
+	}
+	country := f.country(parsed)
+	for _, blocked := range blockedCountries {
+		if country != "" && strings.EqualFold(country, blocked) {
+			return true, "country " + country
+		}
+	}
+	return false, ""
+}
+
+// Count a blocked request
+func recordBlockedRequest(ip, formID, reason string) {
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		return
+	}
+	_, err = db.Exec(`INSERT INTO blocked_requests(ip, form_id, reason, count, last_blocked_at) VALUES(?, ?, ?, 1, CURRENT_TIMESTAMP)
+        ON CONFLICT(ip, form_id, reason) DO UPDATE SET count = count + 1, last_blocked_at = CURRENT_TIMESTAMP`,
+		ip, formID, reason)
+	if err != nil {
+		log.Errorf("Error recording blocked request: %v", err)
+	}
+}
+
+// Middleware to block requests from denied IP addresses and countries
+func ipFilterMiddleware(next http.Handler, filters *ipFilterSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		formID := r.FormValue("formid")
+
+		ip, err := clientIP(r)
+		if err != nil {
+			http.Error(w, "Invalid IP address", http.StatusInternalServerError)
+			log.Errorf("Invalid IP address: %v", err)
+			return
+		}
+
+		if blocked, reason := filters.check(formID, ip); blocked {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			log.Warnf("Blocked request from IP: %s, form ID: %s, reason: %s", ip, formID, reason)
+			recordBlockedRequest(ip, formID, reason)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// API handler to fetch the IP rules, blocked countries and blocked request counts
+func apiIPRulesHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		jsonError(w, "Could not connect to the database", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT ip, form_id, reason, count, last_blocked_at FROM blocked_requests ORDER BY last_blocked_at DESC LIMIT 100")
+	if err != nil {
+		log.Errorf("Error querying blocked requests: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	u := currentUser(r)
+	blocked := []blockedRequest{}
+	for rows.Next() {
+		var b blockedRequest
+		if err := rows.Scan(&b.IP, &b.FormID, &b.Reason, &b.Count, &b.LastBlockedAt); err != nil {
+			log.Errorf("Error scanning row: %v", err)
+			jsonError(w, "Could not read data from the database", http.StatusInternalServerError)
+			return
+		}
+		if u.can(roleViewer, b.FormID) {
+			blocked = append(blocked, b)
+		}
+	}
+
+	blockedCountries := map[string][]string{"": ipFilters.config.IPFilter.BlockedCountries}
+	for formID, formConfig := range ipFilters.config.Forms {
+		if len(formConfig.IPFilter.BlockedCountries) > 0 && u.can(roleViewer, formID) {
+			blockedCountries[formID] = formConfig.IPFilter.BlockedCountries
+		}
+	}
+
+	// Rules for all forms are shown to everyone, form rules only to users who can view the form
+	rules := []ipRule{}
+	for _, rule := range ipFilters.list() {
+		if rule.FormID == "" || u.can(roleViewer, rule.FormID) {
+			rules = append(rules, rule)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rules":             rules,
+		"blocked_countries": blockedCountries,
+		"blocked_requests":  blocked,
+	})
+}
+
+// API handler to add an IP rule
+func createIPRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule ipRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	rule.CIDR = strings.TrimSpace(rule.CIDR)
+	if _, err := parseNetwork(rule.CIDR); err != nil {
+		jsonError(w, "Invalid IP address or CIDR range", http.StatusBadRequest)
+		return
+	}
+	if rule.Action != ipRuleAllow && rule.Action != ipRuleDeny {
+		jsonError(w, "Action must be allow or deny", http.StatusBadRequest)
+		return
+	}
+	if _, exists := ipFilters.config.Forms[rule.FormID]; rule.FormID != "" && !exists {
+		jsonError(w, "Form configuration not found", http.StatusBadRequest)
+		return
+	}
+	if !authorizeScope(w, r, roleEditor, rule.FormID) {
+		return
+	}
+
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		jsonError(w, "Could not connect to the database", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO ip_rules(form_id, cidr, action, note) VALUES(?, ?, ?, ?)", rule.FormID, rule.CIDR, rule.Action, rule.Note)
+	if err != nil {
+		log.Errorf("Error inserting ip rule: %v", err)
+		jsonError(w, "Could not save IP rule", http.StatusInternalServerError)
+		return
+	}
+
+	if err := ipFilters.reload(); err != nil {
+		log.Errorf("Error reloading ip rules: %v", err)
+		jsonError(w, "Could not reload IP rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	recordAudit(r, "ip_rule.create", fmt.Sprintf("%s %s for form %q", rule.Action, rule.CIDR, rule.FormID))
+}
+
+// API handler to delete an IP rule by ID
+func deleteIPRuleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		jsonError(w, "Could not connect to the database", http.StatusInternalServerError)
+		return
+	}
+
+	var formID string
+	err = db.QueryRow("SELECT form_id FROM ip_rules WHERE id = ?", id).Scan(&formID)
+	if err == sql.ErrNoRows {
+		jsonError(w, "IP rule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error querying ip rule: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeScope(w, r, roleEditor, formID) {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM ip_rules WHERE id = ?", id); err != nil {
+		log.Errorf("Error deleting ip rule: %v", err)
+		jsonError(w, "Could not delete IP rule", http.StatusInternalServerError)
+		return
+	}
+
+	if err := ipFilters.reload(); err != nil {
+		log.Errorf("Error reloading ip rules: %v", err)
+		jsonError(w, "Could not reload IP rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	recordAudit(r, "ip_rule.delete", id)
+}
@@ -0,0 +1,52 @@
+// app/ipfilter_test.go
+package main
+
+import (
+	"testing"
+)
+
+func TestIPFilterCheck(t *testing.T) {
+	testDB := useTestDB(t)
+	config := Config{
+		IPFilter: IPFilter{Deny: []string{"198.51.100.0/24"}},
+		Forms: map[string]FormConfig{
+			"contact":  {IPFilter: IPFilter{Allow: []string{"198.51.100.7", "203.0.113.0/24"}}},
+			"internal": {IPFilter: IPFilter{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.66"}}},
+			"open":     {},
+		},
+	}
+	// Rules added on the admin page apply like those of the configuration
+	if _, err := testDB.Exec("INSERT INTO ip_rules(form_id, cidr, action) VALUES('open', '192.0.2.0/24', 'deny'), ('', '2001:db8::/32', 'deny')"); err != nil {
+		t.Fatal(err)
+	}
+	filters, err := newIPFilterSet(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, formID, ip string
+		wantBlocked      bool
+		wantReason       string
+	}{
+		{"global deny", "open", "198.51.100.1", true, "deny 198.51.100.0/24"},
+		{"form allow doesn't override a global deny", "contact", "198.51.100.7", true, "deny 198.51.100.0/24"},
+		{"in the allow list of the form", "contact", "203.0.113.5", false, ""},
+		{"outside the allow list of the form", "contact", "192.0.2.1", true, "not allowed"},
+		{"allow list of another form", "open", "10.1.2.3", false, ""},
+		{"form deny of the admin page", "open", "192.0.2.1", true, "deny 192.0.2.0/24"},
+		{"no rules", "open", "203.0.113.5", false, ""},
+		{"form deny inside its allow list", "internal", "10.0.0.66", true, "deny 10.0.0.66"},
+		{"form allow", "internal", "10.1.2.3", false, ""},
+		{"global deny of IPv6", "internal", "2001:db8::1", true, "deny 2001:db8::/32"},
+		{"without a form", "", "203.0.113.5", false, ""},
+		{"global deny without a form", "", "198.51.100.7", true, "deny 198.51.100.0/24"},
+		{"invalid address", "contact", "not an ip", false, ""},
+	}
+	for _, tt := range tests {
+		blocked, reason := filters.check(tt.formID, tt.ip)
+		if blocked != tt.wantBlocked || reason != tt.wantReason {
+			t.Errorf("%s: %s to form %q blocked %t with %q, want %t with %q", tt.name, tt.ip, tt.formID, blocked, reason, tt.wantBlocked, tt.wantReason)
+		}
+	}
+}
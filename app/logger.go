@@ -1,13 +1,88 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
 var log = logrus.New()
 
+// Replacement of the values of redacted log fields
+const redactedValue = "[REDACTED]"
+
+// Field names redacted from the log when the configuration doesn't list any
+var defaultRedactedFields = []string{"name", "email", "message", "password"}
+
+// Email addresses in log messages and fields, with the local part captured
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+(@[A-Za-z0-9.\-]+\.[A-Za-z]{2,})`)
+
+// redactionHook masks personal data in every log entry before it is written
+type redactionHook struct {
+	sync.RWMutex
+	fields map[string]bool
+	emails bool
+}
+
+// Log redaction, configured from the configuration at startup
+var logRedaction = &redactionHook{emails: true}
+
+// Apply the redaction settings of the configuration
+func (h *redactionHook) configure(config LogRedaction) {
+	names := config.Fields
+	if names == nil {
+		names = defaultRedactedFields
+	}
+	fields := map[string]bool{}
+	for _, name := range names {
+		fields[strings.ToLower(name)] = true
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	h.fields = fields
+	h.emails = !config.KeepEmails
+}
+
+// Mask the email addresses in a string, keeping their domain
+func (h *redactionHook) redactString(value string) string {
+	if !h.emails {
+		return value
+	}
+	return emailPattern.ReplaceAllString(value, "***$1")
+}
+
+func (h *redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Mask the configured fields and email addresses. Entries are copies made for
+// each call, so they can be changed in place.
+func (h *redactionHook) Fire(entry *logrus.Entry) error {
+	h.RLock()
+	defer h.RUnlock()
+	for key, value := range entry.Data {
+		if h.fields[strings.ToLower(key)] {
+			entry.Data[key] = redactedValue
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = h.redactString(v)
+		case error:
+			entry.Data[key] = h.redactString(v.Error())
+		case fmt.Stringer:
+			entry.Data[key] = h.redactString(v.String())
+		}
+	}
+	entry.Message = h.redactString(entry.Message)
+	return nil
+}
+
 // Initialize the logger
 func init() {
 	if _, err := os.Stat("/app/logs"); os.IsNotExist(err) {
@@ -24,4 +99,7 @@ func init() {
 	log.Out = logFile
 	log.SetFormatter(&logrus.JSONFormatter{})
 	log.SetLevel(logrus.InfoLevel)
+
+	logRedaction.configure(LogRedaction{})
+	log.AddHook(logRedaction)
 }
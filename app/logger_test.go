@@ -0,0 +1,72 @@
+// app/logger_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedactionHook(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     LogRedaction
+		wantFields map[string]string
+	}{
+		{
+			name:   "default fields",
+			config: LogRedaction{},
+			wantFields: map[string]string{
+				"msg": "Submission from ***@example.com stored", "Email": redactedValue, "message": redactedValue,
+				"phone": "+44 20 7946 0000", "error": "no mailbox for ***@example.org", "form_id": "contact",
+			},
+		},
+		{
+			name:   "configured fields",
+			config: LogRedaction{Fields: []string{"Phone"}},
+			wantFields: map[string]string{
+				"msg": "Submission from ***@example.com stored", "Email": "***@example.com", "message": "hello",
+				"phone": redactedValue, "error": "no mailbox for ***@example.org", "form_id": "contact",
+			},
+		},
+		{
+			name:   "emails kept",
+			config: LogRedaction{Fields: []string{}, KeepEmails: true},
+			wantFields: map[string]string{
+				"msg": "Submission from alice@example.com stored", "Email": "alice@example.com", "message": "hello",
+				"phone": "+44 20 7946 0000", "error": "no mailbox for bob@example.org", "form_id": "contact",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &redactionHook{}
+			hook.configure(tt.config)
+			var out bytes.Buffer
+			logger := logrus.New()
+			logger.Out = &out
+			logger.SetFormatter(&logrus.JSONFormatter{})
+			logger.AddHook(hook)
+
+			logger.WithFields(logrus.Fields{
+				"Email":   "alice@example.com",
+				"message": "hello",
+				"phone":   "+44 20 7946 0000",
+				"form_id": "contact",
+			}).WithError(errors.New("no mailbox for bob@example.org")).Info("Submission from alice@example.com stored")
+
+			var got map[string]string
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.wantFields {
+				if got[key] != want {
+					t.Errorf("%s = %q, want %q", key, got[key], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+// app/loginguard.go
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Prefix of the pseudo form IDs under which the rate limiter counts failed logins
+const loginFormPrefix = "login:"
+
+// Default settings of the login protection
+const (
+	defaultLoginMaxFailures   = 5
+	defaultLoginIPMaxFailures = 20
+	defaultLoginWindow        = 15 * time.Minute
+	defaultLoginDelay         = time.Second
+	defaultLoginMaxDelay      = 30 * time.Second
+	defaultLoginLockout       = 15 * time.Minute
+	defaultLoginMaxLockout    = 24 * time.Hour
+)
+
+var loginGuard *loginThrottle
+
+// loginLockout is the login block of a username or an IP address. The key of
+// a username is its HMAC, except when listed for an existing account.
+type loginLockout struct {
+	Kind         string    `json:"kind"`
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	Level        int       `json:"level"`
+	Locked       bool      `json:"locked"`
+	BlockedUntil time.Time `json:"blocked_until"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// loginThrottle protects the login against password guessing. Failed logins are
+// counted per username and per IP address by the rate limiter. Every failure
+// after the first doubles the time before the next attempt is accepted, and
+// reaching the limit locks logins for the lockout period, which doubles with
+// every lockout that follows shortly after the previous one. Usernames are
+// counted by their HMAC, as mistyped usernames are often passwords.
+type loginThrottle struct {
+	limiter       RateLimiter
+	usernameKey   []byte
+	maxFailures   int
+	ipMaxFailures int
+	window        time.Duration
+	delay         time.Duration
+	maxDelay      time.Duration
+	lockout       time.Duration
+	maxLockout    time.Duration
+}
+
+// Initialize the login protection from the configuration. The key hashing the
+// usernames is derived from the session secret, so rotating the secret forgets
+// the failed logins of accounts.
+func newLoginThrottle(config LoginProtection, limiter RateLimiter, secret string) (*loginThrottle, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("form-handler login lockouts"))
+	t := &loginThrottle{
+		limiter:       limiter,
+		usernameKey:   mac.Sum(nil),
+		maxFailures:   config.MaxFailures,
+		ipMaxFailures: config.IPMaxFailures,
+	}
+	if t.maxFailures <= 0 {
+		t.maxFailures = defaultLoginMaxFailures
+	}
+	if t.ipMaxFailures <= 0 {
+		t.ipMaxFailures = defaultLoginIPMaxFailures
+	}
+	var err error
+	if t.window, err = parseDurationSetting("login_protection.window", config.Window, defaultLoginWindow); err != nil {
+		return nil, err
+	}
+	if t.delay, err = parseDurationSetting("login_protection.delay", config.Delay, defaultLoginDelay); err != nil {
+		return nil, err
+	}
+	if t.maxDelay, err = parseDurationSetting("login_protection.max_delay", config.MaxDelay, defaultLoginMaxDelay); err != nil {
+		return nil, err
+	}
+	if t.lockout, err = parseDurationSetting("login_protection.lockout", config.Lockout, defaultLoginLockout); err != nil {
+		return nil, err
+	}
+	if t.maxLockout, err = parseDurationSetting("login_protection.max_lockout", config.MaxLockout, defaultLoginMaxLockout); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Return the key under which the failed logins of a username are counted
+func (t *loginThrottle) userKey(username string) string {
+	mac := hmac.New(sha256.New, t.usernameKey)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return the wait before the next attempt after the given number of failures
+func (t *loginThrottle) delayFor(failures int) time.Duration {
+	if failures < 2 {
+		return 0
+	}
+	d := time.Duration(float64(t.delay) * math.Pow(2, float64(failures-2)))
+	return min(d, t.maxDelay)
+}
+
+// Return the duration of a lockout at the given escalation level
+func (t *loginThrottle) lockoutFor(level int) time.Duration {
+	d := t.lockout
+	for i := 1; i < level && d < t.maxLockout; i++ {
+		d *= 2
+	}
+	return min(d, t.maxLockout)
+}
+
+// Return how long logins for the username or from the IP address are still blocked
+func (t *loginThrottle) blockedFor(username, ip string) (time.Duration, error) {
+	db, err := getDB()
+	if err != nil {
+		return 0, fmt.Errorf("error opening database: %v", err)
+	}
+
+	rows, err := db.Query("SELECT blocked_until FROM login_lockouts WHERE (kind = 'user' AND key = ?) OR (kind = 'ip' AND key = ?)",
+		t.userKey(username), ip)
+	if err != nil {
+		return 0, fmt.Errorf("error querying login lockouts: %v", err)
+	}
+	defer rows.Close()
+
+	var wait time.Duration
+	for rows.Next() {
+		var until time.Time
+		if err := rows.Scan(&until); err != nil {
+			return 0, fmt.Errorf("error scanning login lockout: %v", err)
+		}
+		wait = max(wait, time.Until(until))
+	}
+	return wait, rows.Err()
+}
+
+// Record a failed login for the username and the IP address
+func (t *loginThrottle) recordFailure(username, ip, userAgent string) error {
+	if err := t.cleanup(); err != nil {
+		return err
+	}
+	if err := t.recordKey("user", t.userKey(username), t.maxFailures, userAgent); err != nil {
+		return err
+	}
+	return t.recordKey("ip", ip, t.ipMaxFailures, userAgent)
+}
+
+// Count a failed login of one username or IP address and block the next attempts
+func (t *loginThrottle) recordKey(kind, key string, maxFailures int, userAgent string) error {
+	formID := loginFormPrefix + kind
+	limit := RateLimit{Requests: maxFailures, Duration: t.window.String()}
+	result, err := t.limiter.Allow(formID, key, userAgent, limit, t.window)
+	if err != nil {
+		return fmt.Errorf("error counting failed login: %v", err)
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var level int
+	var locked bool
+	var lockedUntil sql.NullTime
+	err = tx.QueryRow("SELECT level, locked, locked_until FROM login_lockouts WHERE kind = ? AND key = ?", kind, key).
+		Scan(&level, &locked, &lockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error querying login lockout: %v", err)
+	}
+
+	now := time.Now().UTC()
+	failures := result.Limit - result.Remaining
+	var until time.Time
+	if result.Allowed && result.Remaining > 0 {
+		until = now.Add(t.delayFor(failures))
+		locked = false
+	} else {
+		// Lockouts shortly after the previous one last longer
+		if !lockedUntil.Valid || now.Sub(lockedUntil.Time) > t.maxLockout {
+			level = 0
+		}
+		level++
+		duration := t.lockoutFor(level)
+		until = now.Add(duration)
+		lockedUntil = sql.NullTime{Time: until, Valid: true}
+		locked = true
+		failures = maxFailures
+
+		// Count the failures after the lockout from zero
+		if err := t.limiter.Clear(key, formID); err != nil {
+			return fmt.Errorf("error resetting failed logins: %v", err)
+		}
+		if kind == "ip" {
+			log.Warnf("Logins from IP %s locked for %s after %d failed attempts", key, duration, maxFailures)
+		} else {
+			log.Warnf("Logins of an account locked for %s after %d failed attempts", duration, maxFailures)
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO login_lockouts(kind, key, failures, level, locked, blocked_until, locked_until, updated_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(kind, key) DO UPDATE SET failures = excluded.failures, level = excluded.level, locked = excluded.locked,
+            blocked_until = excluded.blocked_until, locked_until = excluded.locked_until, updated_at = excluded.updated_at`,
+		kind, key, failures, level, locked, until, lockedUntil, now)
+	if err != nil {
+		return fmt.Errorf("error saving login lockout: %v", err)
+	}
+	return tx.Commit()
+}
+
+// Delete the lockouts that can no longer escalate, such as those of mistyped usernames
+func (t *loginThrottle) cleanup() error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	_, err = db.Exec("DELETE FROM login_lockouts WHERE blocked_until < ?", time.Now().UTC().Add(-t.maxLockout))
+	if err != nil {
+		return fmt.Errorf("error cleaning up login lockouts: %v", err)
+	}
+	return nil
+}
+
+// Forget the failed logins of a username after a successful login
+func (t *loginThrottle) recordSuccess(username string) error {
+	_, err := t.unlock("user", username)
+	return err
+}
+
+// List the active lockouts of existing accounts, by username, and of IP addresses
+func (t *loginThrottle) list() ([]loginLockout, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+
+	usernames := map[string]string{}
+	users, err := db.Query("SELECT username FROM users")
+	if err != nil {
+		return nil, fmt.Errorf("error querying users: %v", err)
+	}
+	defer users.Close()
+	for users.Next() {
+		var username string
+		if err := users.Scan(&username); err != nil {
+			return nil, fmt.Errorf("error scanning user: %v", err)
+		}
+		usernames[t.userKey(username)] = username
+	}
+	if err := users.Err(); err != nil {
+		return nil, fmt.Errorf("error reading users: %v", err)
+	}
+	users.Close()
+
+	rows, err := db.Query(`SELECT kind, key, failures, level, locked, blocked_until, updated_at FROM login_lockouts
+        WHERE locked = 1 AND blocked_until > ? ORDER BY blocked_until DESC`, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error querying login lockouts: %v", err)
+	}
+	defer rows.Close()
+
+	result := []loginLockout{}
+	for rows.Next() {
+		var entry loginLockout
+		if err := rows.Scan(&entry.Kind, &entry.Key, &entry.Failures, &entry.Level, &entry.Locked, &entry.BlockedUntil, &entry.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning login lockout: %v", err)
+		}
+		// Usernames that don't exist are not shown
+		if entry.Kind == "user" {
+			username, exists := usernames[entry.Key]
+			if !exists {
+				continue
+			}
+			entry.Key = username
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+// Lift the lockout of a username or IP address and forget its failed logins
+func (t *loginThrottle) unlock(kind, key string) (bool, error) {
+	if kind == "user" {
+		key = t.userKey(key)
+	}
+	if err := t.limiter.Clear(key, loginFormPrefix+kind); err != nil {
+		return false, fmt.Errorf("error resetting failed logins: %v", err)
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return false, fmt.Errorf("error opening database: %v", err)
+	}
+	result, err := db.Exec("DELETE FROM login_lockouts WHERE kind = ? AND key = ?", kind, key)
+	if err != nil {
+		return false, fmt.Errorf("error deleting login lockout: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Reject a login attempt while logins for the username or from the IP address are blocked
+func checkLoginAllowed(w http.ResponseWriter, r *http.Request, username string) bool {
+	ip, _ := clientIP(r)
+	wait, err := loginGuard.blockedFor(username, ip)
+	if err != nil {
+		log.Errorf("Error checking login lockouts: %v", err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	log.Warnf("Login attempt from IP %s rejected while blocked", ip)
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed login attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+	return false
+}
+
+// Record a failed login attempt for the username and the IP address of the request
+func recordLoginFailure(r *http.Request, username string) {
+	ip, _ := clientIP(r)
+	if err := loginGuard.recordFailure(username, ip, r.UserAgent()); err != nil {
+		log.Errorf("Error recording failed login: %v", err)
+	}
+}
+
+// Return the username for the audit log only when the account exists, as mistyped
+// usernames are often passwords
+func loginActor(username string) string {
+	if _, err := getUserByUsername(username); err != nil {
+		return "unknown user"
+	}
+	return username
+}
+
+// API handler to fetch the locked accounts and IP addresses (admin)
+func apiLoginLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := loginGuard.list()
+	if err != nil {
+		log.Errorf("Error fetching login lockouts: %v", err)
+		jsonError(w, "Could not fetch login lockouts", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// API handler to unlock an account or IP address (admin)
+func unlockLoginHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kind, key := vars["kind"], vars["key"]
+	if kind != "user" && kind != "ip" {
+		jsonError(w, "Invalid lockout kind", http.StatusBadRequest)
+		return
+	}
+
+	found, err := loginGuard.unlock(kind, key)
+	if err != nil {
+		log.Errorf("Error unlocking login: %v", err)
+		jsonError(w, "Could not unlock login", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		jsonError(w, "Lockout not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, "login.unlock", kind+" "+key)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -9,9 +9,17 @@ import (
 	"github.com/joho/godotenv"
 )
 
-var rateLimiter *RateLimiter
+var (
+	rateLimiter     RateLimiter
+	submissionStore SubmissionStore
+)
 
 func main() {
+	// Run a command line subcommand such as "user add" instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	// Load environment variables from .env file
 	err := godotenv.Load("/app/.env")
 	if err != nil {
@@ -25,6 +33,9 @@ func main() {
 		}
 	}
 
+	// Initialize the database, before loading the configuration records its version
+	initDatabase()
+
 	// Load the application configuration
 	configPath := "/app/config/config.json"
 	config, err := loadConfig(configPath)
@@ -32,32 +43,157 @@ func main() {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	// Initialize the database
-	initDatabase()
+	// Mask personal data in the log as configured
+	logRedaction.configure(config.LogRedaction)
+
+	if err := validateRetention(config); err != nil {
+		log.Fatalf("Error in data retention config: %v", err)
+	}
+
+	// Load the keys encrypting sensitive submission fields
+	if err := initEncryption(); err != nil {
+		log.Fatalf("Error loading encryption keys: %v", err)
+	}
+	if err := validateEncryption(config); err != nil {
+		log.Fatalf("Error in encryption config: %v", err)
+	}
+	if indexed, err := indexSubmissions(); err != nil {
+		log.Fatalf("Error indexing data subjects: %v", err)
+	} else if indexed > 0 {
+		log.Infof("Indexed %d names and email addresses for the data subject search", indexed)
+	}
+
+	// Create the first user from the environment if there are no users yet
+	if err := bootstrapAdminUser(); err != nil {
+		log.Fatalf("Error creating the first user: %v", err)
+	}
+
+	// Initialize the session store
+	if err := initSessionStore(); err != nil {
+		log.Fatalf("Error initializing sessions: %v", err)
+	}
+
+	// Sign the links to uploaded files with a key derived from the session secret
+	if err := initUploadSigning(os.Getenv("SESSION_SECRET")); err != nil {
+		log.Fatalf("Error initializing upload links: %v", err)
+	}
+
+	// Purge or anonymize expired submissions and purge the trash
+	go runRetention()
 
 	// Initialize the rate limiter
-	rateLimiter = newRateLimiter()
+	rateLimiter, err = newRateLimiterFromEnv()
+	if err != nil {
+		log.Fatalf("Error initializing rate limiter: %v", err)
+	}
+
+	// Initialize the IP filters
+	ipFilters, err = newIPFilterSet(config, os.Getenv("GEOIP_DATABASE"))
+	if err != nil {
+		log.Fatalf("Error initializing IP filters: %v", err)
+	}
+
+	// Initialize the automatic bans
+	bans, err = newBanList(config.AutoBan)
+	if err != nil {
+		log.Fatalf("Error initializing automatic bans: %v", err)
+	}
+
+	// Initialize the login brute-force protection
+	loginGuard, err = newLoginThrottle(config.LoginProtection, rateLimiter, os.Getenv("SESSION_SECRET"))
+	if err != nil {
+		log.Fatalf("Error initializing login protection: %v", err)
+	}
+
+	// Load the rate limit overrides
+	rateLimitOverrides, err = newRateLimitOverrideSet()
+	if err != nil {
+		log.Fatalf("Error loading rate limit overrides: %v", err)
+	}
+
+	// Initialize single sign-on when an identity provider is configured
+	oidcClient, err = newOIDCLogin(config.OIDC)
+	if err != nil {
+		log.Fatalf("Error initializing single sign-on: %v", err)
+	}
 
 	// Create a new router
 	r := mux.NewRouter()
+	r.Use(csrfMiddleware)
 
 	// Define routes
 	r.HandleFunc("/login", loginHandler).Methods("GET", "POST")
-	r.HandleFunc("/logout", logoutHandler).Methods("GET")
+	r.HandleFunc("/login/2fa", loginTwoFactorHandler).Methods("GET", "POST")
+	r.HandleFunc("/login/oidc", oidcLoginHandler).Methods("GET")
+	r.HandleFunc("/login/oidc/callback", oidcCallbackHandler).Methods("GET")
+	r.HandleFunc("/api/login-options", loginOptionsHandler).Methods("GET")
+	r.HandleFunc("/logout", logoutHandler).Methods("POST")
 	r.Handle("/submissions", authMiddleware(http.HandlerFunc(viewSubmissionsHandler)))
+	r.Handle("/submissions/{id:[0-9]+}", authMiddleware(http.HandlerFunc(viewSubmissionHandler))).Methods("GET")
 	r.Handle("/api/submissions", authMiddleware(http.HandlerFunc(apiSubmissionsHandler))).Methods("GET")
+	r.Handle("/api/submissions", authMiddleware(http.HandlerFunc(bulkUpdateSubmissionsHandler))).Methods("PATCH")
+	r.Handle("/api/submissions", authMiddleware(http.HandlerFunc(deleteSubmissionsHandler))).Methods("DELETE")
+	r.Handle("/api/forms/{form_id}/export", authMiddleware(http.HandlerFunc(exportSubmissionsHandler))).Methods("GET")
+	r.Handle("/api/submissions/{id}", authMiddleware(http.HandlerFunc(apiSubmissionHandler))).Methods("GET")
+	r.Handle("/api/submissions/{id}", authMiddleware(http.HandlerFunc(updateSubmissionHandler))).Methods("PATCH")
 	r.Handle("/api/submissions/{id}", authMiddleware(http.HandlerFunc(deleteSubmissionHandler))).Methods("DELETE")
 	r.HandleFunc("/health", healthHandler).Methods("GET")
+	r.Handle("/users", authMiddleware(requireOwner(http.HandlerFunc(viewUsersHandler)))).Methods("GET")
+	r.Handle("/api/users", authMiddleware(requireOwner(http.HandlerFunc(apiUsersHandler)))).Methods("GET")
+	r.Handle("/api/users", authMiddleware(requireOwner(http.HandlerFunc(createUserHandler)))).Methods("POST")
+	r.Handle("/api/users/{id}", authMiddleware(requireOwner(http.HandlerFunc(deleteUserHandler)))).Methods("DELETE")
+	r.Handle("/api/users/{id}/grants", authMiddleware(requireOwner(http.HandlerFunc(setUserGrantsHandler)))).Methods("PUT")
+	r.Handle("/api/users/{id}/reset", authMiddleware(requireOwner(http.HandlerFunc(resetUserPasswordHandler)))).Methods("POST")
+	r.Handle("/api/users/{id}/2fa", authMiddleware(requireOwner(http.HandlerFunc(resetUserTwoFactorHandler)))).Methods("DELETE")
+	r.Handle("/api/login-lockouts", authMiddleware(requireOwner(http.HandlerFunc(apiLoginLockoutsHandler)))).Methods("GET")
+	r.Handle("/api/login-lockouts/{kind}/{key:.+}", authMiddleware(requireOwner(http.HandlerFunc(unlockLoginHandler)))).Methods("DELETE")
+	r.Handle("/api/settings", authMiddleware(requireOwner(http.HandlerFunc(apiSettingsHandler)))).Methods("GET")
+	r.Handle("/audit", authMiddleware(requireOwner(http.HandlerFunc(viewAuditHandler)))).Methods("GET")
+	r.Handle("/api/audit", authMiddleware(requireOwner(http.HandlerFunc(apiAuditHandler)))).Methods("GET")
+	r.Handle("/api/audit/export", authMiddleware(requireOwner(http.HandlerFunc(exportAuditHandler)))).Methods("GET")
+	r.Handle("/data-subject", authMiddleware(requireOwner(http.HandlerFunc(viewDataSubjectHandler)))).Methods("GET")
+	r.Handle("/api/data-subject", authMiddleware(requireOwner(http.HandlerFunc(apiDataSubjectHandler)))).Methods("GET")
+	r.Handle("/api/data-subject", authMiddleware(requireOwner(http.HandlerFunc(eraseDataSubjectHandler)))).Methods("DELETE")
+	r.Handle("/api/data-subject/export", authMiddleware(requireOwner(http.HandlerFunc(exportDataSubjectHandler)))).Methods("GET")
+	r.Handle("/api/retention", authMiddleware(requireOwner(http.HandlerFunc(apiRetentionHandler)))).Methods("GET")
+	r.Handle("/retention", authMiddleware(requireOwner(http.HandlerFunc(viewRetentionHandler)))).Methods("GET")
+	r.Handle("/api/settings", authMiddleware(requireOwner(http.HandlerFunc(updateSettingsHandler)))).Methods("PUT")
+	r.Handle("/account/password", authMiddleware(http.HandlerFunc(viewPasswordHandler))).Methods("GET")
+	r.Handle("/api/account/password", authMiddleware(http.HandlerFunc(changePasswordHandler))).Methods("POST")
+	r.Handle("/api/account", authMiddleware(http.HandlerFunc(apiAccountHandler))).Methods("GET")
+	r.Handle("/account/tokens", authMiddleware(http.HandlerFunc(viewAPITokensHandler))).Methods("GET")
+	r.Handle("/api/tokens", authMiddleware(http.HandlerFunc(apiTokensHandler))).Methods("GET")
+	r.Handle("/api/tokens", authMiddleware(http.HandlerFunc(createAPITokenHandler))).Methods("POST")
+	r.Handle("/api/tokens/{id}", authMiddleware(http.HandlerFunc(deleteAPITokenHandler))).Methods("DELETE")
+	r.Handle("/account/sessions", authMiddleware(http.HandlerFunc(viewSessionsHandler))).Methods("GET")
+	r.Handle("/api/account/sessions", authMiddleware(http.HandlerFunc(apiSessionsHandler))).Methods("GET")
+	r.Handle("/api/account/sessions", authMiddleware(http.HandlerFunc(revokeOtherSessionsHandler))).Methods("DELETE")
+	r.Handle("/api/account/sessions/{id}", authMiddleware(http.HandlerFunc(revokeSessionHandler))).Methods("DELETE")
+	r.Handle("/account/2fa", authMiddleware(http.HandlerFunc(viewTwoFactorHandler))).Methods("GET")
+	r.Handle("/api/account/2fa", authMiddleware(http.HandlerFunc(apiTwoFactorHandler))).Methods("GET")
+	r.Handle("/api/account/2fa/setup", authMiddleware(http.HandlerFunc(setupTwoFactorHandler))).Methods("POST")
+	r.Handle("/api/account/2fa/enable", authMiddleware(http.HandlerFunc(enableTwoFactorHandler))).Methods("POST")
+	r.Handle("/api/account/2fa/disable", authMiddleware(http.HandlerFunc(disableTwoFactorHandler))).Methods("POST")
+	r.Handle("/api/account/2fa/recovery-codes", authMiddleware(http.HandlerFunc(regenerateRecoveryCodesHandler))).Methods("POST")
 	r.Handle("/api/rate-limits", authMiddleware(http.HandlerFunc(apiRateLimitsHandler))).Methods("GET")
 	r.Handle("/rate-limits", authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "/app/backend/rate_limits.html")
 	}))).Methods("GET")
 	r.Handle("/api/rate-limits/{ip}", authMiddleware(http.HandlerFunc(clearRateLimitHandler))).Methods("DELETE")
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("/app/uploads/"))))
+	r.Handle("/api/rate-limit-overrides", authMiddleware(http.HandlerFunc(apiRateLimitOverridesHandler))).Methods("GET")
+	r.Handle("/api/rate-limit-overrides", authMiddleware(http.HandlerFunc(createRateLimitOverrideHandler))).Methods("POST")
+	r.Handle("/api/rate-limit-overrides/{id}", authMiddleware(http.HandlerFunc(deleteRateLimitOverrideHandler))).Methods("DELETE")
+	r.Handle("/api/bans", authMiddleware(http.HandlerFunc(apiBansHandler))).Methods("GET")
+	r.Handle("/api/bans/{ip}", authMiddleware(http.HandlerFunc(unbanHandler))).Methods("DELETE")
+	r.Handle("/api/ip-rules", authMiddleware(http.HandlerFunc(apiIPRulesHandler))).Methods("GET")
+	r.Handle("/api/ip-rules", authMiddleware(http.HandlerFunc(createIPRuleHandler))).Methods("POST")
+	r.Handle("/api/ip-rules/{id}", authMiddleware(http.HandlerFunc(deleteIPRuleHandler))).Methods("DELETE")
+	r.PathPrefix("/uploads/").HandlerFunc(uploadsHandler).Methods("GET", "HEAD")
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("/app/backend/static/"))))
 
-	// Apply rate limit and CORS middleware to form submission route
-	submitHandler := rateLimitMiddleware(http.HandlerFunc(formHandler), rateLimiter, config)
+	// Apply IP filter, rate limit and CORS middleware to form submission route
+	submitHandler := rateLimitMiddleware(http.HandlerFunc(formHandler), rateLimiter, bans, rateLimitOverrides, config)
+	submitHandler = ipFilterMiddleware(submitHandler, ipFilters)
 	submitHandler = dynamicCORSMiddleware(submitHandler, config)
 	r.Handle("/api/forms", submitHandler).Methods("POST")
 
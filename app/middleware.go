@@ -3,68 +3,40 @@ package main
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"fmt"
+	"math"
 	"math/big"
 	"mime/multipart"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-// RateLimiter tracks the visitors and their request counts
-type RateLimiter struct {
-	visitors map[string]*visitor
-	mu       sync.Mutex
-}
-
-// visitor represents a visitor with the last seen time and request count
-type visitor struct {
-	lastSeen   time.Time
-	requests   int
-	timestamps []time.Time
-	mu         sync.Mutex
-}
-
-// Initialize a new RateLimiter
-func newRateLimiter() *RateLimiter {
-	rl := &RateLimiter{
-		visitors: make(map[string]*visitor),
-	}
-	go rl.cleanupVisitors()
-	return rl
-}
-
-// Get or create a visitor entry for an IP address
-func (rl *RateLimiter) getVisitor(ip string) *visitor {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	v, exists := rl.visitors[ip]
-	if !exists {
-		v = &visitor{lastSeen: time.Now()}
-		rl.visitors[ip] = v
+// Set the rate limit headers of the response
+func setRateLimitHeaders(w http.ResponseWriter, result rateLimitResult) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(result.Reset.Unix(), 10))
+	if !result.Allowed {
+		retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
 	}
-	return v
 }
 
-// Periodically clean up old visitors
-func (rl *RateLimiter) cleanupVisitors() {
-	for {
-		time.Sleep(time.Minute)
-		rl.mu.Lock()
-		for ip, v := range rl.visitors {
-			if time.Since(v.lastSeen) > time.Minute {
-				delete(rl.visitors, ip)
-			}
-		}
-		rl.mu.Unlock()
-	}
+// Extract the client IP address from the request
+func clientIP(r *http.Request) (string, error) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	return ip, err
 }
 
 // Middleware to apply rate limiting based on the form configuration
-func rateLimitMiddleware(next http.Handler, rl *RateLimiter, config Config) http.Handler {
+func rateLimitMiddleware(next http.Handler, rl RateLimiter, bans *banList, overrides *rateLimitOverrideSet, config Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		formID := r.FormValue("formid")
 		if formID == "" {
@@ -80,60 +52,162 @@ func rateLimitMiddleware(next http.Handler, rl *RateLimiter, config Config) http
 			return
 		}
 
-		duration, err := time.ParseDuration(formConfig.RateLimit.Duration)
+		ip, err := clientIP(r)
 		if err != nil {
-			http.Error(w, "Invalid rate limit duration", http.StatusInternalServerError)
-			log.Errorf("Invalid rate limit duration for form %s: %v", formID, err)
+			http.Error(w, "Invalid IP address", http.StatusInternalServerError)
+			log.Errorf("Invalid IP address: %v", err)
 			return
 		}
 
-		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		limit := formConfig.RateLimit
+		if override, found := overrides.lookup(formID, ip); found {
+			limit = override.RateLimit
+		}
+
+		duration, err := limit.window()
 		if err != nil {
-			http.Error(w, "Invalid IP address", http.StatusInternalServerError)
-			log.Errorf("Invalid IP address: %v", err)
+			http.Error(w, "Invalid rate limit configuration", http.StatusInternalServerError)
+			log.Errorf("Invalid rate limit for form %s: %v", formID, err)
 			return
 		}
 
-		visitor := rl.getVisitor(ip)
-		visitor.mu.Lock()
-		defer visitor.mu.Unlock()
-
-		log.Infof("Visitor %s - requests: %d, lastSeen: %s", ip, visitor.requests, visitor.lastSeen)
-		if time.Since(visitor.lastSeen) > duration {
-			visitor.requests = 0
-			visitor.timestamps = []time.Time{}
+		until, banned, err := bans.bannedUntil(ip)
+		if err != nil {
+			log.Errorf("Error checking ban for IP: %s: %v", ip, err)
+		}
+		if banned {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+			http.Error(w, "IP address is temporarily banned", http.StatusForbidden)
+			log.Warnf("Request from banned IP: %s, form ID: %s", ip, formID)
+			recordBlockedRequest(ip, formID, "ban")
+			return
 		}
 
-		if visitor.requests >= formConfig.RateLimit.Requests {
+		result, err := rl.Allow(formID, ip, r.UserAgent(), limit, duration)
+		if err != nil {
+			// Fail open so that an unavailable backend does not take the forms down
+			log.Errorf("Error checking rate limit for IP: %s, form ID: %s: %v", ip, formID, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		setRateLimitHeaders(w, result)
+		if !result.Allowed {
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			log.Warnf("Rate limit exceeded for IP: %s, form ID: %s", ip, formID)
+			if err := bans.recordViolation(ip, formID); err != nil {
+				log.Errorf("Error recording rate limit violation for IP: %s: %v", ip, err)
+			}
 			return
 		}
-
-		visitor.requests++
-		visitor.lastSeen = time.Now()
-		visitor.timestamps = append(visitor.timestamps, visitor.lastSeen)
-		log.Infof("Visitor %s - incremented requests to: %d", ip, visitor.requests)
+		log.Infof("Visitor %s - form %s, remaining requests: %d", ip, formID, result.Remaining)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// Paths a user who must change their password can still access
+var passwordResetPaths = map[string]bool{
+	"/account/password":     true,
+	"/api/account/password": true,
+}
+
+// Reject an unauthenticated request, with a 401 JSON response for the API and a redirect to the login page otherwise
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		jsonError(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// Reject a request of a user who must first complete their account, with a 403
+// JSON response for the API and a redirect to the page completing it otherwise
+func rejectIncompleteAccount(w http.ResponseWriter, r *http.Request, message, page string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		jsonError(w, message, http.StatusForbidden)
+		return
+	}
+	http.Redirect(w, r, page, http.StatusFound)
+}
+
 // Middleware to handle authentication
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests with an API token are authenticated by the token alone, never by the session cookie
+		if token := bearerToken(r); token != "" {
+			apiTokenAuth(w, r, token, next)
+			return
+		}
+
 		session, _ := store.Get(r, "session-name")
 		auth, ok := session.Values["authenticated"].(bool)
-		log.Infof("Auth check - authenticated: %v, ok: %v", auth, ok)
-		if !ok || !auth {
+		userID, _ := session.Values["user_id"].(int64)
+		if !ok || !auth || userID == 0 {
 			log.Warn("Unauthorized access attempt")
-			http.Redirect(w, r, "/login", http.StatusFound)
+			rejectUnauthenticated(w, r)
 			return
 		}
-		next.ServeHTTP(w, r)
+
+		u, err := getUserByID(userID)
+		if err == sql.ErrNoRows {
+			log.Warnf("Session of deleted user %d rejected", userID)
+			rejectUnauthenticated(w, r)
+			return
+		}
+		if err != nil {
+			log.Errorf("Error loading user %d: %v", userID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// Sessions started before CSRF protection have no token yet
+		if err := ensureCSRFToken(w, r, session); err != nil {
+			log.Errorf("Error saving session: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if u.MustReset && !passwordResetPaths[r.URL.Path] {
+			rejectIncompleteAccount(w, r, "password change required", "/account/password")
+			return
+		}
+		if !twoFactorSetupPaths[r.URL.Path] && needsTwoFactorSetup(u) {
+			rejectIncompleteAccount(w, r, "two-factor setup required", "/account/2fa")
+			return
+		}
+
+		next.ServeHTTP(w, withUser(r, u))
 	})
 }
 
+// Authenticate an API request with a bearer token
+func apiTokenAuth(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="form-handler"`)
+	if !strings.HasPrefix(r.URL.Path, "/api/") || apiTokenDenied(r.URL.Path) {
+		log.Warnf("API token used on %s rejected", r.URL.Path)
+		jsonError(w, "API tokens can't be used on this endpoint", http.StatusForbidden)
+		return
+	}
+
+	u, err := authenticateAPIToken(token)
+	if err == errInvalidAPIToken {
+		log.Warn("Request with an invalid API token rejected")
+		jsonError(w, "Invalid or expired API token", http.StatusUnauthorized)
+		return
+	}
+	if err == errAPITokenOwner {
+		log.Warn("Request with an API token of an incomplete account rejected")
+		jsonError(w, "The owner of this token must change their password or set up two-factor authentication", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error authenticating API token: %v", err)
+		jsonError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	next.ServeHTTP(w, withUser(r, u))
+}
+
 // Generate a random string of given length
 func generateRandomString(n int) (string, error) {
 	const letters = "0123456789"
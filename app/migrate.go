@@ -0,0 +1,310 @@
+// app/migrate.go
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQL migrations of the databases, named <version>_<name>.up.sql and
+// <version>_<name>.down.sql. The SQLite migrations are at the top, those of the
+// shared submissions databases in a directory per database.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Prefix of a comment line in a down file that destroys data which must be kept,
+// followed by the reason. Such migrations are only rolled back when forced.
+const migrationForcePrefix = "-- force:"
+
+// migration is a versioned change of the database schema
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Why rolling back requires -force, empty when it doesn't
+	Force string
+}
+
+// migrationStatus is a migration and when it was applied, if it was
+type migrationStatus struct {
+	migration
+	AppliedAt *time.Time
+}
+
+// Columns added to the submissions table by versions before migrations, with
+// their definitions, so those databases can be brought up to the initial migration
+var legacySubmissionColumns = []struct{ name, definition string }{
+	{"spam", "INTEGER NOT NULL DEFAULT 0"},
+	{"starred", "INTEGER NOT NULL DEFAULT 0"},
+	{"status", "TEXT NOT NULL DEFAULT 'new'"},
+	{"tags", "TEXT NOT NULL DEFAULT '[]'"},
+	{"deleted_at", "DATETIME"},
+	{"anonymized_at", "DATETIME"},
+	{"ip", "TEXT NOT NULL DEFAULT ''"},
+	{"user_agent", "TEXT NOT NULL DEFAULT ''"},
+	{"referer", "TEXT NOT NULL DEFAULT ''"},
+	{"origin", "TEXT NOT NULL DEFAULT ''"},
+	{"accept_language", "TEXT NOT NULL DEFAULT ''"},
+	{"config_version", "TEXT NOT NULL DEFAULT ''"},
+	{"processing_ms", "REAL NOT NULL DEFAULT 0"},
+	{"name_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"email_hash", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// Return the embedded migrations of a database sorted by version
+func loadMigrations(dialect sqlDialect) ([]migration, error) {
+	dir := dialect.migrations()
+	names, err := fs.Glob(migrationFiles, dir+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, path := range names {
+		file := strings.TrimPrefix(path, dir+"/")
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %s", file)
+		}
+		content, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+			continue
+		}
+		m.Down = string(content)
+		for _, line := range strings.Split(m.Down, "\n") {
+			if reason, ok := strings.CutPrefix(strings.TrimSpace(line), migrationForcePrefix); ok {
+				m.Force = strings.TrimSpace(reason)
+			}
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Create the schema_version table of the SQLite database, recording the migrations
+// applied to it. Databases created before migrations get the columns the initial
+// migration expects.
+func initSQLiteSchemaVersion(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&exists); err != nil {
+		return fmt.Errorf("error checking for schema_version table: %v", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	var legacy int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'submissions'").Scan(&legacy); err != nil {
+		return fmt.Errorf("error checking for submissions table: %v", err)
+	}
+	if legacy > 0 {
+		for _, column := range legacySubmissionColumns {
+			if err := ensureColumn(db, "submissions", column.name, column.definition); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := db.Exec(`CREATE TABLE schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at DATETIME NOT NULL
+    )`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %v", err)
+	}
+	return nil
+}
+
+// Create the schema_version table of a shared submissions database, with the
+// type of its timestamps
+func createSchemaVersion(db *sql.DB, timestamp string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name VARCHAR(255) NOT NULL,
+        applied_at ` + timestamp + ` NOT NULL
+    )`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %v", err)
+	}
+	return nil
+}
+
+// Return when each applied migration was applied, by version
+func appliedMigrations(db *sql.DB, dialect sqlDialect) (map[int]time.Time, error) {
+	if err := dialect.initSchemaVersion(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, fmt.Errorf("error querying schema_version: %v", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("error scanning schema_version: %v", err)
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Return the migrations and whether they have been applied. Fails when the
+// database has migrations this version doesn't know, as it was migrated by a
+// newer version.
+func migrationStatuses(db *sql.DB, dialect sqlDialect) ([]migrationStatus, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i].migration = m
+		if at, ok := applied[m.Version]; ok {
+			statuses[i].AppliedAt = &at
+			delete(applied, m.Version)
+		}
+	}
+	if len(applied) > 0 {
+		versions := make([]int, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Ints(versions)
+		return statuses, fmt.Errorf("database has migrations %v unknown to this version, it was migrated by a newer version", versions)
+	}
+	return statuses, nil
+}
+
+// Run a migration script and record the change of version in one transaction
+func runMigration(db *sql.DB, script, record string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if strings.TrimSpace(script) != "" {
+		if _, err := tx.Exec(script); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return fmt.Errorf("error updating schema_version: %v", err)
+	}
+	return tx.Commit()
+}
+
+// Apply the pending migrations in order, and return the migrations applied
+func migrateUp(db *sql.DB, dialect sqlDialect) ([]migration, error) {
+	statuses, err := migrationStatuses(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []migration
+	for _, s := range statuses {
+		if s.AppliedAt != nil {
+			continue
+		}
+		err := runMigration(db, s.Up, dialect.rebind("INSERT INTO schema_version(version, name, applied_at) VALUES(?, ?, ?)"),
+			s.Version, s.Name, time.Now().UTC())
+		if err != nil {
+			// Another replica sharing the database may have applied it at the same time
+			if versions, _ := appliedMigrations(db, dialect); !versions[s.Version].IsZero() {
+				continue
+			}
+			return applied, fmt.Errorf("error applying migration %04d_%s: %v", s.Version, s.Name, err)
+		}
+		log.Infof("Applied %s database migration %04d_%s", dialect.name(), s.Version, s.Name)
+		applied = append(applied, s.migration)
+	}
+	return applied, nil
+}
+
+// Roll back the applied migrations newer than the target version, newest
+// first, and return the migrations rolled back. Migrations whose rollback
+// destroys data that must be kept are only rolled back when forced.
+func migrateDown(db *sql.DB, dialect sqlDialect, target int, force bool) ([]migration, error) {
+	statuses, err := migrationStatuses(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check every migration first, so nothing is rolled back when one can't be
+	var pending []migration
+	for i := len(statuses) - 1; i >= 0; i-- {
+		s := statuses[i]
+		if s.AppliedAt == nil || s.Version <= target {
+			continue
+		}
+		if s.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s can't be rolled back", s.Version, s.Name)
+		}
+		if s.Force != "" && !force {
+			return nil, fmt.Errorf("migration %04d_%s is only rolled back with -force, as %s", s.Version, s.Name, s.Force)
+		}
+		pending = append(pending, s.migration)
+	}
+
+	var reverted []migration
+	for _, m := range pending {
+		if err := runMigration(db, m.Down, dialect.rebind("DELETE FROM schema_version WHERE version = ?"), m.Version); err != nil {
+			return reverted, fmt.Errorf("error rolling back migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		log.Infof("Rolled back %s database migration %04d_%s", dialect.name(), m.Version, m.Name)
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// Return the version of the newest applied migration, or 0
+func schemaVersion(statuses []migrationStatus) int {
+	version := 0
+	for _, s := range statuses {
+		if s.AppliedAt != nil {
+			version = s.Version
+		}
+	}
+	return version
+}
@@ -0,0 +1,107 @@
+// app/migrate_test.go
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Return whether a table exists in a SQLite database
+func tableExists(t *testing.T, db *sql.DB, name string) bool {
+	t.Helper()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dialect := &sqliteDialect{}
+
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrateUp(db, dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations))
+	}
+	for _, table := range []string{"submissions", "users", "audit_log", "rate_limits"} {
+		if !tableExists(t, db, table) {
+			t.Errorf("table %s missing after migrating up", table)
+		}
+	}
+	if applied, err := migrateUp(db, dialect); err != nil || len(applied) != 0 {
+		t.Fatalf("migrating an up to date database applied %d migrations: %v", len(applied), err)
+	}
+
+	// Rolling back the audit log needs -force, and nothing is rolled back without it
+	if _, err := migrateDown(db, dialect, 0, false); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Fatalf("rolling back the audit log without -force: err = %v", err)
+	}
+	if !tableExists(t, db, "audit_log") || !tableExists(t, db, "rate_limits") {
+		t.Fatal("a failed rollback dropped tables")
+	}
+
+	reverted, err := migrateDown(db, dialect, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(migrations)-1 || tableExists(t, db, "audit_log") || !tableExists(t, db, "rate_limits") {
+		t.Fatalf("rolling back to version 1 reverted %d migrations", len(reverted))
+	}
+
+	if _, err := migrateDown(db, dialect, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := migrationStatuses(db, dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := schemaVersion(statuses); version != 0 || tableExists(t, db, "audit_log") || tableExists(t, db, "users") {
+		t.Fatalf("schema version %d after rolling back everything", version)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Tables as created by versions before migrations and roles
+	for _, statement := range []string{
+		`CREATE TABLE submissions (id INTEGER PRIMARY KEY AUTOINCREMENT, form_id TEXT, name TEXT, email TEXT, message TEXT, file TEXT, read TEXT DEFAULT 'N', created_at DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO submissions(form_id, name) VALUES('contact', 'Alice')`,
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, username TEXT NOT NULL UNIQUE, password_hash TEXT NOT NULL, must_reset INTEGER NOT NULL DEFAULT 0, created_at DATETIME NOT NULL, updated_at DATETIME NOT NULL)`,
+		`INSERT INTO users(username, password_hash, created_at, updated_at) VALUES('admin', '', '2024-01-01', '2024-01-01')`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := migrateUp(db, &sqliteDialect{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var name, hash string
+	if err := db.QueryRow("SELECT name, name_hash FROM submissions").Scan(&name, &hash); err != nil || name != "Alice" {
+		t.Errorf("submission after adopting the database: %q, %v", name, err)
+	}
+	var role string
+	if err := db.QueryRow("SELECT role FROM form_grants WHERE user_id = 1 AND form_id = '*'").Scan(&role); err != nil || role != roleOwner {
+		t.Errorf("role of the existing user on all forms: %q, %v", role, err)
+	}
+}
@@ -0,0 +1,19 @@
+-- Drops every table, and all the data with them
+DROP TABLE IF EXISTS submissions_fts;
+DROP TABLE IF EXISTS rate_limits;
+DROP TABLE IF EXISTS login_lockouts;
+DROP TABLE IF EXISTS api_token_scopes;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS user_identities;
+DROP TABLE IF EXISTS settings;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS totp_credentials;
+DROP TABLE IF EXISTS form_grants;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS rate_limit_overrides;
+DROP TABLE IF EXISTS bans;
+DROP TABLE IF EXISTS rate_limit_violations;
+DROP TABLE IF EXISTS blocked_requests;
+DROP TABLE IF EXISTS ip_rules;
+DROP TABLE IF EXISTS submissions;
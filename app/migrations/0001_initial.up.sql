@@ -0,0 +1,185 @@
+-- Schema of the database before migrations were introduced. Tables are created
+-- only when missing, so databases created by earlier versions are adopted.
+
+CREATE TABLE IF NOT EXISTS submissions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    form_id TEXT,
+    name TEXT,
+    email TEXT,
+    message TEXT,
+    file TEXT,
+    read TEXT DEFAULT 'N',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    spam INTEGER NOT NULL DEFAULT 0,
+    starred INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'new',
+    tags TEXT NOT NULL DEFAULT '[]',
+    deleted_at DATETIME,
+    anonymized_at DATETIME,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    referer TEXT NOT NULL DEFAULT '',
+    origin TEXT NOT NULL DEFAULT '',
+    accept_language TEXT NOT NULL DEFAULT '',
+    config_version TEXT NOT NULL DEFAULT '',
+    processing_ms REAL NOT NULL DEFAULT 0,
+    name_hash TEXT NOT NULL DEFAULT '',
+    email_hash TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_submissions_created_at ON submissions(created_at, id);
+CREATE INDEX IF NOT EXISTS idx_submissions_form_id ON submissions(form_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_submissions_deleted_at ON submissions(deleted_at);
+CREATE INDEX IF NOT EXISTS idx_submissions_name_hash ON submissions(name_hash);
+CREATE INDEX IF NOT EXISTS idx_submissions_email_hash ON submissions(email_hash);
+
+CREATE TABLE IF NOT EXISTS ip_rules (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    form_id TEXT NOT NULL DEFAULT '',
+    cidr TEXT NOT NULL,
+    action TEXT NOT NULL,
+    note TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS blocked_requests (
+    ip TEXT NOT NULL,
+    form_id TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL,
+    count INTEGER NOT NULL DEFAULT 0,
+    last_blocked_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (ip, form_id, reason)
+);
+
+CREATE TABLE IF NOT EXISTS rate_limit_violations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip TEXT NOT NULL,
+    form_id TEXT NOT NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bans (
+    ip TEXT PRIMARY KEY,
+    level INTEGER NOT NULL,
+    reason TEXT NOT NULL,
+    banned_until DATETIME NOT NULL,
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rate_limit_overrides (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip TEXT NOT NULL,
+    form_id TEXT NOT NULL DEFAULT '',
+    requests INTEGER NOT NULL,
+    duration TEXT NOT NULL,
+    algorithm TEXT NOT NULL DEFAULT '',
+    burst INTEGER NOT NULL DEFAULT 0,
+    note TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL UNIQUE,
+    password_hash TEXT NOT NULL,
+    must_reset INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS form_grants (
+    user_id INTEGER NOT NULL,
+    form_id TEXT NOT NULL,
+    role TEXT NOT NULL,
+    PRIMARY KEY (user_id, form_id)
+);
+
+CREATE TABLE IF NOT EXISTS totp_credentials (
+    user_id INTEGER PRIMARY KEY,
+    secret TEXT NOT NULL,
+    enabled INTEGER NOT NULL DEFAULT 0,
+    last_step INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    user_id INTEGER NOT NULL,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    user_id INTEGER,
+    data BLOB NOT NULL,
+    ip TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    prefix TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    last_used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS api_token_scopes (
+    token_id INTEGER NOT NULL,
+    form_id TEXT NOT NULL,
+    role TEXT NOT NULL,
+    PRIMARY KEY (token_id, form_id)
+);
+
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    kind TEXT NOT NULL,
+    key TEXT NOT NULL,
+    failures INTEGER NOT NULL,
+    level INTEGER NOT NULL DEFAULT 0,
+    locked INTEGER NOT NULL DEFAULT 0,
+    blocked_until DATETIME NOT NULL,
+    locked_until DATETIME,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (kind, key)
+);
+
+CREATE TABLE IF NOT EXISTS rate_limits (
+    form_id TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    state TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    PRIMARY KEY (form_id, ip)
+);
+
+-- Users created before roles were introduced become owners of all forms, so
+-- they keep their access. This only runs once: users left without grants
+-- afterwards, by revoking them or creating users without forms, get no access.
+INSERT INTO form_grants(user_id, form_id, role)
+SELECT id, '*', 'owner' FROM users
+WHERE NOT EXISTS (SELECT 1 FROM form_grants);
@@ -0,0 +1,2 @@
+-- force: rolling back deletes the append-only audit log
+DROP TABLE IF EXISTS audit_log;
@@ -0,0 +1,34 @@
+-- Submissions stored in MySQL or MariaDB, with the columns of the SQLite table.
+-- TEXT columns can't have defaults, so they are always given on insert.
+
+CREATE TABLE IF NOT EXISTS submissions (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    form_id VARCHAR(255) NOT NULL,
+    name TEXT NOT NULL,
+    email TEXT NOT NULL,
+    message TEXT NOT NULL,
+    file VARCHAR(255) NOT NULL DEFAULT '',
+    `read` CHAR(1) NOT NULL DEFAULT 'N',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    spam BOOLEAN NOT NULL DEFAULT FALSE,
+    starred BOOLEAN NOT NULL DEFAULT FALSE,
+    status VARCHAR(20) NOT NULL DEFAULT 'new',
+    tags TEXT NOT NULL,
+    deleted_at DATETIME NULL,
+    anonymized_at DATETIME NULL,
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL,
+    referer TEXT NOT NULL,
+    origin TEXT NOT NULL,
+    accept_language TEXT NOT NULL,
+    config_version VARCHAR(255) NOT NULL DEFAULT '',
+    processing_ms DOUBLE NOT NULL DEFAULT 0,
+    name_hash CHAR(64) NOT NULL DEFAULT '',
+    email_hash CHAR(64) NOT NULL DEFAULT '',
+    INDEX idx_submissions_created_at (created_at, id),
+    INDEX idx_submissions_form_id (form_id, created_at, id),
+    INDEX idx_submissions_deleted_at (deleted_at),
+    INDEX idx_submissions_file (file),
+    INDEX idx_submissions_name_hash (name_hash),
+    INDEX idx_submissions_email_hash (email_hash)
+) DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,34 @@
+-- Submissions stored in PostgreSQL, with the columns of the SQLite table
+
+CREATE TABLE IF NOT EXISTS submissions (
+    id BIGSERIAL PRIMARY KEY,
+    form_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    email TEXT NOT NULL DEFAULT '',
+    message TEXT NOT NULL DEFAULT '',
+    file TEXT NOT NULL DEFAULT '',
+    read TEXT NOT NULL DEFAULT 'N',
+    created_at TIMESTAMP(0) NOT NULL DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'UTC'),
+    spam BOOLEAN NOT NULL DEFAULT FALSE,
+    starred BOOLEAN NOT NULL DEFAULT FALSE,
+    status TEXT NOT NULL DEFAULT 'new',
+    tags TEXT NOT NULL DEFAULT '[]',
+    deleted_at TIMESTAMP,
+    anonymized_at TIMESTAMP,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    referer TEXT NOT NULL DEFAULT '',
+    origin TEXT NOT NULL DEFAULT '',
+    accept_language TEXT NOT NULL DEFAULT '',
+    config_version TEXT NOT NULL DEFAULT '',
+    processing_ms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    name_hash TEXT NOT NULL DEFAULT '',
+    email_hash TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_submissions_created_at ON submissions(created_at, id);
+CREATE INDEX IF NOT EXISTS idx_submissions_form_id ON submissions(form_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_submissions_deleted_at ON submissions(deleted_at);
+CREATE INDEX IF NOT EXISTS idx_submissions_file ON submissions(file);
+CREATE INDEX IF NOT EXISTS idx_submissions_name_hash ON submissions(name_hash);
+CREATE INDEX IF NOT EXISTS idx_submissions_email_hash ON submissions(email_hash);
@@ -2,57 +2,23 @@
 package main
 
 import (
-	"net/http"
-
 	_ "github.com/mattn/go-sqlite3" // Ensure the SQLite3 driver is imported
 )
 
-// Initialize the database and create the submissions table if it doesn't exist
+// Initialize the database, apply its pending migrations and open the store of the submissions
 func initDatabase() {
 	db, err := getDB()
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS submissions (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        form_id TEXT,
-        name TEXT,
-        email TEXT,
-        message TEXT,
-        file TEXT,
-        read TEXT DEFAULT 'N',
-        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-    )`)
-	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
-	}
-}
-
-// Handle the deletion of a submission by ID
-func handleDeleteSubmission(w http.ResponseWriter, r *http.Request, id string) {
-	db, err := getDB()
-	if err != nil {
-		log.Errorf("Error opening database: %v", err)
-		http.Error(w, "Could not connect to the database", http.StatusInternalServerError)
-		return
-	}
-
-	stmt, err := db.Prepare("DELETE FROM submissions WHERE id = ?")
-	if err != nil {
-		log.Errorf("Error preparing delete statement: %v", err)
-		http.Error(w, "Could not prepare delete statement", http.StatusInternalServerError)
-		return
+	// Bring the schema up to date before anything uses it
+	if _, err := migrateUp(db, &sqliteDialect{}); err != nil {
+		log.Fatalf("Error migrating database: %v", err)
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(id)
-	if err != nil {
-		log.Errorf("Error executing delete statement: %v", err)
-		http.Error(w, "Could not delete submission", http.StatusInternalServerError)
-		return
+	// The submissions are stored in this database unless a shared one is configured
+	if submissionStore, err = newSubmissionStoreFromEnv(); err != nil {
+		log.Fatalf("Error initializing the submissions database: %v", err)
 	}
-
-	w.WriteHeader(http.StatusNoContent)
-	log.Infof("Submission with ID %s deleted", id)
 }
@@ -0,0 +1,391 @@
+// app/oidc.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Name of the session holding the state of a single sign-on login in progress
+	oidcSessionName = "oidc-login"
+	// Time a user has to complete a login at the identity provider
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// Errors returned when a single sign-on login is rejected
+var (
+	errOIDCDomain  = errors.New("email domain is not allowed")
+	errOIDCNoRoles = errors.New("none of the groups is mapped to a role")
+)
+
+// oidcLogin signs admins in with an OpenID Connect identity provider using the
+// authorization code flow with PKCE
+type oidcLogin struct {
+	config       OIDC
+	clientSecret string
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// Global single sign-on client, nil when single sign-on is not configured
+var oidcClient *oidcLogin
+
+// Create the single sign-on client from the configuration, returning nil when no issuer is set.
+// The client secret is read from OIDC_CLIENT_SECRET and may be empty for public clients.
+func newOIDCLogin(config OIDC) (*oidcLogin, error) {
+	if config.Issuer == "" {
+		return nil, nil
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc client_id and redirect_url are required")
+	}
+	for group, grants := range config.GroupRoles {
+		for formID, role := range grants {
+			if formID == "" || !validRole(role) {
+				return nil, fmt.Errorf("invalid role %q on form %q for group %q", role, formID, group)
+			}
+		}
+	}
+	if config.Name == "" {
+		config.Name = "Single Sign-On"
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return &oidcLogin{config: config, clientSecret: os.Getenv("OIDC_CLIENT_SECRET")}, nil
+}
+
+// Return the provider, fetching its discovery document on first use so that an
+// unreachable identity provider does not prevent the application from starting
+func (o *oidcLogin) getProvider(ctx context.Context) (*oidc.Provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider == nil {
+		provider, err := oidc.NewProvider(ctx, o.config.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching provider configuration: %v", err)
+		}
+		o.provider = provider
+	}
+	return o.provider, nil
+}
+
+// Return the OAuth2 configuration of the client
+func (o *oidcLogin) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     o.config.ClientID,
+		ClientSecret: o.clientSecret,
+		RedirectURL:  o.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       o.config.Scopes,
+	}
+}
+
+// Check the email domain against the allowlist, allowing any domain when it is empty
+func (o *oidcLogin) domainAllowed(email string) bool {
+	if len(o.config.AllowedDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range o.config.AllowedDomains {
+		if strings.EqualFold(domain, strings.TrimPrefix(allowed, "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Map the groups of a user to grants, keeping the highest role per form
+func (o *oidcLogin) grantsFor(groups []string) map[string]string {
+	grants := map[string]string{}
+	for _, group := range groups {
+		for formID, role := range o.config.GroupRoles[group] {
+			if roleLevels[role] > roleLevels[grants[formID]] {
+				grants[formID] = role
+			}
+		}
+	}
+	return grants
+}
+
+// Read the email_verified claim, which some identity providers send as a string,
+// and whether the token has it
+func emailVerifiedClaim(claims map[string]interface{}) (verified, asserted bool) {
+	switch value := claims["email_verified"].(type) {
+	case bool:
+		return value, true
+	case string:
+		return strings.EqualFold(value, "true"), true
+	}
+	return false, false
+}
+
+// Read the groups claim, which identity providers send as a list or a single string
+func groupsFromClaims(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		groups := []string{}
+		for _, group := range value {
+			if s, ok := group.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// Find the user linked to an identity, creating it on the first login, and
+// replace its grants with the ones mapped from the groups
+func provisionOIDCUser(issuer, subject, email string, grants map[string]string) (*user, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+
+	var u *user
+	var userID int64
+	err = db.QueryRow("SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&userID)
+	switch {
+	case err == sql.ErrNoRows:
+		// Users created by single sign-on have no password and cannot log in with the login form
+		u, err = createUserWithHash(email, "", false)
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec("INSERT INTO user_identities(user_id, issuer, subject, created_at) VALUES(?, ?, ?, ?)",
+			u.ID, issuer, subject, time.Now().UTC())
+		if err != nil {
+			return nil, fmt.Errorf("error linking identity: %v", err)
+		}
+		log.Infof("Created user %s from single sign-on", u.Username)
+	case err != nil:
+		return nil, fmt.Errorf("error querying identity: %v", err)
+	default:
+		if u, err = getUserByID(userID); err != nil {
+			return nil, fmt.Errorf("error loading user %d: %v", userID, err)
+		}
+	}
+
+	if err := setGrants(u.ID, grants); err != nil {
+		return nil, err
+	}
+	return getUserByID(u.ID)
+}
+
+// Return the cookie options of the login state. The cookie must be sent when the
+// identity provider redirects back, which is a cross-site navigation.
+func oidcSessionOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		MaxAge:   maxAge,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Return a random URL-safe string for the state and nonce parameters
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Handler to start a single sign-on login by redirecting to the identity provider
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcClient == nil {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := oidcClient.getProvider(r.Context())
+	if err != nil {
+		log.Errorf("Error starting single sign-on: %v", err)
+		http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		log.Errorf("Error generating state: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		log.Errorf("Error generating nonce: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	session, _ := store.Get(r, oidcSessionName)
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["verifier"] = verifier
+	session.Options = oidcSessionOptions(int(oidcLoginTimeout.Seconds()))
+	if err := session.Save(r, w); err != nil {
+		log.Errorf("Error saving session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	url := oidcClient.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Handler for the identity provider redirecting back after a single sign-on login
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcClient == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	loginSession, _ := store.Get(r, oidcSessionName)
+	state, _ := loginSession.Values["state"].(string)
+	nonce, _ := loginSession.Values["nonce"].(string)
+	verifier, _ := loginSession.Values["verifier"].(string)
+
+	// The login state can only be used once
+	loginSession.Options = oidcSessionOptions(-1)
+	if err := loginSession.Save(r, w); err != nil {
+		log.Errorf("Error saving session: %v", err)
+	}
+
+	if state == "" || r.URL.Query().Get("state") != state {
+		log.Warn("Single sign-on callback with an invalid state")
+		http.Error(w, "Invalid or expired login, please try again", http.StatusBadRequest)
+		return
+	}
+	if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+		log.Warnf("Identity provider returned an error: %s %s", errorCode, r.URL.Query().Get("error_description"))
+		http.Error(w, "Login was not completed at the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := oidcClient.getProvider(r.Context())
+	if err != nil {
+		log.Errorf("Error completing single sign-on: %v", err)
+		http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+		return
+	}
+	token, err := oidcClient.oauth2Config(provider).Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Errorf("Error exchanging authorization code: %v", err)
+		http.Error(w, "Could not complete the login", http.StatusUnauthorized)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Error("Token response without an ID token")
+		http.Error(w, "Could not complete the login", http.StatusUnauthorized)
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oidcClient.config.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		log.Errorf("Error verifying ID token: %v", err)
+		http.Error(w, "Could not complete the login", http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != nonce {
+		log.Warn("ID token with an invalid nonce")
+		http.Error(w, "Could not complete the login", http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		log.Errorf("Error reading ID token claims: %v", err)
+		http.Error(w, "Could not complete the login", http.StatusUnauthorized)
+		return
+	}
+	email, _ := claims["email"].(string)
+	email = strings.ToLower(strings.TrimSpace(email))
+	// Without an allowlist an unasserted email is accepted, but the domain of an
+	// email the identity provider didn't verify can't be trusted
+	verified, asserted := emailVerifiedClaim(claims)
+	if email == "" || (asserted && !verified) || (len(oidcClient.config.AllowedDomains) > 0 && !verified) {
+		recordAuditAs(r, email, "user.login_failed", "sso: missing or unverified email")
+		http.Error(w, "Your account has no verified email address", http.StatusForbidden)
+		return
+	}
+	if !oidcClient.domainAllowed(email) {
+		recordAuditAs(r, email, "user.login_failed", "sso: "+errOIDCDomain.Error())
+		http.Error(w, "Your email domain is not allowed to access the admin panel", http.StatusForbidden)
+		return
+	}
+	grants := oidcClient.grantsFor(groupsFromClaims(claims, oidcClient.config.GroupsClaim))
+	if len(grants) == 0 {
+		recordAuditAs(r, email, "user.login_failed", "sso: "+errOIDCNoRoles.Error())
+		http.Error(w, "Your account has no role in the admin panel", http.StatusForbidden)
+		return
+	}
+
+	u, err := provisionOIDCUser(idToken.Issuer, idToken.Subject, email, grants)
+	if err == errUsernameTaken {
+		recordAuditAs(r, email, "user.login_failed", "sso: username taken by a local user")
+		http.Error(w, "A user with this username already exists and is not linked to single sign-on", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error provisioning single sign-on user: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := store.Get(r, "session-name")
+	if err := startSession(w, r, session, u); err != nil {
+		log.Errorf("Error saving session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordAuditAs(r, u.Username, "user.login", u.Username+" (sso)")
+
+	// Browsers do not send the SameSite=Strict session cookie on a redirect that
+	// started at the identity provider, so continue with a same-site navigation
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=/submissions"></head><body><a href="/submissions">Continue</a></body></html>`)
+}
+
+// API handler returning the login methods shown on the login page
+func loginOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	options := map[string]interface{}{"password": true}
+	if oidcClient != nil {
+		options["sso"] = oidcClient.config.Name
+		options["password"] = !oidcClient.config.DisablePasswordLogin
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+// Check whether the login form is disabled in favour of single sign-on
+func passwordLoginDisabled() bool {
+	return oidcClient != nil && oidcClient.config.DisablePasswordLogin
+}
@@ -0,0 +1,224 @@
+// app/overrides.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+var rateLimitOverrides *rateLimitOverrideSet
+
+// rateLimitOverride replaces the rate limit for an IP address or CIDR range.
+// Overrides with an empty form ID apply to all forms.
+type rateLimitOverride struct {
+	ID        int64     `json:"id"`
+	IP        string    `json:"ip"`
+	FormID    string    `json:"form_id"`
+	RateLimit RateLimit `json:"rate_limit"`
+	Note      string    `json:"note"`
+	CreatedAt string    `json:"created_at,omitempty"`
+	network   *net.IPNet
+}
+
+// rateLimitOverrideSet caches the overrides stored in the database
+type rateLimitOverrideSet struct {
+	overrides []rateLimitOverride
+	mu        sync.RWMutex
+}
+
+// Initialize the rate limit overrides from the database
+func newRateLimitOverrideSet() (*rateLimitOverrideSet, error) {
+	o := &rateLimitOverrideSet{}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Reload the overrides from the database
+func (o *rateLimitOverrideSet) reload() error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	rows, err := db.Query("SELECT id, ip, form_id, requests, duration, algorithm, burst, note, created_at FROM rate_limit_overrides ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying rate limit overrides: %v", err)
+	}
+	defer rows.Close()
+
+	var overrides []rateLimitOverride
+	for rows.Next() {
+		var override rateLimitOverride
+		err := rows.Scan(&override.ID, &override.IP, &override.FormID, &override.RateLimit.Requests, &override.RateLimit.Duration,
+			&override.RateLimit.Algorithm, &override.RateLimit.Burst, &override.Note, &override.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("error scanning rate limit override: %v", err)
+		}
+		if override.network, err = parseNetwork(override.IP); err != nil {
+			log.Warnf("Skipping invalid rate limit override %d: %v", override.ID, err)
+			continue
+		}
+		overrides = append(overrides, override)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rate limit overrides: %v", err)
+	}
+
+	o.mu.Lock()
+	o.overrides = overrides
+	o.mu.Unlock()
+	return nil
+}
+
+// Return a copy of the current overrides
+func (o *rateLimitOverrideSet) list() []rateLimitOverride {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return append([]rateLimitOverride{}, o.overrides...)
+}
+
+// Find the most specific override for an IP address on a form. Form-specific
+// overrides win over global ones, then narrower ranges win over wider ones.
+func (o *rateLimitOverrideSet) lookup(formID, ip string) (rateLimitOverride, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return rateLimitOverride{}, false
+	}
+
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	var best *rateLimitOverride
+	bestScore := -1
+	for i, override := range o.overrides {
+		if override.FormID != "" && override.FormID != formID {
+			continue
+		}
+		if !override.network.Contains(parsed) {
+			continue
+		}
+		score, _ := override.network.Mask.Size()
+		if override.FormID != "" {
+			score += 1000
+		}
+		if score > bestScore {
+			best, bestScore = &o.overrides[i], score
+		}
+	}
+	if best == nil {
+		return rateLimitOverride{}, false
+	}
+	return *best, true
+}
+
+// API handler to fetch the rate limit overrides
+func apiRateLimitOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	overrides := []rateLimitOverride{}
+	for _, override := range rateLimitOverrides.list() {
+		if override.FormID == "" || u.can(roleViewer, override.FormID) {
+			overrides = append(overrides, override)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overrides)
+}
+
+// API handler to add a rate limit override
+func createRateLimitOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	var override rateLimitOverride
+	if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	override.IP = strings.TrimSpace(override.IP)
+	if _, err := parseNetwork(override.IP); err != nil {
+		jsonError(w, "Invalid IP address or CIDR range", http.StatusBadRequest)
+		return
+	}
+	if _, err := override.RateLimit.window(); err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeScope(w, r, roleEditor, override.FormID) {
+		return
+	}
+
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		jsonError(w, "Could not connect to the database", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec("INSERT INTO rate_limit_overrides(ip, form_id, requests, duration, algorithm, burst, note) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		override.IP, override.FormID, override.RateLimit.Requests, override.RateLimit.Duration,
+		override.RateLimit.Algorithm, override.RateLimit.Burst, override.Note)
+	if err != nil {
+		log.Errorf("Error inserting rate limit override: %v", err)
+		jsonError(w, "Could not save rate limit override", http.StatusInternalServerError)
+		return
+	}
+
+	if err := rateLimitOverrides.reload(); err != nil {
+		log.Errorf("Error reloading rate limit overrides: %v", err)
+		jsonError(w, "Could not reload rate limit overrides", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	recordAudit(r, "rate_limit_override.create", fmt.Sprintf("%s on form %q: %d per %s", override.IP, override.FormID,
+		override.RateLimit.Requests, override.RateLimit.Duration))
+}
+
+// API handler to delete a rate limit override by ID
+func deleteRateLimitOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	db, err := getDB()
+	if err != nil {
+		log.Errorf("Error opening database: %v", err)
+		jsonError(w, "Could not connect to the database", http.StatusInternalServerError)
+		return
+	}
+
+	var formID string
+	err = db.QueryRow("SELECT form_id FROM rate_limit_overrides WHERE id = ?", id).Scan(&formID)
+	if err == sql.ErrNoRows {
+		jsonError(w, "Rate limit override not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error querying rate limit override: %v", err)
+		jsonError(w, "Could not query the database", http.StatusInternalServerError)
+		return
+	}
+	if !authorizeScope(w, r, roleEditor, formID) {
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM rate_limit_overrides WHERE id = ?", id); err != nil {
+		log.Errorf("Error deleting rate limit override: %v", err)
+		jsonError(w, "Could not delete rate limit override", http.StatusInternalServerError)
+		return
+	}
+
+	if err := rateLimitOverrides.reload(); err != nil {
+		log.Errorf("Error reloading rate limit overrides: %v", err)
+		jsonError(w, "Could not reload rate limit overrides", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	recordAudit(r, "rate_limit_override.delete", id)
+}
@@ -0,0 +1,46 @@
+// app/overrides_test.go
+package main
+
+import (
+	"testing"
+)
+
+func TestRateLimitOverrideLookup(t *testing.T) {
+	testDB := useTestDB(t)
+	_, err := testDB.Exec(`INSERT INTO rate_limit_overrides(ip, form_id, requests, duration, note) VALUES
+        ('203.0.113.0/24', '', 10, '1m', 'office'),
+        ('203.0.113.7', '', 20, '1m', 'build server'),
+        ('203.0.0.0/16', 'contact', 30, '1m', 'contact form'),
+        ('2001:db8::/32', '', 40, '1m', 'ipv6'),
+        ('not an ip', '', 50, '1m', 'skipped')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := newRateLimitOverrideSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(overrides.list()); n != 4 {
+		t.Errorf("loaded %d overrides, want the 4 valid ones", n)
+	}
+
+	tests := []struct {
+		name, formID, ip string
+		wantRequests     int
+	}{
+		{"range for all forms", "support", "203.0.113.1", 10},
+		{"narrower range wins", "support", "203.0.113.7", 20},
+		{"form override wins over a narrower global one", "contact", "203.0.113.7", 30},
+		{"form override outside the global ranges", "contact", "203.0.1.1", 30},
+		{"form override of another form", "support", "203.0.1.1", 0},
+		{"IPv6", "support", "2001:db8::1", 40},
+		{"no override", "contact", "198.51.100.1", 0},
+		{"invalid address", "contact", "unknown", 0},
+	}
+	for _, tt := range tests {
+		override, found := overrides.lookup(tt.formID, tt.ip)
+		if found != (tt.wantRequests > 0) || override.RateLimit.Requests != tt.wantRequests {
+			t.Errorf("%s: %s on form %q found %t with %d requests, want %d", tt.name, tt.ip, tt.formID, found, override.RateLimit.Requests, tt.wantRequests)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// app/ratelimit.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Supported rate limiting algorithms
+const (
+	rateLimitSlidingWindow = "sliding_window"
+	rateLimitTokenBucket   = "token_bucket"
+)
+
+// RateLimiter checks requests against the rate limits and keeps track of the visitors
+type RateLimiter interface {
+	// Allow checks and records a request of an IP address against the rate limit of a form
+	Allow(formID, ip, userAgent string, limit RateLimit, window time.Duration) (rateLimitResult, error)
+	// States returns the state of every visitor seen within the history period
+	States() ([]rateLimitState, error)
+	// Clear removes the rate limit state of an IP address on a form, or on all forms if formID is empty
+	Clear(ip, formID string) error
+}
+
+// rateLimitResult describes the outcome of a rate limit check
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Time
+	RetryAfter time.Duration
+}
+
+// How long the state of a visitor is kept for the admin view after its last request
+const rateLimitHistory = 24 * time.Hour
+
+// rateLimitState is the rate limit state of one IP address on one form
+type rateLimitState struct {
+	FormID        string      `json:"form_id"`
+	IP            string      `json:"ip"`
+	LastSeen      time.Time   `json:"last_seen"`
+	LastUserAgent string      `json:"last_user_agent"`
+	Accepted      int         `json:"accepted"`
+	Rejected      int         `json:"rejected"`
+	ResetAt       time.Time   `json:"reset_at"`
+	ExpiresAt     time.Time   `json:"expires_at"`
+	Timestamps    []time.Time `json:"timestamps"`
+	Tokens        float64     `json:"tokens"`
+	LastRefill    time.Time   `json:"last_refill"`
+}
+
+// Create the rate limiter selected by the RATE_LIMIT_BACKEND environment variable
+func newRateLimiterFromEnv() (RateLimiter, error) {
+	switch backend := os.Getenv("RATE_LIMIT_BACKEND"); backend {
+	case "", "memory":
+		return newMemoryRateLimiter(), nil
+	case "sqlite":
+		db, err := getDB()
+		if err != nil {
+			return nil, fmt.Errorf("error opening database: %v", err)
+		}
+		return newSQLiteRateLimiter(db)
+	case "redis":
+		return newRedisRateLimiter(os.Getenv("REDIS_URL"))
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend: %s", backend)
+	}
+}
+
+// Apply a request made at now to the state and return the outcome
+func (s *rateLimitState) apply(now time.Time, userAgent string, limit RateLimit, window time.Duration) rateLimitResult {
+	s.LastSeen = now
+	s.LastUserAgent = userAgent
+
+	var result rateLimitResult
+	if limit.Algorithm == rateLimitTokenBucket {
+		result = s.takeToken(now, limit, window)
+	} else {
+		result = s.slideWindow(now, limit, window)
+	}
+
+	s.ResetAt = result.Reset
+	if result.Allowed {
+		s.Accepted++
+	} else {
+		s.Rejected++
+	}
+	return result
+}
+
+// Return the time until which the state is kept. The state stops affecting
+// requests at ExpiresAt but is kept longer for the admin view.
+func (s *rateLimitState) retainUntil() time.Time {
+	retain := s.LastSeen.Add(rateLimitHistory)
+	if s.ExpiresAt.After(retain) {
+		return s.ExpiresAt
+	}
+	return retain
+}
+
+// Drop the timestamps that fall outside the window
+func (s *rateLimitState) pruneTimestamps(now time.Time, window time.Duration) {
+	cutoff := now.Add(-window)
+	kept := s.Timestamps[:0]
+	for _, ts := range s.Timestamps {
+		if ts.After(cutoff) {
+			kept = append(kept, ts)
+		}
+	}
+	s.Timestamps = kept
+}
+
+// Sliding log: allow the request if fewer than the limit were made within the window
+func (s *rateLimitState) slideWindow(now time.Time, limit RateLimit, window time.Duration) rateLimitResult {
+	s.pruneTimestamps(now, window)
+
+	result := rateLimitResult{Limit: limit.Requests}
+	if len(s.Timestamps) >= limit.Requests {
+		result.Reset = now.Add(window)
+		if len(s.Timestamps) > 0 {
+			result.Reset = s.Timestamps[0].Add(window)
+		}
+		result.RetryAfter = result.Reset.Sub(now)
+		s.ExpiresAt = result.Reset
+		return result
+	}
+
+	s.Timestamps = append(s.Timestamps, now)
+	s.ExpiresAt = now.Add(window)
+	result.Allowed = true
+	result.Remaining = limit.Requests - len(s.Timestamps)
+	result.Reset = s.Timestamps[0].Add(window)
+	return result
+}
+
+// Token bucket: the bucket holds up to burst tokens and refills at requests per window
+func (s *rateLimitState) takeToken(now time.Time, limit RateLimit, window time.Duration) rateLimitResult {
+	capacity := float64(limit.burst())
+	rate := float64(limit.Requests) / window.Seconds()
+
+	if s.LastRefill.IsZero() {
+		s.Tokens = capacity
+	} else {
+		s.Tokens = min(capacity, s.Tokens+now.Sub(s.LastRefill).Seconds()*rate)
+	}
+	s.LastRefill = now
+	s.pruneTimestamps(now, window)
+
+	result := rateLimitResult{Limit: int(capacity)}
+	if rate <= 0 {
+		result.Reset = now.Add(window)
+		result.RetryAfter = window
+		s.ExpiresAt = result.Reset
+		return result
+	}
+
+	if s.Tokens < 1 {
+		result.RetryAfter = time.Duration((1 - s.Tokens) / rate * float64(time.Second))
+		result.Reset = now.Add(result.RetryAfter)
+		s.ExpiresAt = now.Add(time.Duration((capacity - s.Tokens) / rate * float64(time.Second)))
+		return result
+	}
+
+	s.Tokens--
+	s.Timestamps = append(s.Timestamps, now)
+	result.Allowed = true
+	result.Remaining = int(s.Tokens)
+	result.Reset = now.Add(time.Duration((capacity - s.Tokens) / rate * float64(time.Second)))
+	s.ExpiresAt = result.Reset
+	return result
+}
+
+// Build the key of a visitor entry from a form ID and an IP address
+func visitorKey(formID, ip string) string {
+	return formID + "|" + ip
+}
+
+// memoryRateLimiter keeps the visitors in process memory
+type memoryRateLimiter struct {
+	visitors map[string]*visitor
+	mu       sync.Mutex
+}
+
+// visitor holds the rate limit state of one IP address on one form
+type visitor struct {
+	state rateLimitState
+	mu    sync.Mutex
+}
+
+// Initialize a new in-memory RateLimiter
+func newMemoryRateLimiter() *memoryRateLimiter {
+	rl := &memoryRateLimiter{
+		visitors: make(map[string]*visitor),
+	}
+	go rl.cleanupVisitors()
+	return rl
+}
+
+// Get or create a visitor entry for a form and IP address
+func (rl *memoryRateLimiter) getVisitor(formID, ip string) *visitor {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	key := visitorKey(formID, ip)
+	v, exists := rl.visitors[key]
+	if !exists {
+		v = &visitor{state: rateLimitState{FormID: formID, IP: ip}}
+		rl.visitors[key] = v
+	}
+	return v
+}
+
+// Periodically clean up visitors whose rate limit state has expired
+func (rl *memoryRateLimiter) cleanupVisitors() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		rl.mu.Lock()
+		for key, v := range rl.visitors {
+			v.mu.Lock()
+			expired := now.After(v.state.retainUntil())
+			v.mu.Unlock()
+			if expired {
+				delete(rl.visitors, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+func (rl *memoryRateLimiter) Allow(formID, ip, userAgent string, limit RateLimit, window time.Duration) (rateLimitResult, error) {
+	v := rl.getVisitor(formID, ip)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.state.apply(time.Now(), userAgent, limit, window), nil
+}
+
+func (rl *memoryRateLimiter) States() ([]rateLimitState, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	states := make([]rateLimitState, 0, len(rl.visitors))
+	for _, v := range rl.visitors {
+		v.mu.Lock()
+		state := v.state
+		state.Timestamps = append([]time.Time(nil), v.state.Timestamps...)
+		v.mu.Unlock()
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func (rl *memoryRateLimiter) Clear(ip, formID string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for key, v := range rl.visitors {
+		if v.state.IP == ip && (formID == "" || v.state.FormID == formID) {
+			delete(rl.visitors, key)
+		}
+	}
+	return nil
+}
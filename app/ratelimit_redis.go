@@ -0,0 +1,141 @@
+// app/ratelimit_redis.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Prefix of the keys holding rate limit state in Redis
+const redisRateLimitPrefix = "form-handler:rate-limit:"
+
+// Number of times a rate limit update is retried when another replica changes the same key
+const redisRateLimitRetries = 10
+
+// redisRateLimiter keeps the visitors in a Redis-compatible server shared between replicas
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+// Initialize a new Redis-backed RateLimiter from a redis:// URL
+func newRedisRateLimiter(redisURL string) (*redisRateLimiter, error) {
+	if redisURL == "" {
+		return nil, errors.New("REDIS_URL environment variable is not set")
+	}
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %v", err)
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("error connecting to redis: %v", err)
+	}
+	return &redisRateLimiter{client: client}, nil
+}
+
+// Build the Redis key of a visitor
+func redisRateLimitKey(formID, ip string) string {
+	return redisRateLimitPrefix + visitorKey(formID, ip)
+}
+
+func (rl *redisRateLimiter) Allow(formID, ip, userAgent string, limit RateLimit, window time.Duration) (rateLimitResult, error) {
+	ctx := context.Background()
+	key := redisRateLimitKey(formID, ip)
+
+	var result rateLimitResult
+	update := func(tx *redis.Tx) error {
+		state := rateLimitState{FormID: formID, IP: ip}
+		data, err := tx.Get(ctx, key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &state); err != nil {
+				return fmt.Errorf("error decoding rate limit state: %v", err)
+			}
+		}
+
+		now := time.Now()
+		result = state.apply(now, userAgent, limit, window)
+		encoded, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("error encoding rate limit state: %v", err)
+		}
+
+		// Redis expires the key once the state is no longer kept
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, state.retainUntil().Sub(now)+time.Second)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < redisRateLimitRetries; i++ {
+		err := rl.client.Watch(ctx, update, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return rateLimitResult{}, fmt.Errorf("error updating rate limit state: %v", err)
+		}
+		return result, nil
+	}
+	return rateLimitResult{}, errors.New("error updating rate limit state: too much contention")
+}
+
+// Load the state of every visitor stored in Redis
+func (rl *redisRateLimiter) states(ctx context.Context) ([]rateLimitState, []string, error) {
+	var states []rateLimitState
+	var keys []string
+	iter := rl.client.Scan(ctx, 0, redisRateLimitPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		data, err := rl.client.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading rate limit state: %v", err)
+		}
+		var state rateLimitState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, nil, fmt.Errorf("error decoding rate limit state: %v", err)
+		}
+		states = append(states, state)
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error scanning rate limits: %v", err)
+	}
+	return states, keys, nil
+}
+
+func (rl *redisRateLimiter) States() ([]rateLimitState, error) {
+	states, _, err := rl.states(context.Background())
+	return states, err
+}
+
+func (rl *redisRateLimiter) Clear(ip, formID string) error {
+	ctx := context.Background()
+	states, keys, err := rl.states(ctx)
+	if err != nil {
+		return err
+	}
+	for i, state := range states {
+		if state.IP != ip || (formID != "" && state.FormID != formID) {
+			continue
+		}
+		if err := rl.client.Del(ctx, keys[i]).Err(); err != nil {
+			return fmt.Errorf("error clearing rate limit: %v", err)
+		}
+	}
+	return nil
+}
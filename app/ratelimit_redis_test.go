@@ -0,0 +1,155 @@
+// app/ratelimit_redis_test.go
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// Start a local Redis server and a rate limiter using it
+func newTestRedisRateLimiter(t *testing.T) (*redisRateLimiter, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	rl, err := newRedisRateLimiter("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.client.Close() })
+	return rl, server
+}
+
+func TestNewRedisRateLimiterErrors(t *testing.T) {
+	for _, url := range []string{"", "http://localhost", "redis://127.0.0.1:1"} {
+		if _, err := newRedisRateLimiter(url); err == nil {
+			t.Errorf("newRedisRateLimiter(%q) succeeded", url)
+		}
+	}
+}
+
+func TestRedisRateLimiterAllow(t *testing.T) {
+	rl, server := newTestRedisRateLimiter(t)
+	limit := RateLimit{Requests: 2}
+
+	for i, want := range []bool{true, true, false} {
+		result, err := rl.Allow("form", "192.0.2.1", "test", limit, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != want {
+			t.Fatalf("request %d: allowed = %t, want %t", i, result.Allowed, want)
+		}
+	}
+
+	// The state is kept for the admin view, then expired by Redis
+	key := redisRateLimitKey("form", "192.0.2.1")
+	if ttl := server.TTL(key); ttl < rateLimitHistory || ttl > rateLimitHistory+2*time.Second {
+		t.Errorf("TTL of %s = %v, want about %v", key, ttl, rateLimitHistory)
+	}
+	server.FastForward(rateLimitHistory + 2*time.Second)
+	if server.Exists(key) {
+		t.Errorf("%s still exists after its TTL", key)
+	}
+	states, err := rl.States()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 0 {
+		t.Errorf("%d states after expiry, want 0", len(states))
+	}
+}
+
+func TestRedisRateLimiterConcurrentAllow(t *testing.T) {
+	rl, _ := newTestRedisRateLimiter(t)
+	limit := RateLimit{Requests: 5}
+
+	// Concurrent updates of the same key conflict and are retried, so exactly
+	// the limit is allowed whatever the interleaving
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed, failed := 0, 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := rl.Allow("form", "192.0.2.1", "test", limit, time.Minute)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			} else if result.Allowed {
+				allowed++
+			}
+		}()
+	}
+	wg.Wait()
+
+	states, err := rl.States()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("%d states, want 1", len(states))
+	}
+	if failed > 0 {
+		t.Logf("%d requests gave up after %d retries", failed, redisRateLimitRetries)
+	}
+	if want := min(5, 8-failed); allowed != want || states[0].Accepted != want || states[0].Accepted+states[0].Rejected != 8-failed {
+		t.Errorf("allowed %d, state accepted %d and rejected %d, want %d allowed of %d", allowed, states[0].Accepted, states[0].Rejected, want, 8-failed)
+	}
+}
+
+func TestRedisRateLimiterStatesAndClear(t *testing.T) {
+	rl, server := newTestRedisRateLimiter(t)
+	limit := RateLimit{Requests: 10}
+	visitors := []struct{ formID, ip string }{{"a", "192.0.2.1"}, {"b", "192.0.2.1"}, {"a", "192.0.2.2"}}
+	for _, v := range visitors {
+		if _, err := rl.Allow(v.formID, v.ip, "agent "+v.ip, limit, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keys of other applications are ignored
+	server.Set("other:key", "value")
+
+	states, err := rl.States()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != len(visitors) {
+		t.Fatalf("%d states, want %d", len(states), len(visitors))
+	}
+	for _, state := range states {
+		if state.LastUserAgent != "agent "+state.IP || len(state.Timestamps) != 1 {
+			t.Errorf("unexpected state %+v", state)
+		}
+	}
+
+	tests := []struct {
+		ip, formID string
+		remaining  []string
+	}{
+		{"192.0.2.1", "a", []string{redisRateLimitKey("b", "192.0.2.1"), redisRateLimitKey("a", "192.0.2.2")}},
+		{"192.0.2.9", "", []string{redisRateLimitKey("b", "192.0.2.1"), redisRateLimitKey("a", "192.0.2.2")}},
+		{"192.0.2.1", "", []string{redisRateLimitKey("a", "192.0.2.2")}},
+	}
+	for _, tt := range tests {
+		if err := rl.Clear(tt.ip, tt.formID); err != nil {
+			t.Fatal(err)
+		}
+		// The key of the other application remains too
+		keys := server.Keys()
+		if len(keys) != len(tt.remaining)+1 {
+			t.Fatalf("after clearing %s on %q: keys %v, want %v", tt.ip, tt.formID, keys, tt.remaining)
+		}
+		for _, key := range tt.remaining {
+			if !server.Exists(key) {
+				t.Errorf("after clearing %s on %q: %s was removed", tt.ip, tt.formID, key)
+			}
+		}
+	}
+	if !server.Exists("other:key") {
+		t.Error("clearing removed a key of another application")
+	}
+}
@@ -0,0 +1,108 @@
+// app/ratelimit_sqlite.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sqliteRateLimiter keeps the visitors in the SQLite database so they survive restarts
+type sqliteRateLimiter struct {
+	db *sql.DB
+	mu sync.Mutex
+}
+
+// Initialize a new SQLite-backed RateLimiter. Its table is created by the migrations.
+func newSQLiteRateLimiter(db *sql.DB) (*sqliteRateLimiter, error) {
+	rl := &sqliteRateLimiter{db: db}
+	go rl.cleanupVisitors()
+	return rl, nil
+}
+
+// Periodically delete visitors whose rate limit state has expired
+func (rl *sqliteRateLimiter) cleanupVisitors() {
+	for {
+		time.Sleep(time.Minute)
+		if _, err := rl.db.Exec("DELETE FROM rate_limits WHERE expires_at < ?", time.Now().UnixNano()); err != nil {
+			log.Errorf("Error cleaning up rate limits: %v", err)
+		}
+	}
+}
+
+func (rl *sqliteRateLimiter) Allow(formID, ip, userAgent string, limit RateLimit, window time.Duration) (rateLimitResult, error) {
+	// SQLite serializes writers anyway, serializing here avoids busy errors between our own requests
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	tx, err := rl.db.Begin()
+	if err != nil {
+		return rateLimitResult{}, fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	state := rateLimitState{FormID: formID, IP: ip}
+	var data string
+	err = tx.QueryRow("SELECT state FROM rate_limits WHERE form_id = ? AND ip = ?", formID, ip).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return rateLimitResult{}, fmt.Errorf("error loading rate limit state: %v", err)
+	default:
+		if err := json.Unmarshal([]byte(data), &state); err != nil {
+			return rateLimitResult{}, fmt.Errorf("error decoding rate limit state: %v", err)
+		}
+	}
+
+	result := state.apply(time.Now(), userAgent, limit, window)
+
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return rateLimitResult{}, fmt.Errorf("error encoding rate limit state: %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO rate_limits(form_id, ip, state, expires_at) VALUES(?, ?, ?, ?)
+        ON CONFLICT(form_id, ip) DO UPDATE SET state = excluded.state, expires_at = excluded.expires_at`,
+		formID, ip, string(encoded), state.retainUntil().UnixNano())
+	if err != nil {
+		return rateLimitResult{}, fmt.Errorf("error saving rate limit state: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return rateLimitResult{}, fmt.Errorf("error committing transaction: %v", err)
+	}
+	return result, nil
+}
+
+func (rl *sqliteRateLimiter) States() ([]rateLimitState, error) {
+	rows, err := rl.db.Query("SELECT state FROM rate_limits WHERE expires_at >= ?", time.Now().UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("error querying rate limits: %v", err)
+	}
+	defer rows.Close()
+
+	var states []rateLimitState
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("error scanning rate limit: %v", err)
+		}
+		var state rateLimitState
+		if err := json.Unmarshal([]byte(data), &state); err != nil {
+			return nil, fmt.Errorf("error decoding rate limit state: %v", err)
+		}
+		states = append(states, state)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rate limits: %v", err)
+	}
+	return states, nil
+}
+
+func (rl *sqliteRateLimiter) Clear(ip, formID string) error {
+	if _, err := rl.db.Exec("DELETE FROM rate_limits WHERE ip = ? AND (? = '' OR form_id = ?)", ip, formID, formID); err != nil {
+		return fmt.Errorf("error clearing rate limits: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// app/ratelimit_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// rateLimitStep is a request made at an offset from the start of a test and its expected outcome
+type rateLimitStep struct {
+	at         time.Duration
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+}
+
+// Apply the steps to a new state and check each outcome
+func checkRateLimitSteps(t *testing.T, limit RateLimit, window time.Duration, steps []rateLimitStep) {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	state := rateLimitState{FormID: "form", IP: "192.0.2.1"}
+	for i, step := range steps {
+		result := state.apply(start.Add(step.at), "test", limit, window)
+		if result.Allowed != step.allowed {
+			t.Fatalf("request %d at %v: allowed = %t, want %t", i, step.at, result.Allowed, step.allowed)
+		}
+		if step.allowed && result.Remaining != step.remaining {
+			t.Errorf("request %d at %v: remaining = %d, want %d", i, step.at, result.Remaining, step.remaining)
+		}
+		if !step.allowed && result.RetryAfter != step.retryAfter {
+			t.Errorf("request %d at %v: retry after = %v, want %v", i, step.at, result.RetryAfter, step.retryAfter)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit RateLimit
+		steps []rateLimitStep
+	}{
+		{
+			name:  "rejects requests over the limit until the oldest leaves the window",
+			limit: RateLimit{Requests: 3},
+			steps: []rateLimitStep{
+				{at: 0, allowed: true, remaining: 2},
+				{at: time.Second, allowed: true, remaining: 1},
+				{at: 2 * time.Second, allowed: true, remaining: 0},
+				{at: 3 * time.Second, retryAfter: 57 * time.Second},
+				{at: 59 * time.Second, retryAfter: time.Second},
+				{at: 61 * time.Second, allowed: true, remaining: 1},
+				{at: 62 * time.Second, allowed: true, remaining: 1},
+				{at: 62 * time.Second, allowed: true, remaining: 0},
+				{at: 62 * time.Second, retryAfter: 59 * time.Second},
+			},
+		},
+		{
+			name:  "rejected requests don't count",
+			limit: RateLimit{Requests: 1},
+			steps: []rateLimitStep{
+				{at: 0, allowed: true, remaining: 0},
+				{at: 30 * time.Second, retryAfter: 30 * time.Second},
+				{at: 45 * time.Second, retryAfter: 15 * time.Second},
+				{at: 60 * time.Second, allowed: true, remaining: 0},
+			},
+		},
+		{
+			name:  "a limit of zero rejects every request",
+			limit: RateLimit{Requests: 0},
+			steps: []rateLimitStep{
+				{at: 0, retryAfter: time.Minute},
+				{at: time.Hour, retryAfter: time.Minute},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.limit.Algorithm = rateLimitSlidingWindow
+			checkRateLimitSteps(t, tt.limit, time.Minute, tt.steps)
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit RateLimit
+		steps []rateLimitStep
+	}{
+		{
+			name:  "allows a burst and then refills at the rate",
+			limit: RateLimit{Requests: 6, Burst: 3},
+			steps: []rateLimitStep{
+				{at: 0, allowed: true, remaining: 2},
+				{at: 0, allowed: true, remaining: 1},
+				{at: 0, allowed: true, remaining: 0},
+				{at: 0, retryAfter: 10 * time.Second},
+				{at: 5 * time.Second, retryAfter: 5 * time.Second},
+				{at: 10 * time.Second, allowed: true, remaining: 0},
+				{at: 40 * time.Second, allowed: true, remaining: 2},
+			},
+		},
+		{
+			name:  "the burst defaults to the number of requests",
+			limit: RateLimit{Requests: 2},
+			steps: []rateLimitStep{
+				{at: 0, allowed: true, remaining: 1},
+				{at: 0, allowed: true, remaining: 0},
+				{at: 0, retryAfter: 30 * time.Second},
+				{at: 10 * time.Minute, allowed: true, remaining: 1},
+			},
+		},
+		{
+			name:  "a rate of zero rejects every request",
+			limit: RateLimit{Requests: 0, Burst: 5},
+			steps: []rateLimitStep{
+				{at: 0, retryAfter: time.Minute},
+				{at: time.Hour, retryAfter: time.Minute},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.limit.Algorithm = rateLimitTokenBucket
+			checkRateLimitSteps(t, tt.limit, time.Minute, tt.steps)
+		})
+	}
+}
+
+func TestRateLimitStateCounts(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	state := rateLimitState{}
+	limit := RateLimit{Requests: 1}
+	state.apply(start, "first", limit, time.Minute)
+	state.apply(start.Add(time.Second), "second", limit, time.Minute)
+
+	if state.Accepted != 1 || state.Rejected != 1 {
+		t.Errorf("accepted %d and rejected %d, want 1 and 1", state.Accepted, state.Rejected)
+	}
+	if state.LastUserAgent != "second" || !state.LastSeen.Equal(start.Add(time.Second)) {
+		t.Errorf("last seen %v with %q, want the second request", state.LastSeen, state.LastUserAgent)
+	}
+	if want := start.Add(time.Second + rateLimitHistory); !state.retainUntil().Equal(want) {
+		t.Errorf("retained until %v, want %v", state.retainUntil(), want)
+	}
+}
+
+func TestMemoryRateLimiterClear(t *testing.T) {
+	rl := &memoryRateLimiter{visitors: make(map[string]*visitor)}
+	limit := RateLimit{Requests: 1}
+	for _, v := range []struct{ formID, ip string }{{"a", "192.0.2.1"}, {"b", "192.0.2.1"}, {"a", "192.0.2.2"}} {
+		if _, err := rl.Allow(v.formID, v.ip, "test", limit, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rl.Clear("192.0.2.1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if states, _ := rl.States(); len(states) != 2 {
+		t.Fatalf("%d states after clearing one form, want 2", len(states))
+	}
+	if err := rl.Clear("192.0.2.1", ""); err != nil {
+		t.Fatal(err)
+	}
+	states, _ := rl.States()
+	if len(states) != 1 || states[0].IP != "192.0.2.2" {
+		t.Fatalf("states after clearing all forms = %+v, want only 192.0.2.2", states)
+	}
+}
@@ -0,0 +1,164 @@
+// app/rbac.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Roles a user can be granted on a form, from least to most privileged.
+// Viewers can read submissions and rate limits, editors can also delete
+// submissions and manage rate limits, and owners can also manage users.
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+// Form ID of a grant that applies to all forms
+const allForms = "*"
+
+var roleLevels = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleOwner:  3,
+}
+
+// Check whether a role name is valid
+func validRole(role string) bool {
+	_, ok := roleLevels[role]
+	return ok
+}
+
+// Return the role of the user on a form, taking grants on all forms into account
+func (u *user) roleFor(formID string) string {
+	role := u.Grants[formID]
+	if global := u.Grants[allForms]; roleLevels[global] > roleLevels[role] {
+		role = global
+	}
+	return role
+}
+
+// Check whether the user has at least the given role on a form
+func (u *user) can(role, formID string) bool {
+	return roleLevels[u.roleFor(formID)] >= roleLevels[role]
+}
+
+// Check whether the user has at least the given role on every form
+func (u *user) canAll(role string) bool {
+	return roleLevels[u.Grants[allForms]] >= roleLevels[role]
+}
+
+// Return the forms on which the user has at least the given role. The first
+// result is true when the role is granted on all forms.
+func (u *user) formsWith(role string) (bool, []string) {
+	if u.canAll(role) {
+		return true, nil
+	}
+	forms := []string{}
+	for formID, granted := range u.Grants {
+		if roleLevels[granted] >= roleLevels[role] {
+			forms = append(forms, formID)
+		}
+	}
+	sort.Strings(forms)
+	return false, forms
+}
+
+// Load the grants of a user
+func loadGrants(db *sql.DB, u *user) error {
+	rows, err := db.Query("SELECT form_id, role FROM form_grants WHERE user_id = ?", u.ID)
+	if err != nil {
+		return fmt.Errorf("error querying grants: %v", err)
+	}
+	defer rows.Close()
+
+	u.Grants = make(map[string]string)
+	for rows.Next() {
+		var formID, role string
+		if err := rows.Scan(&formID, &role); err != nil {
+			return fmt.Errorf("error scanning grant: %v", err)
+		}
+		u.Grants[formID] = role
+	}
+	return rows.Err()
+}
+
+// Replace the grants of a user
+func setGrants(userID int64, grants map[string]string) error {
+	for formID, role := range grants {
+		if formID == "" || !validRole(role) {
+			return fmt.Errorf("invalid grant %q on form %q", role, formID)
+		}
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM form_grants WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting grants: %v", err)
+	}
+	for formID, role := range grants {
+		if _, err := tx.Exec("INSERT INTO form_grants(user_id, form_id, role) VALUES(?, ?, ?)", userID, formID, role); err != nil {
+			return fmt.Errorf("error inserting grant: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Return the username of a user, or an empty string for nil
+func usernameOf(u *user) string {
+	if u == nil {
+		return ""
+	}
+	return u.Username
+}
+
+// Write a 403 response and return false unless the user has the role on the form
+func authorizeForm(w http.ResponseWriter, r *http.Request, role, formID string) bool {
+	u := currentUser(r)
+	if u != nil && u.can(role, formID) {
+		return true
+	}
+	log.Warnf("User %s denied %s access to form %s", usernameOf(u), role, formID)
+	jsonError(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// Write a 403 response and return false unless the user has the role on all forms
+func authorizeAll(w http.ResponseWriter, r *http.Request, role string) bool {
+	u := currentUser(r)
+	if u != nil && u.canAll(role) {
+		return true
+	}
+	log.Warnf("User %s denied %s access to all forms", usernameOf(u), role)
+	jsonError(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// Authorize a setting that applies to one form, or to all forms when formID is empty
+func authorizeScope(w http.ResponseWriter, r *http.Request, role, formID string) bool {
+	if formID == "" {
+		return authorizeAll(w, r, role)
+	}
+	return authorizeForm(w, r, role, formID)
+}
+
+// Middleware to restrict a route to owners of all forms
+func requireOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeAll(w, r, roleOwner) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
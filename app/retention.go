@@ -0,0 +1,217 @@
+// app/retention.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often expired submissions and the trash are purged
+const retentionInterval = time.Hour
+
+// Number of the oldest expiring submissions listed per form in the report
+const retentionReportSample = 10
+
+// Time of the next run of the retention job, shown in the report
+var retentionNextRun struct {
+	sync.Mutex
+	at time.Time
+}
+
+// retentionReport is a dry run of the next run of the retention job
+type retentionReport struct {
+	NextRun time.Time             `json:"next_run"`
+	Forms   []formRetentionReport `json:"forms"`
+	Trash   retentionCount        `json:"trash"`
+}
+
+// retentionCount is the number of submissions a run deletes or anonymizes, and
+// of their uploaded files
+type retentionCount struct {
+	Retain  string    `json:"retain"`
+	Cutoff  time.Time `json:"cutoff"`
+	Expired int       `json:"expired"`
+	Files   int       `json:"files"`
+}
+
+// formRetentionReport is the part of the report for one form
+type formRetentionReport struct {
+	FormID string `json:"form_id"`
+	Action string `json:"action"`
+	retentionCount
+	Oldest []retentionSample `json:"oldest"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// retentionSample is an expiring submission listed in the report
+type retentionSample struct {
+	ID        int64  `json:"id"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Check the retention of every form in the configuration
+func validateRetention(config Config) error {
+	for formID, formConfig := range config.Forms {
+		if _, _, err := formConfig.retention(); err != nil {
+			return fmt.Errorf("form %s: %v", formID, err)
+		}
+	}
+	return nil
+}
+
+// Select the submissions of a form received before the cutoff that the
+// retention action still applies to
+func expiredSubmissions(formID string, cutoff time.Time, action string) submissionSelector {
+	return submissionSelector{FormID: formID, CreatedBefore: cutoff, NotAnonymized: action == retentionAnonymize}
+}
+
+// Remove the personal data of the submissions matching a selector, together
+// with their uploaded files, and return how many were anonymized. The form,
+// state and time of the submissions are kept.
+func anonymizeSubmissions(sel submissionSelector) (int64, error) {
+	n, files, err := submissionStore.Anonymize(sel)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		removeUpload(file)
+	}
+	return n, nil
+}
+
+// Purge or anonymize the submissions of every form older than its retention
+func enforceRetention(config Config) {
+	now := time.Now()
+	for formID, formConfig := range config.Forms {
+		period, action, err := formConfig.retention()
+		if err != nil {
+			log.Errorf("Error in the retention of form %s: %v", formID, err)
+			continue
+		}
+		if period == 0 {
+			continue
+		}
+
+		sel := expiredSubmissions(formID, now.Add(-period), action)
+		var n int64
+		done := "purged"
+		if action == retentionAnonymize {
+			n, err = anonymizeSubmissions(sel)
+			done = "anonymized"
+		} else {
+			n, err = purgeSubmissions(sel)
+		}
+		if err != nil {
+			log.Errorf("Error applying the retention of form %s: %v", formID, err)
+			continue
+		}
+		if n > 0 {
+			log.Infof("Retention of form %s: %s %d submissions older than %s", formID, done, n, formConfig.Retain)
+		}
+	}
+}
+
+// Periodically apply the retention of the forms and purge the expired trash
+func runRetention() {
+	for {
+		retentionNextRun.Lock()
+		retentionNextRun.at = time.Now().Add(retentionInterval)
+		retentionNextRun.Unlock()
+		time.Sleep(retentionInterval)
+
+		// Reload the configuration, like the form handler, to pick up changed retention
+		if config, err := loadConfig("/app/config/config.json"); err != nil {
+			log.Errorf("Error loading config for retention: %v", err)
+		} else {
+			enforceRetention(config)
+		}
+		if err := purgeExpiredTrash(); err != nil {
+			log.Errorf("Error purging the trash: %v", err)
+		}
+	}
+}
+
+// Report what the next run of the retention job will delete, without deleting anything
+func reportRetention(config Config) (retentionReport, error) {
+	retentionNextRun.Lock()
+	report := retentionReport{NextRun: retentionNextRun.at, Forms: []formRetentionReport{}}
+	retentionNextRun.Unlock()
+	if report.NextRun.IsZero() {
+		report.NextRun = time.Now()
+	}
+
+	formIDs := make([]string, 0, len(config.Forms))
+	for formID := range config.Forms {
+		formIDs = append(formIDs, formID)
+	}
+	sort.Strings(formIDs)
+
+	for _, formID := range formIDs {
+		formConfig := config.Forms[formID]
+		entry := formRetentionReport{FormID: formID, Oldest: []retentionSample{}}
+		entry.Retain = formConfig.Retain
+		period, action, err := formConfig.retention()
+		entry.Action = action
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if err != nil || period == 0 {
+			report.Forms = append(report.Forms, entry)
+			continue
+		}
+
+		entry.Cutoff = report.NextRun.Add(-period).UTC()
+		sel := expiredSubmissions(formID, entry.Cutoff, action)
+		if entry.Expired, entry.Files, err = submissionStore.Count(sel); err != nil {
+			return report, err
+		}
+
+		oldest, err := submissionStore.Find(sel, retentionReportSample)
+		if err != nil {
+			return report, err
+		}
+		for _, s := range oldest {
+			entry.Oldest = append(entry.Oldest, retentionSample{ID: s.ID, CreatedAt: s.CreatedAt})
+		}
+		report.Forms = append(report.Forms, entry)
+	}
+
+	days, err := trashRetentionDays()
+	if err != nil {
+		return report, err
+	}
+	report.Trash.Retain = fmt.Sprintf("%dd", days)
+	report.Trash.Cutoff = report.NextRun.AddDate(0, 0, -days).UTC()
+	report.Trash.Expired, report.Trash.Files, err = submissionStore.Count(submissionSelector{DeletedBefore: report.Trash.Cutoff})
+	if err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// Handler to view the retention report (admin)
+func viewRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/retention.html")
+}
+
+// API handler to fetch a dry run of the next run of the retention job (admin)
+func apiRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	config, err := loadConfig("/app/config/config.json")
+	if err != nil {
+		log.Errorf("Error loading config: %v", err)
+		jsonError(w, "Could not load config", http.StatusInternalServerError)
+		return
+	}
+	report, err := reportRetention(config)
+	if err != nil {
+		log.Errorf("Error reporting retention: %v", err)
+		jsonError(w, "Could not report retention", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,92 @@
+// app/retention_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormRetention(t *testing.T) {
+	tests := []struct {
+		retain, action string
+		wantPeriod     time.Duration
+		wantAction     string
+		wantErr        bool
+	}{
+		{"", "", 0, retentionPurge, false},
+		{"30d", "", 30 * 24 * time.Hour, retentionPurge, false},
+		{"2w", retentionAnonymize, 14 * 24 * time.Hour, retentionAnonymize, false},
+		{"36h", retentionPurge, 36 * time.Hour, retentionPurge, false},
+		{"0d", "", 0, "", true},
+		{"-1h", "", 0, "", true},
+		{"d", "", 0, "", true},
+		{"1y", "", 0, "", true},
+		{"30d", "delete", 0, "", true},
+	}
+	for _, tt := range tests {
+		period, action, err := FormConfig{Retain: tt.retain, RetentionAction: tt.action}.retention()
+		if (err != nil) != tt.wantErr || period != tt.wantPeriod || action != tt.wantAction {
+			t.Errorf("retain %q with action %q: %s %q %v, want %s %q with error %t", tt.retain, tt.action, period, action, err, tt.wantPeriod, tt.wantAction, tt.wantErr)
+		}
+	}
+}
+
+func TestEnforceRetention(t *testing.T) {
+	useTestSubmissionStore(t)
+	config := Config{Forms: map[string]FormConfig{
+		"purged":     {Retain: "30d"},
+		"anonymized": {Retain: "1w", RetentionAction: retentionAnonymize},
+		"kept":       {},
+	}}
+	// Store a submission received the given number of days ago
+	create := func(formID string, days int) int64 {
+		t.Helper()
+		id, err := submissionStore.Create(submission{FormID: formID, Name: "Alice", Email: "alice@example.com", Read: "N", Metadata: &submissionMetadata{IP: "192.0.2.7"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := time.Now().UTC().AddDate(0, 0, -days).Format(sqliteTimestampFormat)
+		if _, err := db.Exec("UPDATE submissions SET created_at = ? WHERE id = ?", created, id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	oldPurged, newPurged := create("purged", 31), create("purged", 29)
+	oldAnonymized, newAnonymized := create("anonymized", 8), create("anonymized", 6)
+	oldKept := create("kept", 3650)
+
+	// The report counts what the run will change without changing it
+	report, err := reportRetention(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := map[string]int{}
+	for _, form := range report.Forms {
+		expired[form.FormID] = form.Expired
+	}
+	if expired["purged"] != 1 || expired["anonymized"] != 1 || expired["kept"] != 0 {
+		t.Errorf("expired submissions in the report = %v", expired)
+	}
+
+	enforceRetention(config)
+	if _, err := submissionStore.Get(oldPurged); err == nil {
+		t.Error("submission older than the retention was not purged")
+	}
+	for _, id := range []int64{newPurged, newAnonymized, oldKept} {
+		if s, err := submissionStore.Get(id); err != nil || s.Name != "Alice" {
+			t.Errorf("submission %d within the retention: %+v, %v", id, s, err)
+		}
+	}
+	s, err := submissionStore.Get(oldAnonymized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "" || s.Email != "" || s.Metadata.IP != "" || s.AnonymizedAt == nil || s.FormID != "anonymized" {
+		t.Errorf("anonymized submission = %+v", s)
+	}
+
+	// Anonymized submissions are not counted again
+	if report, _ := reportRetention(config); report.Forms[0].FormID != "anonymized" || report.Forms[0].Expired != 0 {
+		t.Errorf("report after the run = %+v", report.Forms[0])
+	}
+}
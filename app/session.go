@@ -1,18 +1,178 @@
+// app/session.go
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
 
-var store *sessions.CookieStore
+var store *sqliteSessionStore
 
-// Initialize the session store
-func init() {
+var (
+	// Time after which a session expires and the user has to log in again
+	sessionLifetime = time.Hour
+	// Time without requests after which a session expires
+	sessionIdleTimeout = 30 * time.Minute
+	// Whether cookies are only sent over HTTPS
+	secureCookies = true
+)
+
+// Initialize the session store from SESSION_SECRET, SESSION_PREVIOUS_SECRETS, SESSION_LIFETIME,
+// SESSION_IDLE_TIMEOUT and SESSION_COOKIE_SECURE
+func initSessionStore() error {
 	secret := os.Getenv("SESSION_SECRET")
 	if secret == "" {
-		log.Fatal("SESSION_SECRET environment variable is not set")
+		return fmt.Errorf("SESSION_SECRET environment variable is not set")
+	}
+	keys := [][]byte{[]byte(secret)}
+
+	// Cookies signed with previous secrets stay valid until they expire, so the secret can be rotated
+	for _, previous := range strings.Split(os.Getenv("SESSION_PREVIOUS_SECRETS"), ",") {
+		if previous = strings.TrimSpace(previous); previous != "" {
+			keys = append(keys, []byte(previous))
+		}
+	}
+
+	if value := os.Getenv("SESSION_LIFETIME"); value != "" {
+		lifetime, err := time.ParseDuration(value)
+		if err != nil || lifetime <= 0 {
+			return fmt.Errorf("invalid SESSION_LIFETIME: %q", value)
+		}
+		sessionLifetime = lifetime
+	}
+	if value := os.Getenv("SESSION_IDLE_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid SESSION_IDLE_TIMEOUT: %q", value)
+		}
+		sessionIdleTimeout = timeout
+	}
+	if value := os.Getenv("SESSION_COOKIE_SECURE"); value != "" {
+		secure, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SESSION_COOKIE_SECURE: %q", value)
+		}
+		secureCookies = secure
+	}
+	if !secureCookies {
+		log.Warn("SESSION_COOKIE_SECURE is false, session cookies will be sent over plain HTTP")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	store = newSQLiteSessionStore(db, sessionOptions(), sessionIdleTimeout, keys...)
+	return nil
+}
+
+// Return the cookie options of the admin session
+func sessionOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secureCookies,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(sessionLifetime.Seconds()),
+	}
+}
+
+// Mark the session as authenticated for the user and save it
+func startSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, u *user) error {
+	session.Values["authenticated"] = true
+	session.Values["user_id"] = u.ID
+	session.Values["username"] = u.Username
+	session.Options = sessionOptions()
+
+	// Start the authenticated session under a new ID
+	if err := store.renew(session); err != nil {
+		return err
+	}
+
+	// Issue a new CSRF token for the authenticated session
+	if _, err := newCSRFToken(w, session); err != nil {
+		return err
+	}
+	return session.Save(r, w)
+}
+
+// Return the ID of the admin session of the request
+func currentSessionToken(r *http.Request) string {
+	session, _ := store.Get(r, "session-name")
+	return session.ID
+}
+
+// Revoke all sessions of a user except the one with the given ID
+func revokeUserSessions(userID int64, exceptToken string) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	_, err = db.Exec("DELETE FROM sessions WHERE user_id = ? AND token != ?", userID, exceptToken)
+	if err != nil {
+		return fmt.Errorf("error deleting sessions: %v", err)
 	}
-	store = sessions.NewCookieStore([]byte(secret))
+	return nil
+}
+
+// Handler to view the active sessions of the current user
+func viewSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/sessions.html")
+}
+
+// API handler to fetch the active sessions of the current user
+func apiSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := store.listUserSessions(currentUser(r).ID, currentSessionToken(r))
+	if err != nil {
+		log.Errorf("Error fetching sessions: %v", err)
+		jsonError(w, "Could not fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// API handler to revoke a session of the current user
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	found, err := store.revokeSession(u.ID, id)
+	if err != nil {
+		log.Errorf("Error revoking session %d: %v", id, err)
+		jsonError(w, "Could not revoke session", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		jsonError(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, "session.revoke", fmt.Sprintf("session %d of %s", id, u.Username))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API handler to revoke all sessions of the current user except the current one
+func revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if err := revokeUserSessions(u.ID, currentSessionToken(r)); err != nil {
+		log.Errorf("Error revoking sessions of user %d: %v", u.ID, err)
+		jsonError(w, "Could not revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "session.revoke_others", u.Username)
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,211 @@
+// app/session_sqlite.go
+package main
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Minimum time between two updates of the last activity of a session
+const sessionTouchInterval = time.Minute
+
+var sessionIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// sqliteSessionStore keeps the session values in the SQLite database, so the
+// cookie only carries the signed session ID and sessions can be revoked on the
+// server. Cookies signed with any of the keys are accepted, new cookies are
+// signed with the first one.
+type sqliteSessionStore struct {
+	db          *sql.DB
+	codecs      []securecookie.Codec
+	Options     *sessions.Options
+	idleTimeout time.Duration
+}
+
+// activeSession is a session of a user as listed on the sessions page
+type activeSession struct {
+	ID         int64     `json:"id"`
+	Current    bool      `json:"current"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Initialize a new SQLite session store signing cookies with the given keys
+func newSQLiteSessionStore(db *sql.DB, options *sessions.Options, idleTimeout time.Duration, keys ...[]byte) *sqliteSessionStore {
+	var pairs [][]byte
+	for _, key := range keys {
+		pairs = append(pairs, key, nil)
+	}
+	s := &sqliteSessionStore{
+		db:          db,
+		codecs:      securecookie.CodecsFromPairs(pairs...),
+		Options:     options,
+		idleTimeout: idleTimeout,
+	}
+	for _, codec := range s.codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(options.MaxAge)
+		}
+	}
+	go s.cleanupSessions()
+	return s
+}
+
+// Periodically delete expired and idle sessions
+func (s *sqliteSessionStore) cleanupSessions() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now().UTC()
+		if _, err := s.db.Exec("DELETE FROM sessions WHERE expires_at < ? OR last_seen_at < ?", now, now.Add(-s.idleTimeout)); err != nil {
+			log.Errorf("Error cleaning up sessions: %v", err)
+		}
+	}
+}
+
+// Get returns the session of the request for the given name
+func (s *sqliteSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session from the database, or returns a new session when the
+// cookie is missing or invalid, or the session has expired or been revoked
+func (s *sqliteSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var token string
+	if err := securecookie.DecodeMulti(name, c.Value, &token, s.codecs...); err != nil {
+		return session, nil
+	}
+
+	now := time.Now().UTC()
+	var data []byte
+	var lastSeen time.Time
+	err = s.db.QueryRow("SELECT data, last_seen_at FROM sessions WHERE token = ? AND name = ? AND expires_at > ? AND last_seen_at > ?",
+		token, name, now, now.Add(-s.idleTimeout)).Scan(&data, &lastSeen)
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, fmt.Errorf("error loading session: %v", err)
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, fmt.Errorf("error decoding session: %v", err)
+	}
+	session.ID = token
+	session.IsNew = false
+
+	if now.Sub(lastSeen) > sessionTouchInterval {
+		ip, _ := clientIP(r)
+		_, err := s.db.Exec("UPDATE sessions SET last_seen_at = ?, ip = ?, user_agent = ? WHERE token = ?", now, ip, r.UserAgent(), token)
+		if err != nil {
+			log.Errorf("Error updating session activity: %v", err)
+		}
+	}
+	return session, nil
+}
+
+// Save stores the session values and sets the cookie, or deletes the session
+// when its MaxAge is negative
+func (s *sqliteSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if _, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", session.ID); err != nil {
+				return fmt.Errorf("error deleting session: %v", err)
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return fmt.Errorf("error encoding session: %v", err)
+	}
+	var userID sql.NullInt64
+	if authenticated, _ := session.Values["authenticated"].(bool); authenticated {
+		id, _ := session.Values["user_id"].(int64)
+		userID = sql.NullInt64{Int64: id, Valid: id != 0}
+	}
+	if session.ID == "" {
+		session.ID = sessionIDEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+
+	// The lifetime of a session counts from its creation and is not extended by saving it
+	ip, _ := clientIP(r)
+	now := time.Now().UTC()
+	_, err = s.db.Exec(`INSERT INTO sessions(token, name, user_id, data, ip, user_agent, created_at, last_seen_at, expires_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(token) DO UPDATE SET user_id = excluded.user_id, data = excluded.data, last_seen_at = excluded.last_seen_at`,
+		session.ID, session.Name(), userID, data, ip, r.UserAgent(), now, now, now.Add(time.Duration(session.Options.MaxAge)*time.Second))
+	if err != nil {
+		return fmt.Errorf("error saving session: %v", err)
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return fmt.Errorf("error encoding session cookie: %v", err)
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Give the session a new ID, so an ID obtained before the login can't be used afterwards
+func (s *sqliteSessionStore) renew(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", session.ID); err != nil {
+		return fmt.Errorf("error deleting session: %v", err)
+	}
+	session.ID = ""
+	return nil
+}
+
+// List the active sessions of a user, marking the one with the given token as current
+func (s *sqliteSessionStore) listUserSessions(userID int64, currentToken string) ([]activeSession, error) {
+	now := time.Now().UTC()
+	rows, err := s.db.Query(`SELECT id, token, ip, user_agent, created_at, last_seen_at, expires_at FROM sessions
+        WHERE user_id = ? AND expires_at > ? AND last_seen_at > ? ORDER BY last_seen_at DESC`,
+		userID, now, now.Add(-s.idleTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("error querying sessions: %v", err)
+	}
+	defer rows.Close()
+
+	result := []activeSession{}
+	for rows.Next() {
+		var entry activeSession
+		var token string
+		if err := rows.Scan(&entry.ID, &token, &entry.IP, &entry.UserAgent, &entry.CreatedAt, &entry.LastSeenAt, &entry.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("error scanning session: %v", err)
+		}
+		entry.Current = token == currentToken
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+// Revoke a session of a user
+func (s *sqliteSessionStore) revokeSession(userID, id int64) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, fmt.Errorf("error deleting session: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
@@ -0,0 +1,98 @@
+// app/session_sqlite_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Replace the session store with one using the test database
+func useTestSessionStore(t *testing.T) *sqliteSessionStore {
+	t.Helper()
+	previous := store
+	store = newSQLiteSessionStore(useTestDB(t), sessionOptions(), 30*time.Minute, []byte("test session secret"))
+	t.Cleanup(func() { store = previous })
+	return store
+}
+
+// Save a session with the given values and return a request carrying its cookie
+func requestWithSession(t *testing.T, s *sqliteSessionStore, method, target string, values map[interface{}]interface{}) *http.Request {
+	t.Helper()
+	session, err := s.New(httptest.NewRequest(http.MethodGet, "/", nil), "session-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range values {
+		session.Values[key] = value
+	}
+	w := httptest.NewRecorder()
+	if err := s.Save(httptest.NewRequest(http.MethodGet, "/", nil), w, session); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, target, nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSessionRevocationAndIdleTimeout(t *testing.T) {
+	s := useTestSessionStore(t)
+	values := map[interface{}]interface{}{"authenticated": true, "user_id": int64(1), "username": "alice"}
+	first := requestWithSession(t, s, http.MethodGet, "/", values)
+	second := requestWithSession(t, s, http.MethodGet, "/", values)
+
+	// Load the session of a request, as a new request would
+	load := func(r *http.Request) (string, bool) {
+		t.Helper()
+		session, err := s.New(r, "session-name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return session.ID, !session.IsNew
+	}
+	token, found := load(first)
+	if !found {
+		t.Fatal("saved session not found")
+	}
+
+	sessions, err := s.listUserSessions(1, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions listed, want 2", len(sessions))
+	}
+	var id int64
+	for _, session := range sessions {
+		if session.Current {
+			id = session.ID
+		}
+	}
+	if revoked, err := s.revokeSession(2, id); err != nil || revoked {
+		t.Errorf("another user revoked the session: %t, %v", revoked, err)
+	}
+	if revoked, err := s.revokeSession(1, id); err != nil || !revoked {
+		t.Fatalf("revoke: %t, %v", revoked, err)
+	}
+	if _, found := load(first); found {
+		t.Error("revoked session is still valid")
+	}
+	if _, found := load(second); !found {
+		t.Error("the other session was revoked too")
+	}
+
+	// A session without requests for longer than the idle timeout has expired
+	fresh := requestWithSession(t, s, http.MethodGet, "/", values)
+	if _, err := s.db.Exec("UPDATE sessions SET last_seen_at = ?", time.Now().UTC().Add(-31*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := load(fresh); found {
+		t.Error("idle session is still valid")
+	}
+	if remaining, _ := s.listUserSessions(1, ""); len(remaining) != 0 {
+		t.Errorf("%d idle sessions listed, want none", len(remaining))
+	}
+}
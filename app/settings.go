@@ -0,0 +1,114 @@
+// app/settings.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Keys of the settings changed from the admin panel
+const (
+	settingRequire2FA         = "require_2fa"
+	settingTrashRetentionDays = "trash_retention_days"
+)
+
+// Return a setting, or the fallback when it has not been set
+func getSetting(key, fallback string) (string, error) {
+	db, err := getDB()
+	if err != nil {
+		return "", fmt.Errorf("error opening database: %v", err)
+	}
+	var value string
+	err = db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error querying setting %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// Store a setting
+func setSetting(key, value string) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO settings(key, value, updated_at) VALUES(?, ?, ?)
+        ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		key, value, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error storing setting %s: %v", key, err)
+	}
+	return nil
+}
+
+// Check whether every user must use two-factor authentication
+func twoFactorRequired() (bool, error) {
+	value, err := getSetting(settingRequire2FA, "false")
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+// API handler to fetch the settings (admin)
+func apiSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	required, err := twoFactorRequired()
+	if err != nil {
+		log.Errorf("Error reading settings: %v", err)
+		jsonError(w, "Could not read settings", http.StatusInternalServerError)
+		return
+	}
+	retention, err := trashRetentionDays()
+	if err != nil {
+		log.Errorf("Error reading settings: %v", err)
+		jsonError(w, "Could not read settings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		settingRequire2FA:         required,
+		settingTrashRetentionDays: retention,
+	})
+}
+
+// API handler to change the settings (admin)
+func updateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Require2FA         *bool `json:"require_2fa"`
+		TrashRetentionDays *int  `json:"trash_retention_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.TrashRetentionDays != nil && (*request.TrashRetentionDays < 1 || *request.TrashRetentionDays > 3650) {
+		jsonError(w, "Trash retention must be between 1 and 3650 days", http.StatusBadRequest)
+		return
+	}
+
+	if request.Require2FA != nil {
+		if err := setSetting(settingRequire2FA, strconv.FormatBool(*request.Require2FA)); err != nil {
+			log.Errorf("Error storing settings: %v", err)
+			jsonError(w, "Could not store settings", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "settings.update", fmt.Sprintf("%s=%t", settingRequire2FA, *request.Require2FA))
+	}
+	if request.TrashRetentionDays != nil {
+		if err := setSetting(settingTrashRetentionDays, strconv.Itoa(*request.TrashRetentionDays)); err != nil {
+			log.Errorf("Error storing settings: %v", err)
+			jsonError(w, "Could not store settings", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "settings.update", fmt.Sprintf("%s=%d", settingTrashRetentionDays, *request.TrashRetentionDays))
+	}
+
+	apiSettingsHandler(w, r)
+}
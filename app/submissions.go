@@ -0,0 +1,331 @@
+// app/submissions.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of submissions returned per page by default and at most
+const (
+	defaultSubmissionsLimit = 50
+	maxSubmissionsLimit     = 500
+)
+
+// Columns the submissions can be sorted by
+var submissionSortColumns = map[string]bool{
+	"created_at": true,
+	"form_id":    true,
+	"name":       true,
+	"email":      true,
+	"status":     true,
+}
+
+// Statuses a submission moves through
+var submissionStatuses = map[string]bool{
+	"new":         true,
+	"in_progress": true,
+	"done":        true,
+	"archived":    true,
+}
+
+// Number of tags of a submission and length of a tag allowed at most
+const (
+	maxSubmissionTags = 20
+	maxTagLength      = 50
+)
+
+// Format of created_at, which is stored as text by SQLite and parsed from it by
+// the other databases
+const sqliteTimestampFormat = "2006-01-02 15:04:05"
+
+var (
+	errInvalidCursor = errors.New("invalid cursor")
+	errTooManyTags   = fmt.Errorf("a submission can have at most %d tags", maxSubmissionTags)
+)
+
+// submission is a stored form submission
+type submission struct {
+	ID        int64    `json:"id"`
+	FormID    string   `json:"form_id"`
+	Name      string   `json:"name"`
+	Email     string   `json:"email"`
+	Message   string   `json:"message"`
+	File      string   `json:"file"`
+	Read      string   `json:"read"`
+	Spam      bool     `json:"spam"`
+	Starred   bool     `json:"starred"`
+	Status    string   `json:"status"`
+	Tags      []string `json:"tags"`
+	CreatedAt string   `json:"created_at"`
+
+	// When the submission was moved to the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// When the personal data was removed by the retention policy of the form
+	AnonymizedAt *time.Time `json:"anonymized_at,omitempty"`
+
+	// Only set for a single submission
+	Metadata *submissionMetadata `json:"metadata,omitempty"`
+}
+
+// submissionMetadata describes the request that submitted a form. It is empty
+// for submissions stored before it was recorded.
+type submissionMetadata struct {
+	IP             string  `json:"ip"`
+	UserAgent      string  `json:"user_agent"`
+	Referer        string  `json:"referer"`
+	Origin         string  `json:"origin"`
+	AcceptLanguage string  `json:"accept_language"`
+	ConfigVersion  string  `json:"config_version"`
+	ProcessingMS   float64 `json:"processing_ms"`
+}
+
+// submissionFilter selects and orders the submissions returned by the API
+type submissionFilter struct {
+	FormID  string
+	From    time.Time
+	To      time.Time
+	Read    *bool
+	Spam    *bool
+	Starred *bool
+	Status  string
+	Tag     string
+	Search  string
+	Trash   bool
+	Sort    string
+	Desc    bool
+	Limit   int
+	Cursor  *submissionCursor
+}
+
+// submissionCursor is the position after the last submission of a page
+type submissionCursor struct {
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// Parse a date filter given as a date or an RFC 3339 timestamp. Dates used as
+// the end of a range include the whole day.
+func parseSubmissionDate(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return t, nil
+}
+
+// Parse an optional boolean filter
+func parseBoolFilter(query url.Values, name string) (*bool, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q, use true or false", name, value)
+	}
+	return &b, nil
+}
+
+// Parse the filter, sort order and page of a submissions request
+func parseSubmissionFilter(query url.Values) (submissionFilter, error) {
+	f := submissionFilter{
+		FormID: query.Get("form_id"),
+		Search: strings.TrimSpace(query.Get("q")),
+		Sort:   "created_at",
+		Desc:   true,
+		Limit:  defaultSubmissionsLimit,
+	}
+	var err error
+	if value := query.Get("from"); value != "" {
+		if f.From, err = parseSubmissionDate(value, false); err != nil {
+			return f, err
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if f.To, err = parseSubmissionDate(value, true); err != nil {
+			return f, err
+		}
+	}
+	if f.Read, err = parseBoolFilter(query, "read"); err != nil {
+		return f, err
+	}
+	if f.Spam, err = parseBoolFilter(query, "spam"); err != nil {
+		return f, err
+	}
+	if f.Starred, err = parseBoolFilter(query, "starred"); err != nil {
+		return f, err
+	}
+	if f.Status = query.Get("status"); f.Status != "" && !submissionStatuses[f.Status] {
+		return f, fmt.Errorf("invalid status %q", f.Status)
+	}
+	f.Tag = strings.TrimSpace(query.Get("tag"))
+	trash, err := parseBoolFilter(query, "trash")
+	if err != nil {
+		return f, err
+	}
+	f.Trash = trash != nil && *trash
+	if value := query.Get("sort"); value != "" {
+		if !submissionSortColumns[value] {
+			return f, fmt.Errorf("invalid sort %q", value)
+		}
+		f.Sort = value
+	}
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		f.Desc = false
+	default:
+		return f, fmt.Errorf("invalid order %q, use asc or desc", query.Get("order"))
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return f, fmt.Errorf("invalid limit %q", value)
+		}
+		f.Limit = min(limit, maxSubmissionsLimit)
+	}
+	if value := query.Get("cursor"); value != "" {
+		if f.Cursor, err = decodeSubmissionCursor(value); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// Encode the position after a submission as an opaque cursor
+func encodeSubmissionCursor(c submissionCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode a cursor returned with a previous page
+func decodeSubmissionCursor(value string) (*submissionCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c submissionCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+// Turn a search into an FTS5 query matching all words as prefixes
+func ftsQuery(search string) string {
+	var terms []string
+	for _, word := range strings.Fields(search) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Escape the LIKE wildcards of a search word
+func likePattern(word string) string {
+	word = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(word)
+	return "%" + word + "%"
+}
+
+// submissionUpdate changes the state of submissions. Fields left out are not changed.
+type submissionUpdate struct {
+	Read       *bool     `json:"read"`
+	Starred    *bool     `json:"starred"`
+	Spam       *bool     `json:"spam"`
+	Deleted    *bool     `json:"deleted"`
+	Status     *string   `json:"status"`
+	Tags       *[]string `json:"tags"`
+	AddTags    []string  `json:"add_tags"`
+	RemoveTags []string  `json:"remove_tags"`
+}
+
+// Trim tags and drop empty and duplicate ones
+func normalizeTags(tags []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q exceeds maximum length of %d", tag, maxTagLength)
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	return result, nil
+}
+
+// Check and normalize an update
+func (u *submissionUpdate) validate() error {
+	if u.Status != nil && !submissionStatuses[*u.Status] {
+		return fmt.Errorf("invalid status %q", *u.Status)
+	}
+	var err error
+	if u.Tags != nil {
+		tags, err := normalizeTags(*u.Tags)
+		if err != nil {
+			return err
+		}
+		u.Tags = &tags
+	}
+	if u.AddTags, err = normalizeTags(u.AddTags); err != nil {
+		return err
+	}
+	if u.RemoveTags, err = normalizeTags(u.RemoveTags); err != nil {
+		return err
+	}
+	if u.Read == nil && u.Starred == nil && u.Spam == nil && u.Deleted == nil && u.Status == nil && u.Tags == nil && len(u.AddTags) == 0 && len(u.RemoveTags) == 0 {
+		return errors.New("nothing to update")
+	}
+	return nil
+}
+
+// Return whether the update only marks submissions read or unread, which viewers
+// can do. Other changes require the editor role.
+func (u *submissionUpdate) readOnly() bool {
+	return u.Starred == nil && u.Spam == nil && u.Deleted == nil && u.Status == nil && u.Tags == nil && len(u.AddTags) == 0 && len(u.RemoveTags) == 0
+}
+
+// Return whether the update changes the tags
+func (u *submissionUpdate) changesTags() bool {
+	return u.Tags != nil || len(u.AddTags) > 0 || len(u.RemoveTags) > 0
+}
+
+// Return the tags of a submission after the update, given its stored tags,
+// which are replaced when the update sets the tags
+func (u *submissionUpdate) mergeTags(stored []string) ([]string, error) {
+	tags := stored
+	if u.Tags != nil {
+		tags = *u.Tags
+	}
+	remove := map[string]bool{}
+	for _, tag := range u.RemoveTags {
+		remove[tag] = true
+	}
+	kept := []string{}
+	for _, tag := range append(tags, u.AddTags...) {
+		if !remove[tag] {
+			kept = append(kept, tag)
+		}
+	}
+	kept, _ = normalizeTags(kept)
+	if len(kept) > maxSubmissionTags {
+		return nil, errTooManyTags
+	}
+	return kept, nil
+}
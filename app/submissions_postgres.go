@@ -0,0 +1,58 @@
+// app/submissions_postgres.go
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// postgresDialect is the SQL of a PostgreSQL database storing the submissions,
+// which several replicas can share
+type postgresDialect struct{}
+
+func (d postgresDialect) name() string       { return "postgres" }
+func (d postgresDialect) migrations() string { return "migrations/postgres" }
+
+func (d postgresDialect) initSchemaVersion(db *sql.DB) error {
+	return createSchemaVersion(db, "TIMESTAMP")
+}
+
+// PostgreSQL numbers its placeholders $1, $2, ... Question marks in quoted strings are kept.
+func (d postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	n, quoted := 0, false
+	for _, c := range query {
+		if c == '\'' {
+			quoted = !quoted
+		}
+		if c == '?' && !quoted {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (d postgresDialect) text(expr string) string        { return "CAST(" + expr + " AS TEXT)" }
+func (d postgresDialect) equalFold(column string) string { return "lower(" + column + ") = lower(?)" }
+
+// Tags are stored as a JSON array, like in SQLite
+func (d postgresDialect) hasTag() string {
+	return "tags::jsonb @> jsonb_build_array(CAST(? AS TEXT))"
+}
+
+func (d postgresDialect) search(search string) (string, []interface{}) {
+	return likeSearch(search, "ILIKE")
+}
+
+// PostgreSQL has no last insert ID, the new ID is returned by the query
+func (d postgresDialect) insert(db *sql.DB, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := db.QueryRow(d.rebind(query)+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
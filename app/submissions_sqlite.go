@@ -0,0 +1,106 @@
+// app/submissions_sqlite.go
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// sqliteDialect is the SQL of the application database, which stores the
+// submissions unless SUBMISSIONS_DATABASE_URL is set
+type sqliteDialect struct {
+	// Whether SQLite was built with FTS5, which requires the sqlite_fts5 build
+	// tag. Without it the search falls back to LIKE.
+	fts bool
+}
+
+func (d *sqliteDialect) name() string                       { return "sqlite" }
+func (d *sqliteDialect) migrations() string                 { return "migrations" }
+func (d *sqliteDialect) initSchemaVersion(db *sql.DB) error { return initSQLiteSchemaVersion(db) }
+func (d *sqliteDialect) rebind(query string) string         { return query }
+func (d *sqliteDialect) text(expr string) string            { return "CAST(" + expr + " AS TEXT)" }
+func (d *sqliteDialect) equalFold(column string) string     { return column + " = ? COLLATE NOCASE" }
+
+func (d *sqliteDialect) hasTag() string {
+	return "EXISTS (SELECT 1 FROM json_each(submissions.tags) WHERE value = ?)"
+}
+
+func (d *sqliteDialect) search(search string) (string, []interface{}) {
+	if !d.fts {
+		return likeSearch(search, "LIKE")
+	}
+	return "id IN (SELECT rowid FROM submissions_fts WHERE submissions_fts MATCH ?)", []interface{}{ftsQuery(search)}
+}
+
+func (d *sqliteDialect) insert(db *sql.DB, query string, args ...interface{}) (int64, error) {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Triggers keeping the full-text index in sync with the submissions table
+var submissionSearchTriggers = map[string]string{
+	"submissions_fts_insert": `CREATE TRIGGER submissions_fts_insert AFTER INSERT ON submissions BEGIN
+            INSERT INTO submissions_fts(rowid, name, email, message) VALUES (new.id, new.name, new.email, new.message);
+        END`,
+	"submissions_fts_delete": `CREATE TRIGGER submissions_fts_delete AFTER DELETE ON submissions BEGIN
+            INSERT INTO submissions_fts(submissions_fts, rowid, name, email, message) VALUES ('delete', old.id, old.name, old.email, old.message);
+        END`,
+	"submissions_fts_update": `CREATE TRIGGER submissions_fts_update AFTER UPDATE OF name, email, message ON submissions BEGIN
+            INSERT INTO submissions_fts(submissions_fts, rowid, name, email, message) VALUES ('delete', old.id, old.name, old.email, old.message);
+            INSERT INTO submissions_fts(rowid, name, email, message) VALUES (new.id, new.name, new.email, new.message);
+        END`,
+}
+
+// Create the full-text index of the submissions when SQLite supports FTS5, and
+// return whether it does
+func initSubmissionSearch(db *sql.DB) (bool, error) {
+	var available bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available); err != nil {
+		return false, fmt.Errorf("error checking for FTS5: %v", err)
+	}
+
+	// A binary without FTS5 can't write to an index created by one with it, so stop
+	// maintaining the index. It is rebuilt once FTS5 is available again.
+	if !available {
+		for name := range submissionSearchTriggers {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return false, fmt.Errorf("error dropping the search index triggers: %v", err)
+			}
+		}
+		log.Warn("SQLite was built without FTS5, searching submissions with LIKE")
+		return false, nil
+	}
+
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS submissions_fts USING fts5(
+        name, email, message, content='submissions', content_rowid='id'
+    )`)
+	if err != nil {
+		return false, fmt.Errorf("error creating the search index: %v", err)
+	}
+
+	var missing int
+	for name, trigger := range submissionSearchTriggers {
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?", name).Scan(&exists); err != nil {
+			return false, fmt.Errorf("error checking the search index triggers: %v", err)
+		}
+		if exists > 0 {
+			continue
+		}
+		missing++
+		if _, err := db.Exec(trigger); err != nil {
+			return false, fmt.Errorf("error creating the search index triggers: %v", err)
+		}
+	}
+
+	// Index the submissions stored while the index was not maintained
+	if missing > 0 {
+		if _, err := db.Exec("INSERT INTO submissions_fts(submissions_fts) VALUES('rebuild')"); err != nil {
+			return false, fmt.Errorf("error building the search index: %v", err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,678 @@
+// app/submissions_store.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// SubmissionStore stores the form submissions
+type SubmissionStore interface {
+	// Create stores a new submission with its metadata and returns its ID
+	Create(s submission) (int64, error)
+	// Get returns a submission by ID with its metadata, or sql.ErrNoRows when it doesn't exist
+	Get(id int64) (submission, error)
+	// List returns a page of the submissions a user can view and the cursor of the next page, which is empty on the last page
+	List(u *user, f submissionFilter) ([]submission, string, error)
+	// Find returns the submissions matching a selector with their metadata, oldest first, and at most limit unless it is 0
+	Find(sel submissionSelector, limit int) ([]submission, error)
+	// Count returns the number of submissions matching a selector and of their uploaded files
+	Count(sel submissionSelector) (int, int, error)
+	// FormIDs returns the form of each of the submissions that exist
+	FormIDs(ids []int64) (map[int64]string, error)
+	// FormOfFile returns the form of the submission an uploaded file belongs to, or sql.ErrNoRows
+	FormOfFile(name string) (string, error)
+	// Update applies an update to submissions, all or none of them
+	Update(ids []int64, update submissionUpdate) error
+	// Trash moves the submissions matching a selector to the trash and returns how many were moved
+	Trash(sel submissionSelector) (int64, error)
+	// Purge permanently deletes the submissions matching a selector and returns how many were deleted and their uploaded files
+	Purge(sel submissionSelector) (int64, []string, error)
+	// Anonymize removes the personal data of the submissions matching a selector and returns how many were anonymized and their uploaded files
+	Anonymize(sel submissionSelector) (int64, []string, error)
+	// EncryptableValues returns the stored values of the encryptedColumns and the subject indexes of every submission
+	EncryptableValues() ([]storedValues, error)
+	// SetValues replaces stored values of submissions, all or none of them
+	SetValues(changes []valueChange) error
+}
+
+// submissionSelector selects the submissions to find, count, delete or
+// anonymize. Every condition that is set applies.
+type submissionSelector struct {
+	// A submission by ID
+	ID int64
+
+	// The submissions a user can view matching the filters of the submissions list
+	User   *user
+	Filter *submissionFilter
+
+	// The submissions of a form received before a time, and only those not anonymized yet
+	FormID        string
+	CreatedBefore time.Time
+	NotAnonymized bool
+
+	// The submissions moved to the trash before a time
+	DeletedBefore time.Time
+
+	// The submissions of a data subject in all forms, including the trash
+	Subject *dataSubject
+}
+
+// storedValues are the values of the encryptedColumns of a submission as they
+// are stored, and the indexes of its subjectIndexColumns
+type storedValues struct {
+	ID      int64
+	FormID  string
+	File    string
+	Values  []string
+	Indexes []string
+}
+
+// valueChange replaces the stored value of a column of a submission
+type valueChange struct {
+	ID     int64
+	Column string
+	Value  string
+}
+
+// sqlDialect adapts the SQL of the submissions store and of the migrations to a database
+type sqlDialect interface {
+	// Name of the database
+	name() string
+	// Directory of the embedded migrations of the database
+	migrations() string
+	// Create the schema_version table unless it exists
+	initSchemaVersion(db *sql.DB) error
+	// Replace the ? placeholders of a query with those of the database
+	rebind(query string) string
+	// Cast an expression to text
+	text(expr string) string
+	// Condition comparing a column with a placeholder, ignoring case
+	equalFold(column string) string
+	// Condition selecting the submissions with the tag of a placeholder
+	hasTag() string
+	// Condition and arguments selecting the submissions matching every word of a search
+	search(search string) (string, []interface{})
+	// Run an INSERT query and return the ID of the new row
+	insert(db *sql.DB, query string, args ...interface{}) (int64, error)
+}
+
+// Open the database of the submissions selected by SUBMISSIONS_DATABASE_URL, a
+// postgres:// or mysql:// URL, or the application database when it is not set
+func openSubmissionDatabase() (*sql.DB, sqlDialect, error) {
+	dsn := os.Getenv("SUBMISSIONS_DATABASE_URL")
+	if dsn == "" {
+		db, err := getDB()
+		return db, &sqliteDialect{}, err
+	}
+
+	var db *sql.DB
+	var dialect sqlDialect
+	var err error
+	scheme, _, _ := strings.Cut(dsn, "://")
+	switch scheme {
+	case "postgres", "postgresql":
+		db, err = sql.Open("postgres", dsn)
+		dialect = postgresDialect{}
+	case "mysql":
+		db, err = openMySQL(dsn)
+		dialect = mysqlDialect{}
+	default:
+		// The URL holds the password, so it is not repeated in the error
+		return nil, nil, fmt.Errorf("unsupported SUBMISSIONS_DATABASE_URL, use a postgres:// or mysql:// URL")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening %s database: %v", dialect.name(), err)
+	}
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("error connecting to %s database: %v", dialect.name(), err)
+	}
+	if _, ok := dialect.(mysqlDialect); ok {
+		if err := checkMySQLMode(db); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+	}
+	return db, dialect, nil
+}
+
+// Create the submission store selected by the SUBMISSIONS_DATABASE_URL
+// environment variable. Shared databases are migrated here, while the SQLite
+// database is migrated with the other tables by initDatabase.
+func newSubmissionStoreFromEnv() (SubmissionStore, error) {
+	db, dialect, err := openSubmissionDatabase()
+	if err != nil {
+		return nil, err
+	}
+	if sqlite, ok := dialect.(*sqliteDialect); ok {
+		// The search index depends on the SQLite build, so it is kept out of the migrations
+		if sqlite.fts, err = initSubmissionSearch(db); err != nil {
+			return nil, fmt.Errorf("error initializing submission search: %v", err)
+		}
+	} else {
+		if _, err := migrateUp(db, dialect); err != nil {
+			return nil, fmt.Errorf("error migrating %s database: %v", dialect.name(), err)
+		}
+		log.Infof("Storing submissions in the %s database", dialect.name())
+	}
+	return &sqlSubmissionStore{db: db, dialect: dialect}, nil
+}
+
+// sqlSubmissionStore stores the submissions in an SQL database
+type sqlSubmissionStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// Columns selected to scan a submission
+const submissionColumns = `id, form_id, name, email, message, file, "read", spam, starred, status, tags, created_at, deleted_at, anonymized_at`
+
+// Columns selected after submissionColumns to scan the metadata of a submission
+const submissionMetadataColumns = "ip, user_agent, referer, origin, accept_language, config_version, processing_ms"
+
+// Scan a row of submissionColumns, followed by the extra columns
+func scanSubmission(row interface{ Scan(...interface{}) error }, extra ...interface{}) (submission, error) {
+	var s submission
+	var tags string
+	var deletedAt, anonymizedAt sql.NullTime
+	dest := append([]interface{}{&s.ID, &s.FormID, &s.Name, &s.Email, &s.Message, &s.File, &s.Read, &s.Spam, &s.Starred, &s.Status, &tags, &s.CreatedAt, &deletedAt, &anonymizedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		if err == sql.ErrNoRows {
+			return s, err
+		}
+		return s, fmt.Errorf("error scanning submission: %v", err)
+	}
+	if err := json.Unmarshal([]byte(tags), &s.Tags); err != nil {
+		return s, fmt.Errorf("error decoding tags of submission %d: %v", s.ID, err)
+	}
+	for _, value := range []*string{&s.Name, &s.Email, &s.Message} {
+		decrypted, err := decryptValue(*value)
+		if err != nil {
+			return s, fmt.Errorf("error decrypting submission %d: %v", s.ID, err)
+		}
+		*value = decrypted
+	}
+	if deletedAt.Valid {
+		s.DeletedAt = &deletedAt.Time
+	}
+	if anonymizedAt.Valid {
+		s.AnonymizedAt = &anonymizedAt.Time
+	}
+	return s, nil
+}
+
+// Scan a row of submissionColumns followed by submissionMetadataColumns
+func scanSubmissionWithMetadata(row interface{ Scan(...interface{}) error }) (submission, error) {
+	var m submissionMetadata
+	s, err := scanSubmission(row, &m.IP, &m.UserAgent, &m.Referer, &m.Origin, &m.AcceptLanguage, &m.ConfigVersion, &m.ProcessingMS)
+	if err != nil {
+		return s, err
+	}
+	s.Metadata = &m
+	return s, nil
+}
+
+// Return the condition matching every word of a search in the name, email or
+// message with a LIKE operator
+func likeSearch(search, operator string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	for _, word := range strings.Fields(search) {
+		conditions = append(conditions, fmt.Sprintf(`(name %[1]s ? ESCAPE '\' OR email %[1]s ? ESCAPE '\' OR message %[1]s ? ESCAPE '\')`, operator))
+		pattern := likePattern(word)
+		args = append(args, pattern, pattern, pattern)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// Build the WHERE clause selecting the submissions of the forms a user can view
+func (s *sqlSubmissionStore) filterConditions(u *user, f submissionFilter) (string, []interface{}) {
+	conditions := []string{"deleted_at IS NULL"}
+	if f.Trash {
+		conditions[0] = "deleted_at IS NOT NULL"
+	}
+	var args []interface{}
+
+	if all, forms := u.formsWith(roleViewer); !all {
+		if len(forms) == 0 {
+			return "1 = 0", nil
+		}
+		conditions = append(conditions, "form_id IN ("+placeholders(len(forms))+")")
+		for _, formID := range forms {
+			args = append(args, formID)
+		}
+	}
+	if f.FormID != "" {
+		conditions = append(conditions, "form_id = ?")
+		args = append(args, f.FormID)
+	}
+
+	if !f.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, f.From.UTC().Format(sqliteTimestampFormat))
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, f.To.UTC().Format(sqliteTimestampFormat))
+	}
+	if f.Read != nil {
+		conditions = append(conditions, `"read" = ?`)
+		args = append(args, map[bool]string{true: "Y", false: "N"}[*f.Read])
+	}
+	if f.Spam != nil {
+		conditions = append(conditions, "spam = ?")
+		args = append(args, *f.Spam)
+	}
+	if f.Starred != nil {
+		conditions = append(conditions, "starred = ?")
+		args = append(args, *f.Starred)
+	}
+	if f.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, f.Status)
+	}
+	if f.Tag != "" {
+		conditions = append(conditions, s.dialect.hasTag())
+		args = append(args, f.Tag)
+	}
+	if f.Search != "" {
+		condition, searchArgs := s.dialect.search(f.Search)
+		conditions = append(conditions, condition)
+		args = append(args, searchArgs...)
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// Build the WHERE clause of a selector
+func (s *sqlSubmissionStore) conditions(sel submissionSelector) (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	if sel.ID != 0 {
+		conditions = append(conditions, "id = ?")
+		args = append(args, sel.ID)
+	}
+	if sel.Filter != nil {
+		where, filterArgs := s.filterConditions(sel.User, *sel.Filter)
+		conditions = append(conditions, where)
+		args = append(args, filterArgs...)
+	}
+	if sel.FormID != "" {
+		conditions = append(conditions, "form_id = ?")
+		args = append(args, sel.FormID)
+	}
+	if !sel.CreatedBefore.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, sel.CreatedBefore.UTC().Format(sqliteTimestampFormat))
+	}
+	if sel.NotAnonymized {
+		conditions = append(conditions, "anonymized_at IS NULL")
+	}
+	if !sel.DeletedBefore.IsZero() {
+		conditions = append(conditions, "deleted_at < ?")
+		args = append(args, sel.DeletedBefore.UTC().Format(sqliteTimestampFormat))
+	}
+	if sel.Subject != nil {
+		// Any of the identifiers matches. Encrypted names and email addresses
+		// are found by their subject index.
+		matches := []string{"1 = 0"}
+		identifiers := map[string]string{"name": sel.Subject.Name, "email": sel.Subject.Email}
+		for _, column := range subjectIndexColumns {
+			if identifiers[column] == "" {
+				continue
+			}
+			matches = append(matches, s.dialect.equalFold(column))
+			args = append(args, identifiers[column])
+			if indexes := subjectIndexes(identifiers[column]); len(indexes) > 0 {
+				matches = append(matches, column+"_hash IN ("+placeholders(len(indexes))+")")
+				for _, index := range indexes {
+					args = append(args, index)
+				}
+			}
+		}
+		if sel.Subject.IP != "" {
+			matches = append(matches, "ip = ?")
+			args = append(args, sel.Subject.IP)
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s *sqlSubmissionStore) Create(sub submission) (int64, error) {
+	m := sub.Metadata
+	if m == nil {
+		m = &submissionMetadata{}
+	}
+	tags, _ := json.Marshal(append([]string{}, sub.Tags...))
+	nameHash, err := storedSubjectIndex(sub.Name)
+	if err != nil {
+		return 0, err
+	}
+	emailHash, err := storedSubjectIndex(sub.Email)
+	if err != nil {
+		return 0, err
+	}
+	id, err := s.dialect.insert(s.db, `INSERT INTO submissions(form_id, name, email, message, file, "read", tags, created_at,
+        ip, user_agent, referer, origin, accept_language, config_version, processing_ms, name_hash, email_hash)
+        VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sub.FormID, sub.Name, sub.Email, sub.Message, sub.File, sub.Read, string(tags), time.Now().UTC().Format(sqliteTimestampFormat),
+		m.IP, m.UserAgent, m.Referer, m.Origin, m.AcceptLanguage, m.ConfigVersion, m.ProcessingMS, nameHash, emailHash)
+	if err != nil {
+		return 0, fmt.Errorf("error inserting submission: %v", err)
+	}
+	return id, nil
+}
+
+func (s *sqlSubmissionStore) Get(id int64) (submission, error) {
+	query := "SELECT " + submissionColumns + ", " + submissionMetadataColumns + " FROM submissions WHERE id = ?"
+	return scanSubmissionWithMetadata(s.db.QueryRow(s.dialect.rebind(query), id))
+}
+
+func (s *sqlSubmissionStore) List(u *user, f submissionFilter) ([]submission, string, error) {
+	where, args := s.filterConditions(u, f)
+
+	// Page with the sort value and the ID, which breaks ties
+	direction, compare := "ASC", ">"
+	if f.Desc {
+		direction, compare = "DESC", "<"
+	}
+	if f.Cursor != nil {
+		where += fmt.Sprintf(" AND (%s, id) %s (?, ?)", f.Sort, compare)
+		args = append(args, f.Cursor.Value, f.Cursor.ID)
+	}
+
+	query := fmt.Sprintf(`SELECT %s, %s
+        FROM submissions WHERE %s ORDER BY %s %s, id %s LIMIT ?`, submissionColumns, s.dialect.text(f.Sort), where, f.Sort, direction, direction)
+	args = append(args, f.Limit+1)
+
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("error querying submissions: %v", err)
+	}
+	defer rows.Close()
+
+	submissions := []submission{}
+	var last submissionCursor
+	for rows.Next() {
+		var sortValue string
+		sub, err := scanSubmission(rows, &sortValue)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(submissions) == f.Limit {
+			return submissions, encodeSubmissionCursor(last), nil
+		}
+		submissions = append(submissions, sub)
+		last = submissionCursor{Value: sortValue, ID: sub.ID}
+	}
+	return submissions, "", rows.Err()
+}
+
+func (s *sqlSubmissionStore) Find(sel submissionSelector, limit int) ([]submission, error) {
+	where, args := s.conditions(sel)
+	query := "SELECT " + submissionColumns + ", " + submissionMetadataColumns + " FROM submissions WHERE " + where + " ORDER BY created_at, id"
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying submissions: %v", err)
+	}
+	defer rows.Close()
+
+	submissions := []submission{}
+	for rows.Next() {
+		sub, err := scanSubmissionWithMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		submissions = append(submissions, sub)
+	}
+	return submissions, rows.Err()
+}
+
+func (s *sqlSubmissionStore) Count(sel submissionSelector) (int, int, error) {
+	where, args := s.conditions(sel)
+	var count, files int
+	err := s.db.QueryRow(s.dialect.rebind("SELECT COUNT(*), COUNT(NULLIF(file, '')) FROM submissions WHERE "+where), args...).Scan(&count, &files)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error counting submissions: %v", err)
+	}
+	return count, files, nil
+}
+
+func (s *sqlSubmissionStore) FormIDs(ids []int64) (map[int64]string, error) {
+	forms := map[int64]string{}
+	if len(ids) == 0 {
+		return forms, nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := s.db.Query(s.dialect.rebind("SELECT id, form_id FROM submissions WHERE id IN ("+placeholders(len(ids))+")"), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying submissions: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var formID string
+		if err := rows.Scan(&id, &formID); err != nil {
+			return nil, fmt.Errorf("error scanning submission: %v", err)
+		}
+		forms[id] = formID
+	}
+	return forms, rows.Err()
+}
+
+func (s *sqlSubmissionStore) FormOfFile(name string) (string, error) {
+	var formID string
+	err := s.db.QueryRow(s.dialect.rebind("SELECT form_id FROM submissions WHERE file = ? LIMIT 1"), name).Scan(&formID)
+	return formID, err
+}
+
+func (s *sqlSubmissionStore) Update(ids []int64, update submissionUpdate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if err := s.apply(tx, id, update); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing submission updates: %v", err)
+	}
+	return nil
+}
+
+// Apply an update to a submission
+func (s *sqlSubmissionStore) apply(tx *sql.Tx, id int64, u submissionUpdate) error {
+	var sets []string
+	var args []interface{}
+	if u.Read != nil {
+		sets = append(sets, `"read" = ?`)
+		args = append(args, map[bool]string{true: "Y", false: "N"}[*u.Read])
+	}
+	if u.Starred != nil {
+		sets = append(sets, "starred = ?")
+		args = append(args, *u.Starred)
+	}
+	if u.Spam != nil {
+		sets = append(sets, "spam = ?")
+		args = append(args, *u.Spam)
+	}
+	if u.Deleted != nil && *u.Deleted {
+		sets = append(sets, "deleted_at = COALESCE(deleted_at, ?)")
+		args = append(args, time.Now().UTC().Format(sqliteTimestampFormat))
+	}
+	if u.Deleted != nil && !*u.Deleted {
+		sets = append(sets, "deleted_at = NULL")
+	}
+	if u.Status != nil {
+		sets = append(sets, "status = ?")
+		args = append(args, *u.Status)
+	}
+
+	if u.changesTags() {
+		var stored []string
+		if u.Tags == nil {
+			var data string
+			if err := tx.QueryRow(s.dialect.rebind("SELECT tags FROM submissions WHERE id = ?"), id).Scan(&data); err != nil {
+				return fmt.Errorf("error querying tags of submission %d: %v", id, err)
+			}
+			if err := json.Unmarshal([]byte(data), &stored); err != nil {
+				return fmt.Errorf("error decoding tags of submission %d: %v", id, err)
+			}
+		}
+		tags, err := u.mergeTags(stored)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(tags)
+		sets = append(sets, "tags = ?")
+		args = append(args, string(data))
+	}
+
+	args = append(args, id)
+	if _, err := tx.Exec(s.dialect.rebind("UPDATE submissions SET "+strings.Join(sets, ", ")+" WHERE id = ?"), args...); err != nil {
+		return fmt.Errorf("error updating submission %d: %v", id, err)
+	}
+	return nil
+}
+
+func (s *sqlSubmissionStore) Trash(sel submissionSelector) (int64, error) {
+	where, args := s.conditions(sel)
+	result, err := s.db.Exec(s.dialect.rebind("UPDATE submissions SET deleted_at = ? WHERE deleted_at IS NULL AND "+where),
+		append([]interface{}{time.Now().UTC().Format(sqliteTimestampFormat)}, args...)...)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting submissions: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+// Return the uploaded files of the submissions matching a WHERE clause
+func (s *sqlSubmissionStore) files(tx *sql.Tx, where string, args []interface{}) ([]string, error) {
+	rows, err := tx.Query(s.dialect.rebind("SELECT file FROM submissions WHERE file != '' AND "+where), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying files of submissions: %v", err)
+	}
+	defer rows.Close()
+
+	var files []string
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			return nil, fmt.Errorf("error scanning file of submission: %v", err)
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+func (s *sqlSubmissionStore) Purge(sel submissionSelector) (int64, []string, error) {
+	where, args := s.conditions(sel)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	files, err := s.files(tx, where, args)
+	if err != nil {
+		return 0, nil, err
+	}
+	result, err := tx.Exec(s.dialect.rebind("DELETE FROM submissions WHERE "+where), args...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error deleting submissions: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("error committing deletion of submissions: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, files, nil
+}
+
+func (s *sqlSubmissionStore) Anonymize(sel submissionSelector) (int64, []string, error) {
+	where, args := s.conditions(sel)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	files, err := s.files(tx, where, args)
+	if err != nil {
+		return 0, nil, err
+	}
+	result, err := tx.Exec(s.dialect.rebind(`UPDATE submissions SET name = '', email = '', message = '', file = '',
+        name_hash = '', email_hash = '', ip = '', user_agent = '', referer = '', origin = '', accept_language = '', anonymized_at = ? WHERE `+where),
+		append([]interface{}{time.Now().UTC().Format(sqliteTimestampFormat)}, args...)...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error anonymizing submissions: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("error committing anonymization of submissions: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, files, nil
+}
+
+func (s *sqlSubmissionStore) EncryptableValues() ([]storedValues, error) {
+	indexColumns := make([]string, len(subjectIndexColumns))
+	for i, column := range subjectIndexColumns {
+		indexColumns[i] = column + "_hash"
+	}
+	rows, err := s.db.Query("SELECT id, form_id, file, " + strings.Join(encryptedColumns, ", ") + ", " + strings.Join(indexColumns, ", ") + " FROM submissions")
+	if err != nil {
+		return nil, fmt.Errorf("error querying submissions: %v", err)
+	}
+	defer rows.Close()
+
+	var stored []storedValues
+	for rows.Next() {
+		v := storedValues{Values: make([]string, len(encryptedColumns)), Indexes: make([]string, len(subjectIndexColumns))}
+		dest := []interface{}{&v.ID, &v.FormID, &v.File}
+		for i := range v.Values {
+			dest = append(dest, &v.Values[i])
+		}
+		for i := range v.Indexes {
+			dest = append(dest, &v.Indexes[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("error scanning submission: %v", err)
+		}
+		stored = append(stored, v)
+	}
+	return stored, rows.Err()
+}
+
+func (s *sqlSubmissionStore) SetValues(changes []valueChange) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for _, c := range changes {
+		if _, err := tx.Exec(s.dialect.rebind("UPDATE submissions SET "+c.Column+" = ? WHERE id = ?"), c.Value, c.ID); err != nil {
+			return fmt.Errorf("error updating submission %d: %v", c.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing submission changes: %v", err)
+	}
+	return nil
+}
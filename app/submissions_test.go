@@ -0,0 +1,132 @@
+// app/submissions_test.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Send a request with a JSON body as the given user to a handler
+func serveAs(u *user, handler http.HandlerFunc, method, target, body string, vars map[string]string) *httptest.ResponseRecorder {
+	r := withUser(httptest.NewRequest(method, target, strings.NewReader(body)), u)
+	if vars != nil {
+		r = mux.SetURLVars(r, vars)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestUpdateSubmissionHandler(t *testing.T) {
+	useTestSubmissionStore(t)
+	contact, err := submissionStore.Create(submission{FormID: "contact", Name: "Alice", Read: "N"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	support, err := submissionStore.Create(submission{FormID: "support", Name: "Bob", Read: "N"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor := &user{ID: 1, Username: "editor", Grants: map[string]string{"contact": roleEditor, "support": roleViewer}}
+	tooMany := make([]string, maxSubmissionTags+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("tag%d", i)
+	}
+	tooManyTags, _ := json.Marshal(map[string][]string{"tags": tooMany})
+
+	tests := []struct {
+		name     string
+		id       int64
+		body     string
+		wantCode int
+	}{
+		{"change everything", contact, `{"read": true, "starred": true, "status": "done", "tags": [" urgent ", "urgent", ""], "add_tags": ["billing"]}`, http.StatusOK},
+		{"invalid status", contact, `{"status": "closed"}`, http.StatusBadRequest},
+		{"nothing to update", contact, `{}`, http.StatusBadRequest},
+		{"only empty tags", contact, `{"add_tags": [" "]}`, http.StatusBadRequest},
+		{"long tag", contact, `{"add_tags": ["` + strings.Repeat("x", maxTagLength+1) + `"]}`, http.StatusBadRequest},
+		{"too many tags", contact, string(tooManyTags), http.StatusBadRequest},
+		{"invalid body", contact, `{"read": "yes"}`, http.StatusBadRequest},
+		{"unknown submission", 999, `{"read": true}`, http.StatusNotFound},
+		{"viewers can mark read", support, `{"read": true}`, http.StatusOK},
+		{"viewers can't star", support, `{"starred": true}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := serveAs(editor, updateSubmissionHandler, http.MethodPatch, "/api/submissions/1", tt.body, map[string]string{"id": fmt.Sprint(tt.id)})
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: response %d %s, want %d", tt.name, w.Code, w.Body, tt.wantCode)
+		}
+	}
+
+	// Rejected updates changed nothing
+	s, err := submissionStore.Get(contact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Read != "Y" || !s.Starred || s.Status != "done" || strings.Join(s.Tags, ",") != "urgent,billing" {
+		t.Errorf("submission after the updates = %+v", s)
+	}
+	if s, _ := submissionStore.Get(support); s.Read != "Y" || s.Starred {
+		t.Errorf("submission the viewer updated = %+v", s)
+	}
+
+	// A bulk update is applied to all submissions or none of them
+	w := serveAs(editor, bulkUpdateSubmissionsHandler, http.MethodPatch, "/api/submissions", fmt.Sprintf(`{"ids": [%d, %d], "status": "archived"}`, contact, support), nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("bulk update of a form the user views: response %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if s, _ := submissionStore.Get(contact); s.Status != "done" {
+		t.Errorf("status after the refused bulk update = %q", s.Status)
+	}
+}
+
+func TestSubmissionMetadata(t *testing.T) {
+	useTestSubmissionStore(t)
+	metadata := submissionMetadata{
+		IP:             "192.0.2.7",
+		UserAgent:      "Mozilla/5.0",
+		Referer:        "https://example.com/contact",
+		Origin:         "https://example.com",
+		AcceptLanguage: "en-GB",
+		ConfigVersion:  "a1b2c3d4e5f6",
+		ProcessingMS:   1.5,
+	}
+	id, err := submissionStore.Create(submission{FormID: "contact", Name: "Alice", Read: "N", Metadata: &metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viewer := &user{ID: 1, Username: "viewer", Grants: map[string]string{"contact": roleViewer}}
+	w := serveAs(viewer, apiSubmissionHandler, http.MethodGet, "/api/submissions/1", "", map[string]string{"id": fmt.Sprint(id)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("response %d %s", w.Code, w.Body)
+	}
+	var got submission
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Metadata == nil || *got.Metadata != metadata {
+		t.Errorf("metadata = %+v, want %+v", got.Metadata, metadata)
+	}
+
+	// The metadata is only shown to users who can view the form
+	other := &user{ID: 2, Username: "other", Grants: map[string]string{"support": roleOwner}}
+	if w := serveAs(other, apiSubmissionHandler, http.MethodGet, "/api/submissions/1", "", map[string]string{"id": fmt.Sprint(id)}); w.Code != http.StatusForbidden {
+		t.Errorf("submission of another form: response %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// The list leaves the metadata out
+	page, _, err := submissionStore.List(viewer, submissionFilter{Sort: "created_at", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Metadata != nil {
+		t.Errorf("listed submissions = %+v, want one without metadata", page)
+	}
+}
@@ -0,0 +1,548 @@
+// app/totp.go
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Issuer shown in authenticator apps
+	totpIssuer = "Form Handler"
+	// Number of recovery codes generated at once
+	recoveryCodeCount = 10
+	// Time a user has to enter their code after entering their password
+	twoFactorLoginTimeout = 5 * time.Minute
+	// Wrong codes accepted before the password has to be entered again
+	twoFactorMaxAttempts = 5
+)
+
+// Errors returned by the two-factor functions
+var (
+	errInvalidCode          = errors.New("invalid code")
+	errTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	errTwoFactorNotEnrolled = errors.New("two-factor authentication has not been set up")
+)
+
+// Options of the codes, the defaults of most authenticator apps
+var totpOptions = totp.ValidateOpts{
+	Period:    30,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// Paths a user who must set up two-factor authentication can still access
+var twoFactorSetupPaths = map[string]bool{
+	"/account/2fa":            true,
+	"/api/account":            true,
+	"/api/account/2fa":        true,
+	"/api/account/2fa/setup":  true,
+	"/api/account/2fa/enable": true,
+	"/account/password":       true,
+	"/api/account/password":   true,
+}
+
+// Generate a new secret for a user and store it until enrollment is confirmed,
+// returning the key to show to the user
+func setupTOTP(u *user) (*otp.Key, error) {
+	if u.TOTPEnabled {
+		return nil, errTwoFactorEnabled
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: u.Username,
+		Period:      totpOptions.Period,
+		Digits:      totpOptions.Digits,
+		Algorithm:   totpOptions.Algorithm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error generating secret: %v", err)
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	_, err = db.Exec(`INSERT INTO totp_credentials(user_id, secret, enabled, last_step, created_at) VALUES(?, ?, 0, 0, ?)
+        ON CONFLICT(user_id) DO UPDATE SET secret = excluded.secret, enabled = 0, last_step = 0, created_at = excluded.created_at`,
+		u.ID, key.Secret(), time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error storing secret: %v", err)
+	}
+	return key, nil
+}
+
+// Check a code against the secret of a user, rejecting codes that were already used
+func verifyTOTP(userID int64, code string) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+
+	var secret string
+	var lastStep int64
+	err = db.QueryRow("SELECT secret, last_step FROM totp_credentials WHERE user_id = ?", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return errTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return fmt.Errorf("error querying secret: %v", err)
+	}
+
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	now := time.Now()
+	for _, skew := range []int64{0, -1, 1} {
+		step := now.Unix()/int64(totpOptions.Period) + skew
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*int64(totpOptions.Period), 0), totpOptions)
+		if err != nil {
+			return fmt.Errorf("error generating code: %v", err)
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) != 1 {
+			continue
+		}
+		if step <= lastStep {
+			return errInvalidCode
+		}
+		result, err := db.Exec("UPDATE totp_credentials SET last_step = ? WHERE user_id = ? AND last_step < ?", step, userID, step)
+		if err != nil {
+			return fmt.Errorf("error updating last code: %v", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errInvalidCode
+		}
+		return nil
+	}
+	return errInvalidCode
+}
+
+// Confirm enrollment with a code from the authenticator app and return new recovery codes
+func enableTOTP(u *user, code string) ([]string, error) {
+	if u.TOTPEnabled {
+		return nil, errTwoFactorEnabled
+	}
+	if err := verifyTOTP(u.ID, code); err != nil {
+		return nil, err
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	if _, err := db.Exec("UPDATE totp_credentials SET enabled = 1 WHERE user_id = ?", u.ID); err != nil {
+		return nil, fmt.Errorf("error enabling two-factor authentication: %v", err)
+	}
+	return generateRecoveryCodes(u.ID)
+}
+
+// Remove the two-factor credentials and recovery codes of a user
+func disableTOTP(userID int64) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM totp_credentials WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting secret: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting recovery codes: %v", err)
+	}
+	return nil
+}
+
+// Normalize a recovery code, ignoring case, spaces and dashes
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// Hash a recovery code with bcrypt, like the passwords
+func hashRecoveryCode(code string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(normalizeRecoveryCode(code)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("error hashing recovery code: %v", err)
+	}
+	return string(hash), nil
+}
+
+// Check a recovery code against its hash
+func recoveryCodeMatches(hash, code string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(normalizeRecoveryCode(code))) == nil
+}
+
+// Replace the recovery codes of a user and return the new codes
+func generateRecoveryCodes(userID int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("error generating recovery code: %v", err)
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hash, err := hashRecoveryCode(codes[i])
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, fmt.Errorf("error deleting recovery codes: %v", err)
+	}
+	for _, hash := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes(user_id, code_hash) VALUES(?, ?)", userID, hash); err != nil {
+			return nil, fmt.Errorf("error inserting recovery code: %v", err)
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// Use up a recovery code of a user
+func useRecoveryCode(userID int64, code string) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	rows, err := db.Query("SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID)
+	if err != nil {
+		return fmt.Errorf("error querying recovery codes: %v", err)
+	}
+	defer rows.Close()
+
+	var matched int64
+	for rows.Next() {
+		var id int64
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return fmt.Errorf("error scanning recovery code: %v", err)
+		}
+		if recoveryCodeMatches(hash, code) {
+			matched = id
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading recovery codes: %v", err)
+	}
+	rows.Close()
+	if matched == 0 {
+		return errInvalidCode
+	}
+
+	// A code used by a concurrent login is not accepted twice
+	result, err := db.Exec("UPDATE recovery_codes SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now().UTC(), matched)
+	if err != nil {
+		return fmt.Errorf("error using recovery code: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errInvalidCode
+	}
+	return nil
+}
+
+// Count the unused recovery codes of a user
+func remainingRecoveryCodes(userID int64) (int, error) {
+	db, err := getDB()
+	if err != nil {
+		return 0, fmt.Errorf("error opening database: %v", err)
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// Check whether a user must set up two-factor authentication before using the admin panel
+func needsTwoFactorSetup(u *user) bool {
+	// Single sign-on users are authenticated by the identity provider
+	if u.TOTPEnabled || u.SSO {
+		return false
+	}
+	required, err := twoFactorRequired()
+	if err != nil {
+		log.Errorf("Error reading the two-factor setting: %v", err)
+		return false
+	}
+	return required
+}
+
+// Handler for the second login step of users with two-factor authentication
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "session-name")
+	userID, _ := session.Values["pending_user_id"].(int64)
+	pendingAt, _ := session.Values["pending_at"].(int64)
+	if userID == 0 || time.Since(time.Unix(pendingAt, 0)) > twoFactorLoginTimeout {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.ServeFile(w, r, "/app/backend/login_2fa.html")
+		return
+	}
+
+	u, err := getUserByID(userID)
+	if err == sql.ErrNoRows {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error loading user %d: %v", userID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if !checkLoginAllowed(w, r, u.Username) {
+		return
+	}
+
+	code := r.FormValue("code")
+	action := "user.login"
+	if r.FormValue("recovery") != "" {
+		err = useRecoveryCode(u.ID, code)
+		action = "user.login_recovery_code"
+	} else {
+		err = verifyTOTP(u.ID, code)
+	}
+	if err == errInvalidCode || err == errTwoFactorNotEnrolled {
+		recordLoginFailure(r, u.Username)
+		recordAuditAs(r, u.Username, "user.login_2fa_failed", u.Username)
+		attempts, _ := session.Values["pending_attempts"].(int)
+		session.Values["pending_attempts"] = attempts + 1
+		if attempts+1 >= twoFactorMaxAttempts {
+			clearPendingLogin(session)
+		}
+		if err := session.Save(r, w); err != nil {
+			log.Errorf("Error saving session: %v", err)
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error verifying code of user %d: %v", u.ID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	clearPendingLogin(session)
+	if err := startSession(w, r, session, u); err != nil {
+		log.Errorf("Error saving session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := loginGuard.recordSuccess(u.Username); err != nil {
+		log.Errorf("Error resetting failed logins: %v", err)
+	}
+	recordAuditAs(r, u.Username, action, u.Username)
+	if u.MustReset {
+		http.Redirect(w, r, "/account/password", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/submissions", http.StatusFound)
+}
+
+// Remove the state of a login waiting for the second step from the session
+func clearPendingLogin(session *sessions.Session) {
+	delete(session.Values, "pending_user_id")
+	delete(session.Values, "pending_at")
+	delete(session.Values, "pending_attempts")
+}
+
+// Handler to view the two-factor authentication page
+func viewTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/two_factor.html")
+}
+
+// API handler to fetch the two-factor status of the current user
+func apiTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	required, err := twoFactorRequired()
+	if err != nil {
+		log.Errorf("Error reading the two-factor setting: %v", err)
+		jsonError(w, "Could not read settings", http.StatusInternalServerError)
+		return
+	}
+	remaining, err := remainingRecoveryCodes(u.ID)
+	if err != nil {
+		log.Errorf("Error counting recovery codes: %v", err)
+		jsonError(w, "Could not count recovery codes", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  u.TOTPEnabled,
+		"required":                 required,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// API handler to start two-factor enrollment, returning the secret and a QR code of the provisioning URI
+func setupTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := setupTOTP(currentUser(r))
+	if err == errTwoFactorEnabled {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error setting up two-factor authentication: %v", err)
+		jsonError(w, "Could not set up two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		log.Errorf("Error generating QR code: %v", err)
+		jsonError(w, "Could not generate QR code", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		log.Errorf("Error encoding QR code: %v", err)
+		jsonError(w, "Could not generate QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":  key.Secret(),
+		"uri":     key.URL(),
+		"qr_code": "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	})
+}
+
+// API handler to confirm two-factor enrollment with a code
+func enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := enableTOTP(currentUser(r), request.Code)
+	if err == errInvalidCode || err == errTwoFactorEnabled || err == errTwoFactorNotEnrolled {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error enabling two-factor authentication: %v", err)
+		jsonError(w, "Could not enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "user.2fa_enabled", currentUser(r).Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// Check the password of the current user sent in a JSON body, writing an error response on failure
+func confirmPassword(w http.ResponseWriter, r *http.Request) bool {
+	var request struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	u := currentUser(r)
+	if _, err := authenticateUser(u.Username, request.Password); err != nil {
+		if err != errInvalidCredentials {
+			log.Errorf("Error authenticating user: %v", err)
+		}
+		jsonError(w, "Password is incorrect", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// API handler to turn off two-factor authentication for the current user
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	required, err := twoFactorRequired()
+	if err != nil {
+		log.Errorf("Error reading the two-factor setting: %v", err)
+		jsonError(w, "Could not read settings", http.StatusInternalServerError)
+		return
+	}
+	if required {
+		jsonError(w, "Two-factor authentication is required for all users", http.StatusBadRequest)
+		return
+	}
+	if !confirmPassword(w, r) {
+		return
+	}
+
+	u := currentUser(r)
+	if err := disableTOTP(u.ID); err != nil {
+		log.Errorf("Error disabling two-factor authentication: %v", err)
+		jsonError(w, "Could not disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "user.2fa_disabled", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API handler to replace the recovery codes of the current user
+func regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if !u.TOTPEnabled {
+		jsonError(w, errTwoFactorNotEnrolled.Error(), http.StatusBadRequest)
+		return
+	}
+	if !confirmPassword(w, r) {
+		return
+	}
+
+	codes, err := generateRecoveryCodes(u.ID)
+	if err != nil {
+		log.Errorf("Error generating recovery codes: %v", err)
+		jsonError(w, "Could not generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r, "user.recovery_codes_regenerated", u.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// API handler to remove two-factor authentication of a user who lost their device (admin)
+func resetUserTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := disableTOTP(u.ID); err != nil {
+		log.Errorf("Error resetting two-factor authentication: %v", err)
+		jsonError(w, "Could not reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	// Tokens created with the lost device are revoked with it
+	if err := deleteUserAPITokens(u.ID); err != nil {
+		log.Errorf("Error revoking API tokens of user %d: %v", u.ID, err)
+	}
+	recordAudit(r, "user.2fa_reset", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
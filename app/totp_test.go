@@ -0,0 +1,152 @@
+// app/totp_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// Set up two-factor authentication for a user and return its secret
+func enrollTestTOTP(t *testing.T, u *user) string {
+	t.Helper()
+	key, err := setupTOTP(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.Secret()
+}
+
+// Wait for the start of a period when the current one ends soon, so that the
+// codes of a test are generated and checked in the same period
+func waitForTOTPPeriod() {
+	if left := int64(totpOptions.Period) - time.Now().Unix()%int64(totpOptions.Period); left <= 2 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+}
+
+// Return a code that differs from the given one in every digit
+func wrongTOTPCode(code string) string {
+	wrong := []byte(code)
+	for i, c := range wrong {
+		wrong[i] = '0' + (c-'0'+5)%10
+	}
+	return string(wrong)
+}
+
+// Return the code of a secret for the period at an offset from now
+func totpCodeAt(t *testing.T, secret string, offset int) string {
+	t.Helper()
+	at := time.Now().Add(time.Duration(offset*int(totpOptions.Period)) * time.Second)
+	code, err := totp.GenerateCodeCustom(secret, at, totpOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	useTestDB(t)
+	u := &user{ID: 1, Username: "alice"}
+	secret := enrollTestTOTP(t, u)
+	waitForTOTPPeriod()
+
+	if err := verifyTOTP(2, totpCodeAt(t, secret, 0)); err != errTwoFactorNotEnrolled {
+		t.Errorf("code of a user without two-factor authentication: err = %v, want %v", err, errTwoFactorNotEnrolled)
+	}
+
+	tests := []struct {
+		name string
+		code string
+		want error
+	}{
+		{"wrong code", wrongTOTPCode(totpCodeAt(t, secret, 0)), errInvalidCode},
+		{"code of the previous period", totpCodeAt(t, secret, -1), nil},
+		{"code of two periods ago", totpCodeAt(t, secret, -2), errInvalidCode},
+		{"current code with spaces", " " + totpCodeAt(t, secret, 0)[:3] + " " + totpCodeAt(t, secret, 0)[3:], nil},
+		{"current code replayed", totpCodeAt(t, secret, 0), errInvalidCode},
+		{"code of the previous period after a newer one", totpCodeAt(t, secret, -1), errInvalidCode},
+		{"code of the next period", totpCodeAt(t, secret, 1), nil},
+		{"code of the next period replayed", totpCodeAt(t, secret, 1), errInvalidCode},
+	}
+	for _, tt := range tests {
+		if err := verifyTOTP(u.ID, tt.code); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestEnableTOTP(t *testing.T) {
+	useTestDB(t)
+	u := &user{ID: 1, Username: "alice"}
+	secret := enrollTestTOTP(t, u)
+	waitForTOTPPeriod()
+
+	if _, err := enableTOTP(u, wrongTOTPCode(totpCodeAt(t, secret, 0))); err != errInvalidCode {
+		t.Fatalf("enabling with a wrong code: err = %v, want %v", err, errInvalidCode)
+	}
+	codes, err := enableTOTP(u, totpCodeAt(t, secret, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("%d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// The code that confirmed enrollment can't be used to log in
+	if err := verifyTOTP(u.ID, totpCodeAt(t, secret, 0)); err != errInvalidCode {
+		t.Errorf("enrollment code reused: err = %v, want %v", err, errInvalidCode)
+	}
+
+	u.TOTPEnabled = true
+	if _, err := setupTOTP(u); err != errTwoFactorEnabled {
+		t.Errorf("setting up again: err = %v, want %v", err, errTwoFactorEnabled)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	testDB := useTestDB(t)
+	codes, err := generateRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hash string
+	if err := testDB.QueryRow("SELECT code_hash FROM recovery_codes WHERE user_id = 1 LIMIT 1").Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$2") {
+		t.Errorf("recovery code stored as %q, want a bcrypt hash", hash)
+	}
+
+	tests := []struct {
+		name   string
+		userID int64
+		code   string
+		want   error
+	}{
+		{"unknown code", 1, "aaaa-aaaa", errInvalidCode},
+		{"code of another user", 2, codes[0], errInvalidCode},
+		{"code in capitals without dash", 1, strings.ToUpper(strings.ReplaceAll(codes[0], "-", "")), nil},
+		{"used code", 1, codes[0], errInvalidCode},
+		{"other code", 1, codes[1], nil},
+	}
+	for _, tt := range tests {
+		if err := useRecoveryCode(tt.userID, tt.code); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+	if remaining, _ := remainingRecoveryCodes(1); remaining != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes remaining, want %d", remaining, recoveryCodeCount-2)
+	}
+
+	// Regenerating replaces the unused codes
+	if _, err := generateRecoveryCodes(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := useRecoveryCode(1, codes[2]); err != errInvalidCode {
+		t.Errorf("replaced code: err = %v, want %v", err, errInvalidCode)
+	}
+}
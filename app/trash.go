@@ -0,0 +1,115 @@
+// app/trash.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Days deleted submissions stay in the trash by default before they are purged
+const defaultTrashRetentionDays = 30
+
+// Return the number of days deleted submissions stay in the trash
+func trashRetentionDays() (int, error) {
+	value, err := getSetting(settingTrashRetentionDays, strconv.Itoa(defaultTrashRetentionDays))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Permanently delete the submissions matching a selector together with their
+// uploaded files, and return how many were deleted
+func purgeSubmissions(sel submissionSelector) (int64, error) {
+	n, files, err := submissionStore.Purge(sel)
+	if err != nil {
+		return 0, err
+	}
+
+	// Files are removed after the rows, so a failure leaves an orphaned file
+	// rather than a submission pointing to a missing one
+	for _, file := range files {
+		removeUpload(file)
+	}
+	return n, nil
+}
+
+// Purge the submissions that have been in the trash longer than the retention
+func purgeExpiredTrash() error {
+	days, err := trashRetentionDays()
+	if err != nil {
+		return err
+	}
+	n, err := purgeSubmissions(submissionSelector{DeletedBefore: time.Now().UTC().AddDate(0, 0, -days)})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Infof("Purged %d submissions deleted more than %d days ago", n, days)
+	}
+	return nil
+}
+
+// Report whether a filter narrows the submissions down, rather than matching
+// all of them
+func (f submissionFilter) narrows() bool {
+	return f.FormID != "" || !f.From.IsZero() || !f.To.IsZero() || f.Read != nil || f.Spam != nil ||
+		f.Starred != nil || f.Status != "" || f.Tag != "" || f.Search != "" || f.Trash
+}
+
+// API handler to delete all submissions matching the filters of the submissions
+// list. They are moved to the trash, or purged with permanent=true. Deleting
+// every submission takes all=true, so a request missing its filters doesn't.
+func deleteSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseSubmissionFilter(query)
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	all, err := parseBoolFilter(query, "all")
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !filter.narrows() && (all == nil || !*all) {
+		jsonError(w, "Give a filter, or all=true to delete all submissions", http.StatusBadRequest)
+		return
+	}
+	permanent, err := parseBoolFilter(query, "permanent")
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeScope(w, r, roleEditor, filter.FormID) {
+		return
+	}
+
+	sel := submissionSelector{User: currentUser(r), Filter: &filter}
+	scope := filter.FormID
+	if scope == "" {
+		scope = allForms
+	}
+	var n int64
+	if permanent != nil && *permanent {
+		if n, err = purgeSubmissions(sel); err != nil {
+			log.Errorf("Error purging submissions: %v", err)
+			jsonError(w, "Could not delete submissions", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "submission.purge", fmt.Sprintf("%d submissions of form %s", n, scope))
+	} else {
+		if n, err = submissionStore.Trash(sel); err != nil {
+			log.Errorf("Error deleting submissions: %v", err)
+			jsonError(w, "Could not delete submissions", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, "submission.delete", fmt.Sprintf("%d submissions of form %s", n, scope))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"deleted": n})
+}
@@ -0,0 +1,110 @@
+// app/trash_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteSubmissionsHandler(t *testing.T) {
+	useTestSubmissionStore(t)
+	for _, formID := range []string{"contact", "contact", "support"} {
+		if _, err := submissionStore.Create(submission{FormID: formID, Name: "Alice", Read: "N"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner := &user{ID: 1, Username: "owner", Grants: map[string]string{"*": roleOwner}}
+	remaining := func() int {
+		t.Helper()
+		count, _, err := submissionStore.Count(submissionSelector{Filter: &submissionFilter{}, User: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	tests := []struct {
+		query      string
+		wantCode   int
+		wantBody   string
+		wantRemain int
+	}{
+		// Without a filter nothing is deleted
+		{"", http.StatusBadRequest, "all=true", 3},
+		{"?permanent=true", http.StatusBadRequest, "all=true", 3},
+		{"?all=false", http.StatusBadRequest, "all=true", 3},
+		{"?all=yes", http.StatusBadRequest, "all", 3},
+		{"?form_id=contact", http.StatusOK, `{"deleted":2}`, 1},
+		{"?all=true", http.StatusOK, `{"deleted":1}`, 0},
+	}
+	for _, tt := range tests {
+		r := withUser(httptest.NewRequest(http.MethodDelete, "/api/submissions"+tt.query, nil), owner)
+		w := httptest.NewRecorder()
+		deleteSubmissionsHandler(w, r)
+		if w.Code != tt.wantCode || !strings.Contains(w.Body.String(), tt.wantBody) {
+			t.Errorf("%q: response %d %s, want %d with %s", tt.query, w.Code, w.Body, tt.wantCode, tt.wantBody)
+		}
+		if got := remaining(); got != tt.wantRemain {
+			t.Errorf("%q: %d submissions remain, want %d", tt.query, got, tt.wantRemain)
+		}
+	}
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	useTestSubmissionStore(t)
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, err := submissionStore.Create(submission{FormID: "contact", Name: "Alice", Read: "N"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	trashed := func() []int64 {
+		t.Helper()
+		found, err := submissionStore.Find(submissionSelector{Filter: &submissionFilter{Trash: true}, User: &user{Grants: map[string]string{"*": roleViewer}}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, s := range found {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+
+	deleted, restored := true, false
+	if err := submissionStore.Update(ids, submissionUpdate{Deleted: &deleted}); err != nil {
+		t.Fatal(err)
+	}
+	if got := trashed(); len(got) != 3 {
+		t.Fatalf("%d submissions in the trash, want 3", len(got))
+	}
+	if err := submissionStore.Update(ids[:1], submissionUpdate{Deleted: &restored}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := submissionStore.Get(ids[0]); err != nil || s.DeletedAt != nil {
+		t.Errorf("restored submission: deleted at %v, %v", s.DeletedAt, err)
+	}
+
+	// Only the submissions in the trash longer than the retention are purged
+	old := time.Now().UTC().AddDate(0, 0, -defaultTrashRetentionDays-1).Format(sqliteTimestampFormat)
+	if _, err := db.Exec("UPDATE submissions SET deleted_at = ? WHERE id = ?", old, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := purgeExpiredTrash(); err != nil {
+		t.Fatal(err)
+	}
+	if got := trashed(); len(got) != 1 || got[0] != ids[2] {
+		t.Errorf("submissions in the trash after the purge = %v, want [%d]", got, ids[2])
+	}
+	if _, err := submissionStore.Get(ids[1]); err == nil {
+		t.Error("expired submission can still be read")
+	}
+	if _, err := submissionStore.Get(ids[0]); err != nil {
+		t.Errorf("restored submission after the purge: %v", err)
+	}
+}
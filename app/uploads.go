@@ -0,0 +1,143 @@
+// app/uploads.go
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the signed links to uploaded files in exports stay valid, from UPLOAD_LINK_LIFETIME
+var signedUploadLifetime = 24 * time.Hour
+
+// Key signing the links to uploaded files, derived from the session secret
+var uploadSigningKey []byte
+
+// Base URL of the signed links, from PUBLIC_URL. Without it exports contain
+// only the file names, as the Host header of the request can't be trusted.
+var publicBaseURL string
+
+// Derive the key signing links to uploaded files from the session secret and
+// read PUBLIC_URL and UPLOAD_LINK_LIFETIME. Links signed before the secret is
+// rotated stop working.
+func initUploadSigning(secret string) error {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("form-handler uploads"))
+	uploadSigningKey = mac.Sum(nil)
+
+	if value := os.Getenv("PUBLIC_URL"); value != "" {
+		base, err := url.Parse(value)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+			return fmt.Errorf("invalid PUBLIC_URL: %q", value)
+		}
+		publicBaseURL = strings.TrimSuffix(value, "/")
+	}
+	if value := os.Getenv("UPLOAD_LINK_LIFETIME"); value != "" {
+		lifetime, err := time.ParseDuration(value)
+		if err != nil || lifetime <= 0 {
+			return fmt.Errorf("invalid UPLOAD_LINK_LIFETIME: %q", value)
+		}
+		signedUploadLifetime = lifetime
+	}
+	return nil
+}
+
+// Return the signature of a link to an uploaded file valid until expires
+func uploadSignature(name string, expires int64) string {
+	mac := hmac.New(sha256.New, uploadSigningKey)
+	fmt.Fprintf(mac, "%s\n%d", name, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Return a link to an uploaded file that works without logging in until it
+// expires, or the file name if PUBLIC_URL is not set
+func signedUploadURL(name string) string {
+	if publicBaseURL == "" {
+		return name
+	}
+	expires := time.Now().Add(signedUploadLifetime).Unix()
+	return fmt.Sprintf("%s/uploads/%s?expires=%d&signature=%s",
+		publicBaseURL, url.PathEscape(name), expires, uploadSignature(name, expires))
+}
+
+// Check the signature and expiry of a link to an uploaded file
+func validUploadSignature(name string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := uploadSignature(name, expires)
+	return hmac.Equal([]byte(query.Get("signature")), []byte(expected))
+}
+
+// Send an uploaded file as a download, so files uploaded through a form are
+// never rendered by the browser on the admin origin. Encrypted files are
+// decrypted.
+func serveUpload(w http.ResponseWriter, r *http.Request, name string) {
+	info, err := os.Stat(filepath.Join("/app/uploads", name))
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	var data []byte
+	if err == nil {
+		data, err = readUpload(name)
+	}
+	if err != nil {
+		log.Errorf("Error reading uploaded file %s: %v", name, err)
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+}
+
+// Delete an uploaded file from storage
+func removeUpload(name string) {
+	err := os.Remove(filepath.Join("/app/uploads", filepath.Base(name)))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error deleting uploaded file %s: %v", name, err)
+	}
+}
+
+// Handler serving uploaded files to requests with a valid signed link, or to
+// users who can view the submission the file belongs to
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		http.NotFound(w, r)
+		return
+	}
+	if validUploadSignature(name, r.URL.Query()) {
+		serveUpload(w, r, name)
+		return
+	}
+
+	authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		formID, err := submissionStore.FormOfFile(name)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Errorf("Error querying submission of file: %v", err)
+			http.Error(w, "Could not query the database", http.StatusInternalServerError)
+			return
+		}
+		if !authorizeForm(w, r, roleViewer, formID) {
+			return
+		}
+		serveUpload(w, r, name)
+	})).ServeHTTP(w, r)
+}
@@ -0,0 +1,65 @@
+// app/uploads_test.go
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInitUploadSigning(t *testing.T) {
+	tests := []struct {
+		publicURL, lifetime string
+		wantErr             bool
+	}{
+		{"https://forms.example.com/", "", false},
+		{"", "1h", false},
+		{"forms.example.com", "", true},
+		{"javascript:alert(1)", "", true},
+		{"https://", "", true},
+		{"", "forever", true},
+		{"", "-1h", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("PUBLIC_URL", tt.publicURL)
+		t.Setenv("UPLOAD_LINK_LIFETIME", tt.lifetime)
+		publicBaseURL, signedUploadLifetime = "", 24*time.Hour
+		if err := initUploadSigning("secret"); (err != nil) != tt.wantErr {
+			t.Errorf("PUBLIC_URL %q and UPLOAD_LINK_LIFETIME %q: error %v, want error %t", tt.publicURL, tt.lifetime, err, tt.wantErr)
+		}
+	}
+	t.Cleanup(func() { publicBaseURL, signedUploadLifetime = "", 24*time.Hour })
+}
+
+func TestSignedUploadURL(t *testing.T) {
+	t.Setenv("PUBLIC_URL", "")
+	t.Setenv("UPLOAD_LINK_LIFETIME", "")
+	if err := initUploadSigning("secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got := signedUploadURL("file.pdf"); got != "file.pdf" {
+		t.Errorf("link without PUBLIC_URL = %q, want the file name", got)
+	}
+
+	publicBaseURL = "https://forms.example.com"
+	t.Cleanup(func() { publicBaseURL = "" })
+	link, err := url.Parse(signedUploadURL("file name.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(link.String(), "https://forms.example.com/uploads/file%20name.pdf?") {
+		t.Errorf("link = %s, want one under PUBLIC_URL", link)
+	}
+	if !validUploadSignature("file name.pdf", link.Query()) {
+		t.Error("signature of the link is invalid")
+	}
+	if validUploadSignature("other.pdf", link.Query()) {
+		t.Error("signature is valid for another file")
+	}
+	expired := link.Query()
+	expired.Set("expires", "1")
+	if validUploadSignature("file name.pdf", expired) {
+		t.Error("signature is valid with a changed expiry")
+	}
+}
@@ -0,0 +1,536 @@
+// app/users.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Minimum length of a user password
+const minPasswordLength = 10
+
+// Errors returned by the user functions
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+	errUsernameTaken      = errors.New("username is already taken")
+	errWeakPassword       = fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+)
+
+// Hash compared against when a username does not exist, so that unknown
+// usernames take as long to reject as wrong passwords
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("form-handler-dummy-password"), bcrypt.DefaultCost)
+
+// contextKey is the type of the request context keys set by the middleware
+type contextKey string
+
+// Context key of the authenticated user
+const userContextKey contextKey = "user"
+
+// user is an admin account
+type user struct {
+	ID           int64             `json:"id"`
+	Username     string            `json:"username"`
+	MustReset    bool              `json:"must_reset"`
+	TOTPEnabled  bool              `json:"totp_enabled"`
+	SSO          bool              `json:"sso"`
+	Grants       map[string]string `json:"grants"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	passwordHash string
+}
+
+// Return the authenticated user of the request, or nil
+func currentUser(r *http.Request) *user {
+	u, _ := r.Context().Value(userContextKey).(*user)
+	return u
+}
+
+// Return a copy of the request carrying the authenticated user
+func withUser(r *http.Request, u *user) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, u))
+}
+
+// Hash a password with bcrypt after checking its length
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errWeakPassword
+	}
+	return hashPasswordUnchecked(password)
+}
+
+// Hash a password with bcrypt without checking its length
+func hashPasswordUnchecked(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("error hashing password: %v", err)
+	}
+	return string(hash), nil
+}
+
+const userColumns = "id, username, password_hash, must_reset, created_at, updated_at, " +
+	"COALESCE((SELECT enabled FROM totp_credentials WHERE user_id = users.id), 0), " +
+	"EXISTS(SELECT 1 FROM user_identities WHERE user_id = users.id)"
+
+// Scan a user row selected with userColumns
+func scanUser(row interface{ Scan(...interface{}) error }) (*user, error) {
+	var u user
+	if err := row.Scan(&u.ID, &u.Username, &u.passwordHash, &u.MustReset, &u.CreatedAt, &u.UpdatedAt, &u.TOTPEnabled, &u.SSO); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Create a user with a password
+func createUser(username, password string, mustReset bool) (*user, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return createUserWithHash(username, hash, mustReset)
+}
+
+// Create a user with an already hashed password
+func createUserWithHash(username, hash string, mustReset bool) (*user, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, errors.New("username is required")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+
+	now := time.Now().UTC()
+	result, err := db.Exec("INSERT INTO users(username, password_hash, must_reset, created_at, updated_at) VALUES(?, ?, ?, ?, ?)",
+		username, hash, mustReset, now, now)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, errUsernameTaken
+		}
+		return nil, fmt.Errorf("error inserting user: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	return &user{ID: id, Username: username, MustReset: mustReset, Grants: map[string]string{}, CreatedAt: now, UpdatedAt: now, passwordHash: hash}, nil
+}
+
+// Get a user and their grants by ID
+func getUserByID(id int64) (*user, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	u, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return nil, err
+	}
+	return u, loadGrants(db, u)
+}
+
+// Get a user and their grants by username
+func getUserByUsername(username string) (*user, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	u, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if err != nil {
+		return nil, err
+	}
+	return u, loadGrants(db, u)
+}
+
+// List all users
+func listUsers() ([]*user, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("error querying users: %v", err)
+	}
+	defer rows.Close()
+
+	users := []*user{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning user: %v", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, u := range users {
+		if err := loadGrants(db, u); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// Check a username and password and return the matching user
+func authenticateUser(username, password string) (*user, error) {
+	u, err := getUserByUsername(username)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.passwordHash), []byte(password)); err != nil {
+		return nil, errInvalidCredentials
+	}
+	return u, nil
+}
+
+// Set the password of a user and whether it must be changed at the next login
+func setUserPassword(id int64, password string, mustReset bool) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	result, err := db.Exec("UPDATE users SET password_hash = ?, must_reset = ?, updated_at = ? WHERE id = ?", hash, mustReset, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("error updating password: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Require a user to change their password at the next login
+func forceUserPasswordReset(id int64) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	result, err := db.Exec("UPDATE users SET must_reset = 1, updated_at = ? WHERE id = ?", time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("error updating user: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Delete a user
+func deleteUser(id int64) error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	result, err := db.Exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := db.Exec("DELETE FROM form_grants WHERE user_id = ?", id); err != nil {
+		return fmt.Errorf("error deleting grants: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM user_identities WHERE user_id = ?", id); err != nil {
+		return fmt.Errorf("error deleting identities: %v", err)
+	}
+	if err := revokeUserSessions(id, ""); err != nil {
+		return err
+	}
+	if err := deleteUserAPITokens(id); err != nil {
+		return err
+	}
+	return disableTOTP(id)
+}
+
+// Create the first user from ADMIN_USERNAME and ADMIN_PASSWORD when there are no users yet
+func bootstrapAdminUser() error {
+	db, err := getDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		return fmt.Errorf("error counting users: %v", err)
+	}
+	username, password := os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD")
+	if count > 0 || username == "" || password == "" {
+		return nil
+	}
+
+	// Keep existing deployments working, but have weak passwords changed at the first login
+	mustReset := len(password) < minPasswordLength
+	hash, err := hashPasswordUnchecked(password)
+	if err != nil {
+		return err
+	}
+	u, err := createUserWithHash(username, hash, mustReset)
+	if err != nil {
+		return fmt.Errorf("error creating user from ADMIN_USERNAME: %v", err)
+	}
+	if err := setGrants(u.ID, map[string]string{allForms: roleOwner}); err != nil {
+		return err
+	}
+	log.Warnf("Created user %s from ADMIN_USERNAME and ADMIN_PASSWORD, these variables are no longer needed", username)
+	return nil
+}
+
+// Write a JSON error response
+func jsonError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// Handler to view the users page (admin)
+func viewUsersHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/users.html")
+}
+
+// Handler to view the password change page
+func viewPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "/app/backend/password.html")
+}
+
+// API handler to fetch the current user
+func apiAccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentUser(r))
+}
+
+// API handler to fetch the users
+func apiUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := listUsers()
+	if err != nil {
+		log.Errorf("Error fetching users: %v", err)
+		jsonError(w, "Could not fetch users", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+// API handler to create a user
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Username  string            `json:"username"`
+		Password  string            `json:"password"`
+		MustReset bool              `json:"must_reset"`
+		Grants    map[string]string `json:"grants"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for formID, role := range request.Grants {
+		if formID == "" || !validRole(role) {
+			jsonError(w, fmt.Sprintf("Invalid role %q on form %q", role, formID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	u, err := createUser(request.Username, request.Password, request.MustReset)
+	if err != nil {
+		if err == errUsernameTaken || err == errWeakPassword || strings.Contains(err.Error(), "required") {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Errorf("Error creating user: %v", err)
+		jsonError(w, "Could not create user", http.StatusInternalServerError)
+		return
+	}
+	if err := setGrants(u.ID, request.Grants); err != nil {
+		log.Errorf("Error setting grants of user %d: %v", u.ID, err)
+		jsonError(w, "Could not set user roles", http.StatusInternalServerError)
+		return
+	}
+	if request.Grants != nil {
+		u.Grants = request.Grants
+	}
+
+	recordAudit(r, "user.create", u.Username)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u)
+}
+
+// Parse the user ID of the request path and load the user
+func userFromPath(w http.ResponseWriter, r *http.Request) (*user, bool) {
+	var id int64
+	if _, err := fmt.Sscan(mux.Vars(r)["id"], &id); err != nil {
+		jsonError(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+	u, err := getUserByID(id)
+	if err == sql.ErrNoRows {
+		jsonError(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Errorf("Error fetching user %d: %v", id, err)
+		jsonError(w, "Could not fetch user", http.StatusInternalServerError)
+		return nil, false
+	}
+	return u, true
+}
+
+// API handler to delete a user
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r)
+	if !ok {
+		return
+	}
+	if u.ID == currentUser(r).ID {
+		jsonError(w, "You cannot delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := deleteUser(u.ID); err != nil {
+		log.Errorf("Error deleting user %d: %v", u.ID, err)
+		jsonError(w, "Could not delete user", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "user.delete", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API handler to replace the form roles of a user
+func setUserGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r)
+	if !ok {
+		return
+	}
+	if u.ID == currentUser(r).ID {
+		jsonError(w, "You cannot change your own roles", http.StatusBadRequest)
+		return
+	}
+
+	var grants map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&grants); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	for formID, role := range grants {
+		if formID == "" || !validRole(role) {
+			jsonError(w, fmt.Sprintf("Invalid role %q on form %q", role, formID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := setGrants(u.ID, grants); err != nil {
+		log.Errorf("Error setting grants of user %d: %v", u.ID, err)
+		jsonError(w, "Could not set user roles", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, "user.grants", fmt.Sprintf("%s %v", u.Username, grants))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API handler to force a user to change their password at the next login,
+// optionally setting a new temporary password
+func resetUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := userFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Password string `json:"password"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	if request.Password != "" {
+		err = setUserPassword(u.ID, request.Password, true)
+	} else {
+		err = forceUserPasswordReset(u.ID)
+	}
+	if err == errWeakPassword {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error resetting password of user %d: %v", u.ID, err)
+		jsonError(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeUserSessions(u.ID, ""); err != nil {
+		log.Errorf("Error revoking sessions of user %d: %v", u.ID, err)
+	}
+	if err := deleteUserAPITokens(u.ID); err != nil {
+		log.Errorf("Error revoking API tokens of user %d: %v", u.ID, err)
+	}
+
+	recordAudit(r, "user.force_reset", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// API handler to change the password of the current user
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	u := currentUser(r)
+	if _, err := authenticateUser(u.Username, request.CurrentPassword); err != nil {
+		jsonError(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+	if request.NewPassword == request.CurrentPassword {
+		jsonError(w, "New password must differ from the current password", http.StatusBadRequest)
+		return
+	}
+
+	err := setUserPassword(u.ID, request.NewPassword, false)
+	if err == errWeakPassword {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Errorf("Error changing password of user %d: %v", u.ID, err)
+		jsonError(w, "Could not change password", http.StatusInternalServerError)
+		return
+	}
+
+	// Sign out the other browsers, which may be used by someone who knew the old password
+	if err := revokeUserSessions(u.ID, currentSessionToken(r)); err != nil {
+		log.Errorf("Error revoking sessions of user %d: %v", u.ID, err)
+	}
+
+	recordAudit(r, "user.password_change", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
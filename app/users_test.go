@@ -0,0 +1,61 @@
+// app/users_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashing(t *testing.T) {
+	useTestDB(t)
+	const password = "correct horse battery staple"
+	if _, err := createUser("alice", "short", false); err != errWeakPassword {
+		t.Errorf("short password: error %v, want %v", err, errWeakPassword)
+	}
+	u, err := createUser("alice", password, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createUser("alice", password, false); err != errUsernameTaken {
+		t.Errorf("taken username: error %v, want %v", err, errUsernameTaken)
+	}
+
+	// Only a bcrypt hash of the password is stored
+	stored, err := getUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.passwordHash, "$2") || strings.Contains(stored.passwordHash, password) {
+		t.Errorf("stored password hash %q is not a bcrypt hash", stored.passwordHash)
+	}
+
+	tests := []struct {
+		username, password string
+		wantErr            error
+	}{
+		{"alice", password, nil},
+		{"alice", "Correct horse battery staple", errInvalidCredentials},
+		{"alice", "", errInvalidCredentials},
+		{"bob", password, errInvalidCredentials},
+	}
+	for _, tt := range tests {
+		got, err := authenticateUser(tt.username, tt.password)
+		if err != tt.wantErr {
+			t.Errorf("%s with %q: error %v, want %v", tt.username, tt.password, err, tt.wantErr)
+		}
+		if err == nil && got.ID != u.ID {
+			t.Errorf("%s authenticated as user %d, want %d", tt.username, got.ID, u.ID)
+		}
+	}
+
+	// A changed password replaces the old one
+	if err := setUserPassword(u.ID, "another horse battery staple", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateUser("alice", password); err != errInvalidCredentials {
+		t.Errorf("old password after the change: error %v", err)
+	}
+	if got, err := authenticateUser("alice", "another horse battery staple"); err != nil || !got.MustReset {
+		t.Errorf("new password: must reset %t, error %v", got != nil && got.MustReset, err)
+	}
+}
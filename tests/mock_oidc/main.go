@@ -0,0 +1,221 @@
+// tests/mock_oidc/main.go
+//
+// A minimal OpenID Connect provider for testing the single sign-on login of the
+// admin panel. It approves every authorization request without asking for
+// credentials and issues RS256-signed ID tokens. The claims can be set with
+// flags, or per login by appending mock_email, mock_groups and mock_sub to the
+// authorization URL.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authorization is a code issued by the authorization endpoint
+type authorization struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	claims        map[string]interface{}
+}
+
+var (
+	addr     = flag.String("addr", "127.0.0.1:9000", "address to listen on")
+	issuer   = flag.String("issuer", "http://127.0.0.1:9000", "issuer URL")
+	clientID = flag.String("client-id", "form-handler", "accepted client ID")
+	email    = flag.String("email", "admin@example.com", "email claim")
+	groups   = flag.String("groups", "form-admins", "comma-separated groups claim")
+	subject  = flag.String("sub", "", "subject claim, the email when empty")
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes = map[string]authorization{}
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b64(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Sign the claims as an RS256 JWT
+func signJWT(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "mock"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		log.Fatalf("Error signing token: %v", err)
+	}
+	return input + "." + b64(signature)
+}
+
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                *issuer,
+		"authorization_endpoint":                *issuer + "/authorize",
+		"token_endpoint":                        *issuer + "/token",
+		"jwks_uri":                              *issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "mock",
+			"n":   b64(key.N.Bytes()),
+			"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != *clientID || q.Get("response_type") != "code" {
+		http.Error(w, "invalid client_id or response_type", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	claimEmail, claimGroups, claimSubject := *email, *groups, *subject
+	if v := q.Get("mock_email"); v != "" {
+		claimEmail = v
+	}
+	if _, ok := q["mock_groups"]; ok {
+		claimGroups = q.Get("mock_groups")
+	}
+	if v := q.Get("mock_sub"); v != "" {
+		claimSubject = v
+	}
+	if claimSubject == "" {
+		claimSubject = claimEmail
+	}
+	groupList := []string{}
+	for _, group := range strings.Split(claimGroups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groupList = append(groupList, group)
+		}
+	}
+
+	code := randomString()
+	mu.Lock()
+	codes[code] = authorization{
+		clientID:      q.Get("client_id"),
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		claims: map[string]interface{}{
+			"sub":            claimSubject,
+			"email":          claimEmail,
+			"email_verified": true,
+			"groups":         groupList,
+		},
+	}
+	mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	mu.Lock()
+	auth, ok := codes[r.PostForm.Get("code")]
+	delete(codes, r.PostForm.Get("code"))
+	mu.Unlock()
+
+	requestClientID, _, hasBasicAuth := r.BasicAuth()
+	if !hasBasicAuth {
+		requestClientID = r.PostForm.Get("client_id")
+	}
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		requestClientID != auth.clientID || r.PostForm.Get("redirect_uri") != auth.redirectURI {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if b64(sum[:]) != auth.codeChallenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	claims := auth.claims
+	claims["iss"] = *issuer
+	claims["aud"] = auth.clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(5 * time.Minute).Unix()
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signJWT(claims),
+	})
+}
+
+func main() {
+	flag.Parse()
+
+	var err error
+	key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Error generating key: %v", err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discoveryHandler)
+	http.HandleFunc("/jwks", jwksHandler)
+	http.HandleFunc("/authorize", authorizeHandler)
+	http.HandleFunc("/token", tokenHandler)
+
+	log.Printf("Mock OIDC provider listening on %s with issuer %s", *addr, *issuer)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -7,10 +7,12 @@ echo "Running all security tests..."
 tests=(
     "test_input_sanitization.sh"
     "test_rate_limiting.sh"
+    "test_ip_filtering.sh"
     "test_referral_url_validation.sh"
     "test_cors_validation.sh"
     "test_form_field_validation.sh"
     "test_authentication.sh"
+    "test_oidc.sh"
 )
 
 # Execute each test script
@@ -2,13 +2,21 @@
 
 # Define server URL for authentication test
 SERVER_URL="http://localhost:8080/login"
+ADMIN_USERNAME="${ADMIN_USERNAME:-admin}"
+ADMIN_PASSWORD="${ADMIN_PASSWORD:-password}"
+COOKIE_JAR=$(mktemp)
 
 echo "Testing authentication..."
 
+# Fetch the CSRF token of the login form
+curl -s -o /dev/null -c $COOKIE_JAR $SERVER_URL
+csrf_token=$(awk '$6 == "csrf_token" {print $7}' $COOKIE_JAR)
+
 # Test for valid credentials
-response=$(curl -s -o /dev/null -w "%{http_code}" -X POST $SERVER_URL \
-    -F "username=admin" \
-    -F "password=password")
+response=$(curl -s -o /dev/null -w "%{http_code}" -b $COOKIE_JAR -X POST $SERVER_URL \
+    -F "username=$ADMIN_USERNAME" \
+    -F "password=$ADMIN_PASSWORD" \
+    -F "csrf_token=$csrf_token")
 
 # Verify if the response status code is 302 (Found), indicating a successful login
 if [ "$response" -eq 302 ]; then
@@ -17,10 +25,16 @@ else
     echo "Authentication Test (valid credentials): Failed"
 fi
 
+# The login starts a new session, so fetch the login form again
+rm -f $COOKIE_JAR
+curl -s -o /dev/null -c $COOKIE_JAR $SERVER_URL
+csrf_token=$(awk '$6 == "csrf_token" {print $7}' $COOKIE_JAR)
+
 # Test for invalid credentials
-response=$(curl -s -o /dev/null -w "%{http_code}" -X POST $SERVER_URL \
-    -F "username=admin" \
-    -F "password=wrongpassword")
+response=$(curl -s -o /dev/null -w "%{http_code}" -b $COOKIE_JAR -X POST $SERVER_URL \
+    -F "username=$ADMIN_USERNAME" \
+    -F "password=wrongpassword" \
+    -F "csrf_token=$csrf_token")
 
 # Verify if the response status code is 401 (Unauthorized)
 if [ "$response" -eq 401 ]; then
@@ -28,3 +42,17 @@ if [ "$response" -eq 401 ]; then
 else
     echo "Authentication Test (invalid credentials): Failed"
 fi
+
+# Test a login without the CSRF token
+response=$(curl -s -o /dev/null -w "%{http_code}" -b $COOKIE_JAR -X POST $SERVER_URL \
+    -F "username=$ADMIN_USERNAME" \
+    -F "password=$ADMIN_PASSWORD")
+
+# Verify if the response status code is 403 (Forbidden)
+if [ "$response" -eq 403 ]; then
+    echo "Authentication Test (missing CSRF token): Passed"
+else
+    echo "Authentication Test (missing CSRF token): Failed"
+fi
+
+rm -f $COOKIE_JAR
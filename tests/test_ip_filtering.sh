@@ -0,0 +1,45 @@
+#!/bin/bash
+
+# Define server URL, referer URL, and origin for IP filtering test
+SERVER_URL="http://localhost:8080"
+REFERER_URL="http://127.0.0.1:8000/"
+ORIGIN="http://127.0.0.1:8000"
+ADMIN_USERNAME="${ADMIN_USERNAME:-admin}"
+ADMIN_PASSWORD="${ADMIN_PASSWORD:-password}"
+COOKIE_JAR=$(mktemp)
+
+echo "Testing IP filtering..."
+
+# Log in to manage the IP rules, the CSRF token is replaced at login
+curl -s -o /dev/null -c $COOKIE_JAR $SERVER_URL/login
+curl -s -o /dev/null -b $COOKIE_JAR -c $COOKIE_JAR -X POST $SERVER_URL/login \
+    -F "username=$ADMIN_USERNAME" \
+    -F "password=$ADMIN_PASSWORD" \
+    -F "csrf_token=$(awk '$6 == "csrf_token" {print $7}' $COOKIE_JAR)"
+csrf_token=$(awk '$6 == "csrf_token" {print $7}' $COOKIE_JAR)
+
+# Deny the local address range
+curl -s -o /dev/null -b $COOKIE_JAR -X POST $SERVER_URL/api/ip-rules \
+    -H "X-CSRF-Token: $csrf_token" \
+    -H "Content-Type: application/json" \
+    -d '{"cidr": "127.0.0.0/8", "action": "deny", "note": "test_ip_filtering.sh"}'
+
+response=$(curl -s -o /dev/null -w "%{http_code}" -X POST $SERVER_URL/api/forms \
+    -H "Referer: $REFERER_URL" \
+    -H "Origin: $ORIGIN" \
+    -F "formid=g7h8i9j0k1l2" \
+    -F "email=jane.doe@example.com" \
+    -F "message=Hello, this is a test message")
+
+# Verify if the response status code is 403 (Forbidden)
+if [ "$response" -eq 403 ]; then
+    echo "IP Filtering Test (denied IP): Passed"
+else
+    echo "IP Filtering Test (denied IP): Failed"
+fi
+
+# Remove the rule again
+rule_id=$(curl -s -b $COOKIE_JAR $SERVER_URL/api/ip-rules | grep -o '"id":[0-9]*,"form_id":"","cidr":"127.0.0.0/8"' | grep -o '[0-9]*' | head -1)
+curl -s -o /dev/null -b $COOKIE_JAR -H "X-CSRF-Token: $csrf_token" -X DELETE $SERVER_URL/api/ip-rules/$rule_id
+
+rm -f $COOKIE_JAR
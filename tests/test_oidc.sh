@@ -0,0 +1,80 @@
+#!/bin/bash
+
+# Test the single sign-on login against the mock OIDC provider in tests/mock_oidc.
+# The server must be configured with:
+#   "oidc": {
+#       "issuer": "http://127.0.0.1:9000",
+#       "client_id": "form-handler",
+#       "redirect_url": "http://localhost:8080/login/oidc/callback",
+#       "allowed_domains": ["example.com"],
+#       "group_roles": {"form-admins": {"*": "owner"}}
+#   }
+# The mock provider is started when it is not already running.
+SERVER_URL="http://localhost:8080"
+MOCK_URL="http://127.0.0.1:9000"
+COOKIE_JAR=$(mktemp)
+
+echo "Testing OIDC single sign-on..."
+
+if ! curl -s $SERVER_URL/api/login-options | grep -q '"sso"'; then
+    echo "OIDC Test: Skipped (single sign-on is not configured)"
+    rm -f $COOKIE_JAR
+    exit 0
+fi
+
+MOCK_PID=""
+if ! curl -s -o /dev/null $MOCK_URL/.well-known/openid-configuration; then
+    (cd "$(dirname "$0")/mock_oidc" && go build -o "$COOKIE_JAR.mock" . ) || exit 1
+    "$COOKIE_JAR.mock" -addr 127.0.0.1:9000 -issuer $MOCK_URL 2>/dev/null &
+    MOCK_PID=$!
+    sleep 1
+fi
+
+# Log in at the mock provider with the given email and groups, and print the
+# status code and redirect of the callback
+sso_login() {
+    local auth_url callback_url
+    rm -f $COOKIE_JAR
+    auth_url=$(curl -s -o /dev/null -c $COOKIE_JAR -w "%{redirect_url}" $SERVER_URL/login/oidc)
+    callback_url=$(curl -s -o /dev/null -w "%{redirect_url}" "$auth_url&mock_email=$1&mock_groups=$2")
+    curl -s -o /dev/null -b $COOKIE_JAR -c $COOKIE_JAR -w "%{http_code} %{redirect_url}" "$callback_url"
+    echo "$callback_url" > "$COOKIE_JAR.callback"
+}
+
+# Test a user in an allowed domain and a mapped group
+response=$(sso_login "sso.admin@example.com" "form-admins")
+api_response=$(curl -s -o /dev/null -b $COOKIE_JAR -w "%{http_code}" $SERVER_URL/api/submissions)
+if [ "${response%% *}" -eq 200 ] && [ "$api_response" -eq 200 ]; then
+    echo "OIDC Test (allowed user): Passed"
+else
+    echo "OIDC Test (allowed user): Failed"
+fi
+
+# Test that the callback cannot be replayed
+response=$(curl -s -o /dev/null -b $COOKIE_JAR -w "%{http_code}" "$(cat $COOKIE_JAR.callback)")
+if [ "$response" -eq 400 ] || [ "$response" -eq 401 ]; then
+    echo "OIDC Test (replayed callback): Passed"
+else
+    echo "OIDC Test (replayed callback): Failed"
+fi
+
+# Test a user outside the allowed domains
+response=$(sso_login "mallory@example.org" "form-admins")
+if [ "${response%% *}" -eq 403 ]; then
+    echo "OIDC Test (disallowed domain): Passed"
+else
+    echo "OIDC Test (disallowed domain): Failed"
+fi
+
+# Test a user without a mapped group
+response=$(sso_login "nobody@example.com" "")
+if [ "${response%% *}" -eq 403 ]; then
+    echo "OIDC Test (unmapped groups): Passed"
+else
+    echo "OIDC Test (unmapped groups): Failed"
+fi
+
+if [ -n "$MOCK_PID" ]; then
+    kill $MOCK_PID
+fi
+rm -f $COOKIE_JAR $COOKIE_JAR.callback $COOKIE_JAR.mock